@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ImageMetadata is the body of GET /api/v1/images/{id}.
+type ImageMetadata struct {
+	ID                string            `json:"id"`
+	ContentType       string            `json:"content_type"`
+	Size              int               `json:"size"`
+	Width             int               `json:"width,omitempty"`
+	Height            int               `json:"height,omitempty"`
+	UpstreamLatencyMs int64             `json:"upstream_latency_ms"`
+	Cache             string            `json:"cache"`
+	Parameters        map[string]string `json:"parameters"`
+	ContentURL        string            `json:"content_url"`
+}
+
+// ImageStatus is the body of GET /api/v1/images/{id}/status.
+type ImageStatus struct {
+	ID          string `json:"id"`
+	Exists      bool   `json:"exists"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Cached      bool   `json:"cached"`
+}
+
+// ImageEXIF is the body of GET /api/v1/images/{id}/exif: the EXIF and XMP
+// of an image, normalized so the same fields are filled whichever of the two
+// carried them.
+type ImageEXIF struct {
+	ID           string                 `json:"id"`
+	Source       string                 `json:"source"` // "preview" or "raw"
+	Width        int                    `json:"width,omitempty"`
+	Height       int                    `json:"height,omitempty"`
+	Orientation  int                    `json:"orientation"`
+	CaptureDate  string                 `json:"capture_date,omitempty"`
+	Make         string                 `json:"make,omitempty"`
+	Model        string                 `json:"model,omitempty"`
+	LensModel    string                 `json:"lens_model,omitempty"`
+	Software     string                 `json:"software,omitempty"`
+	Artist       string                 `json:"artist,omitempty"`
+	Copyright    string                 `json:"copyright,omitempty"`
+	Description  string                 `json:"description,omitempty"`
+	Keywords     []string               `json:"keywords,omitempty"`
+	ExposureTime string                 `json:"exposure_time,omitempty"`
+	FNumber      float64                `json:"f_number,omitempty"`
+	ISO          int                    `json:"iso,omitempty"`
+	FocalLength  float64                `json:"focal_length_mm,omitempty"`
+	GPS          *GPSPosition           `json:"gps,omitempty"`
+	Found        []string               `json:"found"` // "exif", "xmp"
+	XMP          map[string]interface{} `json:"xmp,omitempty"`
+}
+
+// GPSPosition is where an image was taken, in decimal degrees and metres.
+type GPSPosition struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// ImagePlaceholder is the body of GET /api/v1/images/{id}/placeholder: a
+// blurred stand-in clients can show while the image loads.
+type ImagePlaceholder struct {
+	ID       string `json:"id"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Blurhash string `json:"blurhash"`
+	DataURI  string `json:"data_uri"` // a JPEG at most 32 pixels a side
+}
+
+// SrcSet is the body of GET /api/v1/images/{id}/srcset: the URLs of an
+// image at several widths, ready to use in <img srcset>.
+type SrcSet struct {
+	ID       string          `json:"id"`
+	Width    int             `json:"width"`
+	Height   int             `json:"height"`
+	Src      string          `json:"src"`
+	Srcset   string          `json:"srcset"`
+	Sizes    string          `json:"sizes"`
+	Variants []SrcSetVariant `json:"variants"`
+}
+
+// SrcSetVariant is one width of a SrcSet.
+type SrcSetVariant struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+func sendJSON(w http.ResponseWriter, v interface{}, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// imageActions maps the path segment after /api/v1/images/{id} to its
+// handler; the empty action is the image itself.
+var imageActions = map[string]func(http.ResponseWriter, *http.Request, string){
+	"":            handleImageMetadata,
+	"content":     handleImageContent,
+	"status":      handleImageStatus,
+	"exif":        handleImageEXIF,
+	"placeholder": handleImagePlaceholder,
+	"srcset":      handleImageSrcset,
+}
+
+// handleImagesAPI routes everything under /api/v1/images/.
+func handleImagesAPI(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/images/")
+	photoId, action, _ := strings.Cut(rest, "/")
+
+	if photoId == "" {
+		sendJSONError(w, codeMissingID, "Image ID required", "Please provide a valid image identifier", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	handler, ok := imageActions[action]
+	if !ok {
+		sendJSONError(w, codeUnknownEndpoint, "Not found", fmt.Sprintf("Unknown endpoint %s", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	handler(w, r, photoId)
+}
+
+// handleImageMetadata describes an image, fetching it first if it isn't
+// cached yet so its dimensions can be read.
+func handleImageMetadata(w http.ResponseWriter, r *http.Request, photoId string) {
+	logf("%s /api/v1/images/%s - Client: %s", r.Method, photoId, r.RemoteAddr)
+
+	entry, hit, err := loadImage(r.Context(), photoId)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	// Describe the image as /content sends it.
+	entry = sanitizedEntry(photoId, entry)
+
+	meta := ImageMetadata{
+		ID:                photoId,
+		ContentType:       entry.ContentType,
+		Size:              len(entry.Data),
+		UpstreamLatencyMs: entry.UpstreamLatency.Milliseconds(),
+		Cache:             "miss",
+		Parameters:        tempestParameters(),
+		ContentURL:        "/api/v1/images/" + url.PathEscape(photoId) + "/content",
+	}
+	if hit {
+		meta.Cache = "hit"
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(entry.Data)); err == nil {
+		meta.Width, meta.Height = cfg.Width, cfg.Height
+	}
+	sendJSON(w, meta, http.StatusOK)
+}
+
+// handleImageContent sends the image bytes.
+func handleImageContent(w http.ResponseWriter, r *http.Request, photoId string) {
+	logf("%s /api/v1/images/%s/content - Client: %s", r.Method, photoId, r.RemoteAddr)
+
+	if keyWatermarks(w, r) {
+		serveRendered(w, r, photoId, renderOptions{Watermark: true})
+		return
+	}
+
+	entry, hit, err := loadImage(r.Context(), photoId)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+
+	serveImageEntry(w, r, sanitizedEntry(photoId, entry), hit)
+}
+
+// handleImageStatus reports whether an image exists without sending it,
+// answering from the cache when it can.
+func handleImageStatus(w http.ResponseWriter, r *http.Request, photoId string) {
+	logf("%s /api/v1/images/%s/status - Client: %s", r.Method, photoId, r.RemoteAddr)
+
+	if entry, ok := images.Get(photoId); ok {
+		sendJSON(w, ImageStatus{
+			ID:          photoId,
+			Exists:      true,
+			ContentType: entry.ContentType,
+			Size:        int64(len(entry.Data)),
+			Cached:      true,
+		}, http.StatusOK)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), tempestTimeout)
+	defer cancel()
+
+	probe, err := probeTempestImage(ctx, photoId)
+	if err == nil {
+		err = checkDeclaredType(photoId, probe.ContentType)
+	}
+	if err != nil {
+		if te, ok := err.(*tempestError); ok && te.Status == http.StatusNotFound {
+			sendJSON(w, ImageStatus{ID: photoId, Exists: false}, http.StatusNotFound)
+			return
+		}
+		sendTempestError(w, err)
+		return
+	}
+
+	status := ImageStatus{ID: photoId, Exists: true, ContentType: probe.ContentType}
+	if probe.Size >= 0 {
+		status.Size = probe.Size
+	}
+	sendJSON(w, status, http.StatusOK)
+}
+
+// handleImageEXIF reports the EXIF and XMP of an image. With raw=true it
+// reads the raw preview, which keeps more of the camera's metadata.
+func handleImageEXIF(w http.ResponseWriter, r *http.Request, photoId string) {
+	logf("%s /api/v1/images/%s/exif - Client: %s", r.Method, photoId, r.RemoteAddr)
+
+	raw := false
+	if s := r.URL.Query().Get("raw"); s != "" {
+		var err error
+		if raw, err = strconv.ParseBool(s); err != nil {
+			sendTempestError(w, invalidParameterError("raw must be true or false"))
+			return
+		}
+	}
+
+	load, source := loadImage, "preview"
+	if raw {
+		load, source = loadRawImage, "raw"
+	}
+	entry, _, err := load(r.Context(), photoId)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+
+	info := describeMetadata(entry.Data, metadataToRemove)
+	info.ID, info.Source = photoId, source
+	sendJSON(w, info, http.StatusOK)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKey is a key accepted in the X-API-Key header and what it implies.
+type apiKey struct {
+	Key string
+	// Watermark marks every image served to a request carrying the key,
+	// from /fetch-photo, /fetch-photos, /api/v1/images/{id}/content, IIIF,
+	// contact sheets and jobs, and every link it mints. Placeholders are
+	// left alone. It isn't access control: the same images can be fetched
+	// without the key.
+	Watermark bool
+}
+
+// apiKeys are read from -api-keys-file at startup; without one, endpoints
+// that need a key are disabled.
+var apiKeys []apiKey
+
+// loadAPIKeys reads one key per line, optionally followed by the word
+// watermark, skipping blank lines and # comments.
+func loadAPIKeys(path string) ([]apiKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []apiKey
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key := apiKey{Key: fields[0]}
+		if len(key.Key) < 16 {
+			return nil, fmt.Errorf("line %d: keys must be at least 16 characters long", line)
+		}
+		for _, option := range fields[1:] {
+			switch option {
+			case "watermark":
+				key.Watermark = true
+			default:
+				return nil, fmt.Errorf("line %d: unknown option %q", line, option)
+			}
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+	return keys, nil
+}
+
+// requestAPIKey finds the key sent in the X-API-Key header of r, if it is
+// one of apiKeys.
+func requestAPIKey(r *http.Request) (apiKey, bool) {
+	given := r.Header.Get("X-API-Key")
+	if given == "" {
+		return apiKey{}, false
+	}
+	// Compare against every key so the time taken doesn't say which matched.
+	match := -1
+	for i, key := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key.Key)) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return apiKey{}, false
+	}
+	return apiKeys[match], true
+}
+
+// apiKeyID identifies key in saved records without keeping the key itself.
+func apiKeyID(key apiKey) string {
+	sum := sha256.Sum256([]byte(key.Key))
+	return hex.EncodeToString(sum[:])
+}
+
+// keysWatermark reports whether any key watermarks what it fetches, in
+// which case responses vary on X-API-Key.
+func keysWatermark() bool {
+	for _, key := range apiKeys {
+		if key.Watermark {
+			return true
+		}
+	}
+	return false
+}
+
+// keyWatermarks reports whether the API key r carries forces a watermark.
+// Whenever any key can, it notes on w that the response varies on it.
+func keyWatermarks(w http.ResponseWriter, r *http.Request) bool {
+	if !keysWatermark() {
+		return false
+	}
+	w.Header().Add("Vary", "X-API-Key")
+	key, ok := requestAPIKey(r)
+	return ok && key.Watermark
+}
+
+// requireAPIKey checks the X-API-Key header of r, answering the request
+// itself and returning false if it isn't one of apiKeys.
+func requireAPIKey(w http.ResponseWriter, r *http.Request) (apiKey, bool) {
+	if len(apiKeys) == 0 {
+		sendJSONError(w, codeInvalidAPIKey, "API keys not configured", "This server has no API keys; start it with -api-keys-file to use this endpoint", http.StatusForbidden)
+		return apiKey{}, false
+	}
+	if r.Header.Get("X-API-Key") == "" {
+		sendJSONError(w, codeAPIKeyRequired, "API key required", "Send an API key in the X-API-Key header", http.StatusUnauthorized)
+		return apiKey{}, false
+	}
+	key, ok := requestAPIKey(r)
+	if !ok {
+		logf("DENIED: Unknown API key from %s", r.RemoteAddr)
+		sendJSONError(w, codeInvalidAPIKey, "Invalid API key", "The key in the X-API-Key header is not recognized", http.StatusUnauthorized)
+		return apiKey{}, false
+	}
+	return key, true
+}
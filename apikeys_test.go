@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testWatermarkKey = "watermark-key-0123456789"
+
+// withWatermarkingKey configures a text watermark and one API key that
+// forces it, for one test.
+func withWatermarkingKey(t *testing.T) {
+	mark, err := loadWatermark("", "Mark", "center", 1, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldMark, oldKeys := studioMark, apiKeys
+	studioMark, apiKeys = mark, []apiKey{{Key: testWatermarkKey, Watermark: true}}
+	t.Cleanup(func() { studioMark, apiKeys = oldMark, oldKeys })
+}
+
+func grayJPEG(t *testing.T, size int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Rect, image.NewUniform(color.RGBA{128, 128, 128, 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestKeyWatermarksEveryImageEndpoint(t *testing.T) {
+	fakeTempest(t, map[string][]byte{"abc": grayJPEG(t, 256)})
+	withWatermarkingKey(t)
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		mux.HandleFunc(rt.pattern, rt.handler)
+	}
+
+	for _, path := range []string{
+		"/fetch-photo?id=abc",
+		"/fetch-photos?ids=abc",
+		"/api/v1/images/abc/content",
+		"/iiif/abc/full/max/0/default.jpg",
+		"/api/v1/contact-sheet?ids=abc",
+	} {
+		get := func(key string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if key != "" {
+				req.Header.Set("X-API-Key", key)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: status %d: %s", path, rec.Code, rec.Body)
+			}
+			return rec
+		}
+		plain, marked := get(""), get(testWatermarkKey)
+		if bytes.Equal(plain.Body.Bytes(), marked.Body.Bytes()) {
+			t.Errorf("%s: the watermarking key got the unmarked image", path)
+		}
+		if vary := strings.Join(plain.Header().Values("Vary"), ", "); !strings.Contains(vary, "X-API-Key") {
+			t.Errorf("%s: Vary is %q, want it to include X-API-Key", path, vary)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	maxArchiveIDs     = 200
+	archiveFetchSlots = 4
+)
+
+// parsePhotoIDs splits a list of image IDs separated by commas, spaces or
+// newlines, dropping blanks and duplicates while keeping the original order.
+func parsePhotoIDs(s string) []string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	seen := make(map[string]bool, len(fields))
+	ids := make([]string, 0, len(fields))
+	for _, id := range fields {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// imageExtension picks a file extension for an image content type.
+func imageExtension(contentType string) string {
+	switch strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]) {
+	case "image/jpeg", "image/jpg", "image/pjpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/tiff":
+		return ".tif"
+	default:
+		return ".bin"
+	}
+}
+
+// hashedNameSuffix matches the suffix archiveFileName adds.
+var hashedNameSuffix = regexp.MustCompile(`-[0-9a-f]{8}$`)
+
+// archiveFileName turns an image ID into something safe to use as a zip entry
+// or file name. An ID that had to be changed, or that already ends like one
+// that was, gets the start of its SHA-256 appended, so IDs such as a/b and
+// a_b don't end up with the same name.
+func archiveFileName(photoId string) string {
+	name := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		if r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, photoId)
+	if name == photoId && !hashedNameSuffix.MatchString(name) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(photoId))
+	return name + "-" + hex.EncodeToString(sum[:4])
+}
+
+// archiveEntryName is the name an image is stored under in archives and
+// download directories.
+func archiveEntryName(photoId, contentType string) string {
+	return archiveFileName(photoId) + imageExtension(contentType)
+}
+
+// archiveFailure records an image left out of an archive.
+type archiveFailure struct {
+	ID string `json:"id"`
+	ErrorResponse
+}
+
+type archiveResult struct {
+	photoId     string
+	contentType string
+	data        []byte
+	err         error
+}
+
+// fetchArchiveImage loads one image for an archive.
+func fetchArchiveImage(ctx context.Context, photoId string) archiveResult {
+	entry, _, err := loadImage(ctx, photoId)
+	if err != nil {
+		return archiveResult{photoId: photoId, err: err}
+	}
+	entry = sanitizedEntry(photoId, entry)
+	return archiveResult{photoId: photoId, contentType: entry.ContentType, data: entry.Data}
+}
+
+// handleFetchPhotos streams a zip archive of every image listed in the ids
+// query parameter. Images that can't be fetched are left out of the archive
+// and reported in errors.json with the same ErrorResponse shape /fetch-photo
+// uses.
+func handleFetchPhotos(w http.ResponseWriter, r *http.Request) {
+	ids := parsePhotoIDs(r.URL.Query().Get("ids"))
+	clientIP := r.RemoteAddr
+
+	logf("%s /fetch-photos - Client: %s - IDs: %d", r.Method, clientIP, len(ids))
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(ids) == 0 {
+		logf("ERROR: Missing photo IDs from %s", clientIP)
+		sendJSONError(w, codeMissingID, "Image IDs required", "Please provide one or more image identifiers separated by commas, spaces or newlines", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxArchiveIDs {
+		sendJSONError(w, codeTooManyIDs, "Too many image IDs", fmt.Sprintf("At most %d images can be downloaded at once", maxArchiveIDs), http.StatusBadRequest)
+		return
+	}
+
+	opts := renderOptions{Watermark: keyWatermarks(w, r)}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="tempest-images.zip"`)
+	// The archive's length isn't known until every image has been fetched,
+	// so HEAD only checks the IDs.
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Fetch a few images ahead while the archive is written in request order.
+	results := make([]chan archiveResult, len(ids))
+	for i := range results {
+		results[i] = make(chan archiveResult, 1)
+	}
+	slots := make(chan struct{}, archiveFetchSlots)
+	go func() {
+		for i, id := range ids {
+			select {
+			case slots <- struct{}{}:
+			case <-r.Context().Done():
+				return
+			}
+			go func(i int, id string) {
+				results[i] <- fetchJobImage(r.Context(), id, opts)
+			}(i, id)
+		}
+	}()
+
+	zw := zip.NewWriter(w)
+	var failures []archiveFailure
+	for i := range ids {
+		var res archiveResult
+		select {
+		case res = <-results[i]:
+			<-slots
+		case <-r.Context().Done():
+			return
+		}
+
+		if res.err != nil {
+			failures = append(failures, archiveFailure{ID: res.photoId, ErrorResponse: errorResponseFor(res.err)})
+			continue
+		}
+		// Images are already compressed, so store them as-is.
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     archiveEntryName(res.photoId, res.contentType),
+			Method:   zip.Store,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			return
+		}
+		if _, err := f.Write(res.data); err != nil {
+			return
+		}
+	}
+
+	if len(failures) > 0 {
+		f, err := zw.Create("errors.json")
+		if err == nil {
+			enc := json.NewEncoder(f)
+			enc.SetIndent("", "  ")
+			enc.Encode(failures)
+		}
+	}
+	zw.Close()
+
+	logf("SUCCESS: Served archive of %d/%d images to %s", len(ids)-len(failures), len(ids), clientIP)
+}
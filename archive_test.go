@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestArchiveFileName(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{"abc123", "abc123"},
+		{"a_b", "a_b"},
+		{"a/b", "a_b-c14cddc0"},
+		{"a:b", "a_b-6783a31e"},
+		{"tab\there", "tab_here-5b876593"},
+		{"x-0123abcd", "x-0123abcd-6324b7ee"},
+		{"x-0123ABCD", "x-0123ABCD"},
+	}
+	seen := make(map[string]string)
+	for _, tt := range tests {
+		got := archiveFileName(tt.id)
+		if got != tt.want {
+			t.Errorf("archiveFileName(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("%q and %q are both named %q", other, tt.id, got)
+		}
+		seen[got] = tt.id
+	}
+}
+
+func TestFetchPhotosHeadDoesNotFetch(t *testing.T) {
+	var fetches atomic.Int64
+	srv := fakeTempest(t, nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	rec := httptest.NewRecorder()
+	handleFetchPhotos(rec, httptest.NewRequest(http.MethodHead, "/fetch-photos?ids=a,b,c", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("Content-Type %q, want application/zip", ct)
+	}
+	if n := fetches.Load(); n != 0 {
+		t.Errorf("HEAD made %d upstream requests, want 0", n)
+	}
+
+	rec = httptest.NewRecorder()
+	handleFetchPhotos(rec, httptest.NewRequest(http.MethodHead, "/fetch-photos", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("HEAD without IDs: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	imageCacheMaxBytes = 256 << 20
+	imageCacheTTL      = time.Hour
+)
+
+// cacheEntry is a fully downloaded image kept in memory.
+type cacheEntry struct {
+	ContentType string
+	Data        []byte
+	FetchedAt   time.Time
+	// UpstreamLatency is how long Tempest took to deliver the image.
+	UpstreamLatency time.Duration
+	// ETag is always set; LastModified only when Tempest sent one.
+	ETag         string
+	LastModified time.Time
+	// MetadataRemoved lists what sanitizedEntry took out of a copy.
+	MetadataRemoved []string
+	// Digest is the SHA-256 of Data, sent as Repr-Digest and checked again
+	// whenever the entry is read from the cache.
+	Digest []byte
+}
+
+// imageCache is a size-bounded LRU of images. Entries expire after the same
+// hour browsers are told to cache them for.
+type imageCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type cacheItem struct {
+	key   string
+	entry *cacheEntry
+}
+
+var images = newImageCache(imageCacheMaxBytes, imageCacheTTL)
+
+func newImageCache(maxBytes int64, ttl time.Duration) *imageCache {
+	return &imageCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry stored under key if it hasn't expired and still
+// matches its digest. An entry that doesn't is dropped, so the image is
+// fetched or rendered again.
+func (c *imageCache) Get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	item := el.Value.(*cacheItem)
+	if time.Since(item.entry.FetchedAt) > c.ttl {
+		c.remove(el)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	c.mu.Unlock()
+
+	// Hashing a large image takes a while, so it is done without the lock.
+	if item.entry.Digest != nil && !bytes.Equal(contentDigest(item.entry.Data), item.entry.Digest) {
+		logf("CORRUPT: Cached %s no longer matches its digest; dropping it", key)
+		c.mu.Lock()
+		if c.items[key] == el {
+			c.remove(el)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	return item.entry, true
+}
+
+// Put stores entry under key, evicting the least recently used entries to
+// stay within the size limit. Entries larger than the whole cache are not
+// stored.
+func (c *imageCache) Put(key string, entry *cacheEntry) {
+	size := int64(len(entry.Data))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.order.PushFront(&cacheItem{key: key, entry: entry})
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *imageCache) remove(el *list.Element) {
+	item := el.Value.(*cacheItem)
+	c.order.Remove(el)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.entry.Data))
+}
+
+// digestIndexSize bounds how many image digests are remembered.
+const digestIndexSize = 50000
+
+// digestIndex remembers the SHA-256 of each image fetched in full, with the
+// ETag it had, so Repr-Digest can still be sent after the image has left the
+// cache and only part of it, or none of it, passes through again.
+type digestIndex struct {
+	mu    sync.Mutex
+	items map[string]knownDigest
+}
+
+type knownDigest struct {
+	etag   string
+	digest []byte
+}
+
+var upstreamDigests = &digestIndex{items: make(map[string]knownDigest)}
+
+// Remember records the digest of photoId while it has etag. When the index
+// is full an arbitrary entry makes room.
+func (d *digestIndex) Remember(photoId, etag string, digest []byte) {
+	if etag == "" || digest == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.items[photoId]; !ok && len(d.items) >= digestIndexSize {
+		for id := range d.items {
+			delete(d.items, id)
+			break
+		}
+	}
+	d.items[photoId] = knownDigest{etag, digest}
+}
+
+// Lookup returns the digest remembered for photoId if it still has etag,
+// or nil.
+func (d *digestIndex) Lookup(photoId, etag string) []byte {
+	if etag == "" {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if known, ok := d.items[photoId]; ok && known.etag == etag {
+		return known.digest
+	}
+	return nil
+}
+
+// Forget drops what is remembered about photoId.
+func (d *digestIndex) Forget(photoId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.items, photoId)
+}
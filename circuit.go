@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamErrorWindow is the period over which -upstream-5xx-alert counts
+// 5xx responses from Tempest.
+const upstreamErrorWindow = time.Minute
+
+// circuitBreaker stops requests to Tempest for -circuit-cooldown once
+// -circuit-failures requests in a row have failed, so an outage is reported
+// at once instead of after a timeout per image. After the cooldown one
+// request is let through: if it succeeds the circuit closes again,
+// otherwise it stays open for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int // in a row
+	openUntil time.Time
+	open      bool
+	probing   bool // a request is testing whether Tempest has recovered
+	lastError string
+
+	// 5xx responses in the current window, for -upstream-5xx-alert.
+	windowStart time.Time
+	errors5xx   int
+	alerted     bool
+}
+
+var tempestCircuit circuitBreaker
+
+// circuitOpenError is the 503 sent while the circuit is open.
+func circuitOpenError(retryAt time.Time) *tempestError {
+	return &tempestError{codeCircuitOpen, "Service unavailable", fmt.Sprintf("The Tempest API has been failing; requests are paused until %s", retryAt.UTC().Format(time.RFC3339)), http.StatusServiceUnavailable}
+}
+
+// allow reports whether a request may be sent to Tempest, or returns the
+// error to answer with instead. probe is set for the one request let
+// through to test whether Tempest has recovered; its outcome must be passed
+// to record or abandon.
+func (c *circuitBreaker) allow() (probe bool, err error) {
+	if *circuitFailures <= 0 {
+		return false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.open {
+		return false, nil
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return false, circuitOpenError(c.openUntil)
+	}
+	c.probing = true
+	return true, nil
+}
+
+// circuitEvent is a webhook event raised by the circuit breaker, sent once
+// its lock has been released.
+type circuitEvent struct {
+	event string
+	data  map[string]interface{}
+}
+
+// record notes the outcome of a request to Tempest. probe is what allow
+// returned for it; failed is set for connection errors, timeouts and 5xx
+// responses; status is the response status, or 0 if there wasn't one.
+func (c *circuitBreaker) record(probe bool, failed bool, status int, detail string) {
+	// Saving a webhook delivery syncs to disk, which mustn't hold up every
+	// other request to Tempest.
+	for _, e := range c.update(probe, failed, status, detail) {
+		notifyWebhooks(e.event, e.data)
+	}
+}
+
+// abandon notes a request that never got an answer for reasons that say
+// nothing about Tempest, such as the client going away. If it was the probe,
+// the next request becomes the probe instead.
+func (c *circuitBreaker) abandon(probe bool) {
+	if !probe {
+		return
+	}
+	c.mu.Lock()
+	c.probing = false
+	c.mu.Unlock()
+}
+
+// update is record with the lock held, returning the events to send.
+func (c *circuitBreaker) update(probe bool, failed bool, status int, detail string) []circuitEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var events []circuitEvent
+
+	if status >= 500 && *upstream5xxAlert > 0 {
+		if now.Sub(c.windowStart) > upstreamErrorWindow {
+			c.windowStart, c.errors5xx, c.alerted = now, 0, false
+		}
+		c.errors5xx++
+		if c.errors5xx >= *upstream5xxAlert && !c.alerted {
+			c.alerted = true
+			logf("ALERT: Tempest returned %d 5xx responses in the last %s", c.errors5xx, upstreamErrorWindow)
+			events = append(events, circuitEvent{eventUpstreamErrors, map[string]interface{}{
+				"count":          c.errors5xx,
+				"window_seconds": int(upstreamErrorWindow / time.Second),
+				"last_status":    status,
+			}})
+		}
+	}
+
+	if *circuitFailures <= 0 {
+		return events
+	}
+	if c.open && !probe {
+		// A request sent before the circuit opened; only the probe
+		// decides whether it closes.
+		return events
+	}
+	c.probing = false
+	if !failed {
+		c.failures = 0
+		if c.open {
+			c.open = false
+			logf("CIRCUIT CLOSED: Tempest is answering again")
+			events = append(events, circuitEvent{eventCircuitClosed, map[string]interface{}{}})
+		}
+		return events
+	}
+
+	c.failures++
+	c.lastError = detail
+	if c.open || c.failures >= *circuitFailures {
+		c.openUntil = now.Add(*circuitCooldown)
+		if !c.open {
+			c.open = true
+			logf("CIRCUIT OPEN: %d Tempest requests in a row failed; pausing requests for %s", c.failures, *circuitCooldown)
+			events = append(events, circuitEvent{eventCircuitOpened, map[string]interface{}{
+				"failures":         c.failures,
+				"last_error":       c.lastError,
+				"cooldown_seconds": int(*circuitCooldown / time.Second),
+				"retry_at":         c.openUntil.UTC(),
+			}})
+		}
+	}
+	return events
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// withCircuitSettings sets the circuit breaker flags for one test.
+func withCircuitSettings(t *testing.T, failures int, cooldown time.Duration) {
+	oldFailures, oldCooldown := *circuitFailures, *circuitCooldown
+	*circuitFailures, *circuitCooldown = failures, cooldown
+	t.Cleanup(func() { *circuitFailures, *circuitCooldown = oldFailures, oldCooldown })
+}
+
+func TestCircuitBreakerOpensAndCloses(t *testing.T) {
+	withCircuitSettings(t, 3, 20*time.Millisecond)
+	var c circuitBreaker
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.allow(); err != nil {
+			t.Fatalf("closed circuit refused request %d: %v", i, err)
+		}
+		c.record(false, true, http.StatusServiceUnavailable, "503")
+	}
+	if _, err := c.allow(); err != nil {
+		t.Fatalf("circuit opened after 2 failures, want 3: %v", err)
+	}
+	c.record(false, true, http.StatusServiceUnavailable, "503")
+
+	// Open: requests are refused with a 503.
+	_, err := c.allow()
+	if te, ok := err.(*tempestError); !ok || te.Code != codeCircuitOpen || te.Status != http.StatusServiceUnavailable {
+		t.Fatalf("open circuit allowed a request or answered %v", err)
+	}
+
+	// Half-open after the cooldown: exactly one probe goes through.
+	time.Sleep(30 * time.Millisecond)
+	probe, err := c.allow()
+	if err != nil || !probe {
+		t.Fatalf("after the cooldown allow = %v, %v; want a probe", probe, err)
+	}
+	if _, err := c.allow(); err == nil {
+		t.Fatal("a second request went through while the probe was in flight")
+	}
+
+	// A failed probe keeps it open for another cooldown.
+	c.record(probe, true, http.StatusInternalServerError, "500")
+	if _, err := c.allow(); err == nil {
+		t.Fatal("circuit closed after a failed probe")
+	}
+
+	// A successful probe closes it.
+	time.Sleep(30 * time.Millisecond)
+	if probe, err = c.allow(); err != nil || !probe {
+		t.Fatalf("after the second cooldown allow = %v, %v; want a probe", probe, err)
+	}
+	c.record(probe, false, http.StatusOK, "200")
+	for i := 0; i < 5; i++ {
+		if probe, err := c.allow(); err != nil || probe {
+			t.Fatalf("closed circuit: allow = %v, %v", probe, err)
+		}
+	}
+}
+
+func TestCircuitBreakerAbandonedProbe(t *testing.T) {
+	withCircuitSettings(t, 1, 10*time.Millisecond)
+	var c circuitBreaker
+	c.record(false, true, 0, "connection refused")
+	time.Sleep(20 * time.Millisecond)
+
+	probe, err := c.allow()
+	if err != nil || !probe {
+		t.Fatalf("allow = %v, %v; want a probe", probe, err)
+	}
+	c.abandon(probe)
+	if probe, err := c.allow(); err != nil || !probe {
+		t.Fatalf("after an abandoned probe allow = %v, %v; want another probe", probe, err)
+	}
+}
+
+// Requests sent before the circuit opened neither free the probe's slot nor
+// close the circuit when they finish.
+func TestCircuitBreakerIgnoresOlderRequestsWhileOpen(t *testing.T) {
+	withCircuitSettings(t, 1, 10*time.Millisecond)
+	var c circuitBreaker
+	c.record(false, true, 0, "connection refused")
+	time.Sleep(20 * time.Millisecond)
+
+	probe, err := c.allow()
+	if err != nil || !probe {
+		t.Fatalf("allow = %v, %v; want a probe", probe, err)
+	}
+	c.record(false, true, http.StatusBadGateway, "502")
+	if _, err := c.allow(); err == nil {
+		t.Fatal("a second probe went through after an older request failed")
+	}
+	c.record(false, false, http.StatusOK, "200")
+	if _, err := c.allow(); err == nil {
+		t.Fatal("an older request's success closed the circuit")
+	}
+	c.record(probe, false, http.StatusOK, "200")
+	if probe, err := c.allow(); err != nil || probe {
+		t.Fatalf("after the probe succeeded allow = %v, %v", probe, err)
+	}
+}
@@ -0,0 +1,660 @@
+// Package client calls the Tempest Image Finder service.
+//
+//	c := client.New("http://localhost:8080", client.WithAPIKey(key))
+//	img, err := c.FetchImage(ctx, "ABC123")
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client calls one Image Finder server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey sends key in the X-API-Key header of every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithTimeout limits each attempt, including reading the response body. It
+// is 30 seconds by default; 0 leaves attempts limited only by the context.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithRetries retries requests that failed with a connection error or a
+// temporary status (408, 5xx) up to n more times, waiting backoff before the
+// first retry and doubling it each time. Only GET, HEAD and DELETE requests
+// are retried: a POST that seemed to fail may still have created a job or
+// share link.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = n, backoff }
+}
+
+// WithHTTPClient replaces the http.Client used for requests. The client is
+// not modified; WithTimeout applies on top of its own Timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// New returns a Client for the server at baseURL, e.g.
+// "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		timeout:    30 * time.Second,
+		backoff:    500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Image is an image being streamed from the service. The caller must close
+// Body.
+type Image struct {
+	ID          string
+	ContentType string
+	Size        int64 // -1 when unknown
+	Cached      bool
+	Body        io.ReadCloser
+}
+
+// Metadata describes an image.
+type Metadata struct {
+	ID                string            `json:"id"`
+	ContentType       string            `json:"content_type"`
+	Size              int64             `json:"size"`
+	Width             int               `json:"width"`
+	Height            int               `json:"height"`
+	UpstreamLatencyMs int64             `json:"upstream_latency_ms"`
+	Cache             string            `json:"cache"`
+	Parameters        map[string]string `json:"parameters"`
+	ContentURL        string            `json:"content_url"`
+}
+
+// Status reports whether an image exists.
+type Status struct {
+	ID          string `json:"id"`
+	Exists      bool   `json:"exists"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Cached      bool   `json:"cached"`
+}
+
+// EXIF is the EXIF and XMP metadata of an image.
+type EXIF struct {
+	ID           string                 `json:"id"`
+	Source       string                 `json:"source"`
+	Width        int                    `json:"width"`
+	Height       int                    `json:"height"`
+	Orientation  int                    `json:"orientation"`
+	CaptureDate  string                 `json:"capture_date"`
+	Make         string                 `json:"make"`
+	Model        string                 `json:"model"`
+	LensModel    string                 `json:"lens_model"`
+	Software     string                 `json:"software"`
+	Artist       string                 `json:"artist"`
+	Copyright    string                 `json:"copyright"`
+	Description  string                 `json:"description"`
+	Keywords     []string               `json:"keywords"`
+	ExposureTime string                 `json:"exposure_time"`
+	FNumber      float64                `json:"f_number"`
+	ISO          int                    `json:"iso"`
+	FocalLength  float64                `json:"focal_length_mm"`
+	GPS          *GPSPosition           `json:"gps"`
+	Found        []string               `json:"found"`
+	XMP          map[string]interface{} `json:"xmp"`
+}
+
+// GPSPosition is where an image was taken.
+type GPSPosition struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude"`
+}
+
+// Placeholder is a blurred stand-in for an image to show while it loads.
+type Placeholder struct {
+	ID       string `json:"id"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Blurhash string `json:"blurhash"`
+	DataURI  string `json:"data_uri"`
+}
+
+// SrcSet is an image at several widths, ready for <img srcset>.
+type SrcSet struct {
+	ID       string          `json:"id"`
+	Width    int             `json:"width"`
+	Height   int             `json:"height"`
+	Src      string          `json:"src"`
+	Srcset   string          `json:"srcset"`
+	Sizes    string          `json:"sizes"`
+	Variants []SrcSetVariant `json:"variants"`
+}
+
+// SrcSetVariant is one width of a SrcSet.
+type SrcSetVariant struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// ShareLinkOptions controls a share link. The zero value gives a link that
+// lasts a day, can be viewed any number of times and shows the image as it
+// is.
+type ShareLinkOptions struct {
+	ExpiresIn time.Duration
+	MaxViews  int
+	// Params fixes rendering parameters such as "w" or "format"; Allow
+	// lists the ones the viewer may set.
+	Params map[string]string
+	Allow  []string
+	// Watermark marks the image with the server's watermark.
+	Watermark bool
+}
+
+// ShareLink is a signed link to one image.
+type ShareLink struct {
+	URL       string    `json:"url"`
+	ImageURL  string    `json:"image_url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxViews  int       `json:"max_views"`
+	Watermark bool      `json:"watermark"`
+	KeyID     string    `json:"key_id"`
+}
+
+// Job is a background download of many images.
+type Job struct {
+	ID          string            `json:"id"`
+	State       string            `json:"state"` // queued, running, completed, failed or cancelled
+	CreatedAt   time.Time         `json:"created_at"`
+	StartedAt   *time.Time        `json:"started_at"`
+	FinishedAt  *time.Time        `json:"finished_at"`
+	Params      map[string]string `json:"params"`
+	Total       int               `json:"total"`
+	Done        int               `json:"done"`
+	Failed      int               `json:"failed"`
+	Items       []JobItem         `json:"items"`
+	ArchiveURL  string            `json:"archive_url"`
+	ArchiveSize int64             `json:"archive_size"`
+}
+
+// Finished reports whether the job has stopped, successfully or not.
+func (j *Job) Finished() bool {
+	return j.State == "completed" || j.State == "failed" || j.State == "cancelled"
+}
+
+// JobItem is the progress of one image in a Job.
+type JobItem struct {
+	ID          string `json:"id"`
+	State       string `json:"state"` // pending, fetching, done or failed
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"` // hex
+	Error       *Error `json:"error"`
+}
+
+// FetchImage streams the image with the given ID.
+func (c *Client) FetchImage(ctx context.Context, id string) (*Image, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/v1/images/"+url.PathEscape(id)+"/content")
+	if err != nil {
+		return nil, err
+	}
+	return &Image{
+		ID:          id,
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		Cached:      resp.Header.Get("X-Cache") == "HIT",
+		Body:        resp.Body,
+	}, nil
+}
+
+// Metadata fetches the description of an image.
+func (c *Client) Metadata(ctx context.Context, id string) (*Metadata, error) {
+	var m Metadata
+	if err := c.getJSON(ctx, "/api/v1/images/"+url.PathEscape(id), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// EXIF reads the EXIF and XMP metadata of an image. With raw set it reads
+// the unrotated, uncropped preview, which keeps more of the camera's
+// metadata.
+func (c *Client) EXIF(ctx context.Context, id string, raw bool) (*EXIF, error) {
+	path := "/api/v1/images/" + url.PathEscape(id) + "/exif"
+	if raw {
+		path += "?raw=true"
+	}
+	var x EXIF
+	if err := c.getJSON(ctx, path, &x); err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+
+// Placeholder fetches the blurhash and tiny inline thumbnail of an image.
+func (c *Client) Placeholder(ctx context.Context, id string) (*Placeholder, error) {
+	var p Placeholder
+	if err := c.getJSON(ctx, "/api/v1/images/"+url.PathEscape(id)+"/placeholder", &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SrcSet lists URLs of an image at the given widths, or at the server's
+// default widths when there are none. Widths the image is narrower than are
+// left out.
+func (c *Client) SrcSet(ctx context.Context, id string, widths []int) (*SrcSet, error) {
+	path := "/api/v1/images/" + url.PathEscape(id) + "/srcset"
+	if len(widths) > 0 {
+		list := make([]string, len(widths))
+		for i, w := range widths {
+			list[i] = strconv.Itoa(w)
+		}
+		path += "?widths=" + strings.Join(list, ",")
+	}
+	var s SrcSet
+	if err := c.getJSON(ctx, path, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateShareLink mints a link that shows one image without revealing its
+// ID. The client needs an API key.
+func (c *Client) CreateShareLink(ctx context.Context, id string, opts ShareLinkOptions) (*ShareLink, error) {
+	req := struct {
+		ID        string            `json:"id"`
+		ExpiresIn string            `json:"expires_in,omitempty"`
+		MaxViews  int               `json:"max_views,omitempty"`
+		Params    map[string]string `json:"params,omitempty"`
+		Allow     []string          `json:"allow,omitempty"`
+		Watermark bool              `json:"watermark,omitempty"`
+	}{ID: id, MaxViews: opts.MaxViews, Params: opts.Params, Allow: opts.Allow, Watermark: opts.Watermark}
+	if opts.ExpiresIn > 0 {
+		req.ExpiresIn = opts.ExpiresIn.String()
+	}
+	var link ShareLink
+	if err := c.postJSON(ctx, "/api/v1/share-links", req, &link); err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// Exists checks whether an image exists without downloading it. A missing
+// image is reported with Exists false and a nil error.
+func (c *Client) Exists(ctx context.Context, id string) (*Status, error) {
+	var s Status
+	if err := c.getJSON(ctx, "/api/v1/images/"+url.PathEscape(id)+"/status", &s, http.StatusNotFound); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// DownloadArchive streams a zip archive of the given images. Images the
+// server couldn't fetch are listed in errors.json inside the archive. The
+// caller must close the returned reader.
+func (c *Client) DownloadArchive(ctx context.Context, ids []string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/fetch-photos?ids="+url.QueryEscape(strings.Join(ids, ",")))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// CreateJob queues a background download of the given images, each
+// rendered with params such as "w" or "format" when there are any. Poll
+// Job until it has finished, then fetch the archive with JobArchive. The
+// client needs an API key, and only that key can see the job.
+func (c *Client) CreateJob(ctx context.Context, ids []string, params map[string]string) (*Job, error) {
+	req := struct {
+		IDs    []string          `json:"ids"`
+		Params map[string]string `json:"params,omitempty"`
+	}{ids, params}
+	var j Job
+	if err := c.postJSON(ctx, "/api/v1/jobs", req, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Job reports the progress of a job.
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	var j Job
+	if err := c.getJSON(ctx, "/api/v1/jobs/"+url.PathEscape(id), &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// CancelJob stops a job that hasn't finished yet.
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	resp, err := c.do(ctx, http.MethodDelete, "/api/v1/jobs/"+url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var j Job
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		return nil, fmt.Errorf("client: decoding job %s: %w", id, err)
+	}
+	return &j, nil
+}
+
+// JobArchive streams the zip archive of a completed job. The caller must
+// close the returned reader.
+func (c *Client) JobArchive(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/v1/jobs/"+url.PathEscape(id)+"/archive")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WebhookDelivery is one event sent to one of the server's webhooks.
+type WebhookDelivery struct {
+	ID          string           `json:"id"`
+	Event       string           `json:"event"`
+	URL         string           `json:"url"`
+	Webhook     int              `json:"webhook"` // which webhook of the server's, as several may share a URL
+	State       string           `json:"state"`   // pending, delivered or failed
+	CreatedAt   time.Time        `json:"created_at"`
+	NextAttempt *time.Time       `json:"next_attempt"`
+	Attempts    []WebhookAttempt `json:"attempts"`
+	Payload     json.RawMessage  `json:"payload"`
+}
+
+// WebhookAttempt is one try at sending a WebhookDelivery.
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// WebhookDeliveries lists the server's most recent webhook deliveries,
+// newest first, optionally only those in one state. The client needs an API
+// key.
+func (c *Client) WebhookDeliveries(ctx context.Context, state string, limit int) ([]WebhookDelivery, error) {
+	q := url.Values{}
+	if state != "" {
+		q.Set("state", state)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var deliveries []WebhookDelivery
+	if err := c.getJSON(ctx, "/api/v1/webhooks/deliveries?"+q.Encode(), &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// PingWebhooks sends a ping event to every webhook, returning the
+// deliveries the server queued. The client needs an API key.
+func (c *Client) PingWebhooks(ctx context.Context) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	if err := c.postJSON(ctx, "/api/v1/webhooks/ping", struct{}{}, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// ContactSheetLayout arranges a contact sheet. Zero fields use the
+// server's defaults.
+type ContactSheetLayout struct {
+	Columns  int
+	Size     int    // tile width and height in pixels
+	NoLabels bool   // leave out the ID under each tile
+	Format   string // "jpeg", "png" or "pdf"
+	Rows     int    // rows per PDF page
+}
+
+// ContactSheet streams a contact sheet of the given images. Images the
+// server couldn't fetch are shown as tiles saying why. The caller must
+// close the returned reader.
+func (c *Client) ContactSheet(ctx context.Context, ids []string, layout ContactSheetLayout) (io.ReadCloser, error) {
+	q := url.Values{"ids": {strings.Join(ids, ",")}}
+	if layout.Columns > 0 {
+		q.Set("columns", strconv.Itoa(layout.Columns))
+	}
+	if layout.Size > 0 {
+		q.Set("size", strconv.Itoa(layout.Size))
+	}
+	if layout.NoLabels {
+		q.Set("labels", "false")
+	}
+	if layout.Format != "" {
+		q.Set("format", layout.Format)
+	}
+	if layout.Rows > 0 {
+		q.Set("rows", strconv.Itoa(layout.Rows))
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/api/v1/contact-sheet?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// BatchResult is the outcome of fetching one image in a batch.
+type BatchResult struct {
+	ID          string
+	ContentType string
+	Data        []byte
+	Err         error
+}
+
+// FetchBatch downloads several images, at most concurrency at a time, and
+// returns one result per ID in the order given. Once ctx is done, images not
+// yet started fail with its error.
+func (c *Client) FetchBatch(ctx context.Context, ids []string, concurrency int) []BatchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]BatchResult, len(ids))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			for j := i; j < len(ids); j++ {
+				results[j] = BatchResult{ID: ids[j], Err: ctx.Err()}
+			}
+			wg.Wait()
+			return results
+		}
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			results[i] = BatchResult{ID: id}
+			img, err := c.FetchImage(ctx, id)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			defer img.Body.Close()
+			results[i].ContentType = img.ContentType
+			results[i].Data, results[i].Err = io.ReadAll(img.Body)
+		}(i, id)
+	}
+	wg.Wait()
+	return results
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}, accept ...int) error {
+	resp, err := c.do(ctx, http.MethodGet, path, accept...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("client: decoding %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Client) postJSON(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("client: decoding %s: %w", path, err)
+	}
+	return nil
+}
+
+// do sends a request, retrying temporary failures, and returns the response
+// only if it succeeded or its status is listed in accept. Failed responses are
+// decoded into *Error.
+func (c *Client) do(ctx context.Context, method, path string, accept ...int) (*http.Response, error) {
+	return c.send(ctx, method, path, nil, accept...)
+}
+
+// send is do with a JSON request body, which may be nil.
+func (c *Client) send(ctx context.Context, method, path string, body []byte, accept ...int) (*http.Response, error) {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.doOnce(ctx, method, path, body)
+		if err == nil && (resp.StatusCode < 300 || containsStatus(accept, resp.StatusCode)) {
+			return resp, nil
+		}
+		if err == nil {
+			err = decodeError(resp)
+		}
+
+		if attempt >= c.retries || !idempotent(method) || !retryable(ctx, err) {
+			return nil, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// doOnce makes one attempt. The attempt's timeout keeps running while the
+// response body is read, and ends when it is closed.
+func (c *Client) doOnce(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose ends an attempt's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// idempotent reports whether a request with method can safely be sent again.
+func idempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodDelete
+}
+
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if e, ok := err.(*Error); ok {
+		return e.temporary()
+	}
+	return true
+}
+
+// decodeError reads an ErrorResponse from a failed response and closes it.
+func decodeError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	e := &Error{Status: resp.StatusCode}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(body, e) == nil && e.Message != "" {
+			e.Status = resp.StatusCode
+			return e
+		}
+	}
+	e.Message = "unexpected response"
+	e.Details = "status " + strconv.Itoa(resp.StatusCode)
+	return e
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func sendError(w http.ResponseWriter, code string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	io.WriteString(w, `{"error":"failed","code":"`+code+`","details":"details","status":0}`)
+}
+
+func TestRetriesIdempotentRequests(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			sendError(w, "upstream_unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"id":"abc","exists":true}`)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetries(3, time.Millisecond))
+	s, err := c.Exists(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("Exists: %v", err)
+	}
+	if !s.Exists || calls != 3 {
+		t.Errorf("got exists=%v after %d calls, want true after 3", s.Exists, calls)
+	}
+}
+
+func TestDoesNotRetryPost(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		sendError(w, "upstream_error", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetries(3, time.Millisecond))
+	if _, err := c.CreateJob(context.Background(), []string{"a", "b"}, nil); !errors.Is(err, ErrUpstream) {
+		t.Fatalf("CreateJob error = %v, want ErrUpstream", err)
+	}
+	if calls != 1 {
+		t.Errorf("POST sent %d times, want once", calls)
+	}
+}
+
+func TestGivesUpAfterRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		sendError(w, "upstream_timeout", http.StatusRequestTimeout)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetries(2, time.Millisecond))
+	if _, err := c.Metadata(context.Background(), "abc"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Metadata error = %v, want ErrTimeout", err)
+	}
+	if calls != 3 {
+		t.Errorf("sent %d times, want 3", calls)
+	}
+}
+
+func TestErrorDecoding(t *testing.T) {
+	tests := []struct {
+		code        string
+		status      int
+		contentType string
+		want        error
+		notWant     error
+	}{
+		{"image_not_found", 404, "application/json", ErrNotFound, ErrJobNotFound},
+		{"job_not_found", 404, "application/json", ErrJobNotFound, ErrNotFound},
+		{"upstream_invalid_image", 502, "application/json", ErrInvalidImage, ErrUnavailable},
+		{"upstream_connection_failed", 502, "application/json", ErrUpstream, ErrInvalidImage},
+		{"image_too_large", 413, "application/json", ErrTooLarge, ErrBadRequest},
+		{"invalid_parameter", 400, "application/json", ErrBadRequest, nil},
+		{"share_link_expired", 410, "application/json", ErrShareLink, ErrNotFound},
+		{"upstream_circuit_open", 503, "application/json", ErrUnavailable, ErrUpstream},
+		{"", 502, "text/html", ErrUnavailable, ErrInvalidImage},
+		{"", 404, "text/html", nil, ErrNotFound},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.contentType != "application/json" {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, "<html>oops</html>")
+				return
+			}
+			sendError(w, tt.code, tt.status)
+		}))
+		_, err := New(srv.URL).Metadata(context.Background(), "abc")
+		srv.Close()
+
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("%s/%d: error %v is not an *Error", tt.code, tt.status, err)
+			continue
+		}
+		if e.Code != tt.code || e.Status != tt.status {
+			t.Errorf("%s/%d: decoded code %q status %d", tt.code, tt.status, e.Code, e.Status)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s/%d: errors.Is(%v) = false, want true", tt.code, tt.status, tt.want)
+		}
+		if tt.notWant != nil && errors.Is(err, tt.notWant) {
+			t.Errorf("%s/%d: errors.Is(%v) = true, want false", tt.code, tt.status, tt.notWant)
+		}
+	}
+}
+
+func TestTimeoutDoesNotModifyHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	for _, timeoutFirst := range []bool{true, false} {
+		hc := &http.Client{}
+		opts := []Option{WithHTTPClient(hc), WithTimeout(50 * time.Millisecond)}
+		if timeoutFirst {
+			opts[0], opts[1] = opts[1], opts[0]
+		}
+		c := New(srv.URL, opts...)
+		start := time.Now()
+		if _, err := c.Metadata(context.Background(), "abc"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Metadata error = %v, want a deadline error", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("request took %s despite the 50ms timeout", elapsed)
+		}
+		if hc.Timeout != 0 {
+			t.Errorf("WithTimeout changed the caller's http.Client.Timeout to %s", hc.Timeout)
+		}
+	}
+}
+
+func TestFetchBatchStopsWhenCancelled(t *testing.T) {
+	started := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	c := New(srv.URL)
+	done := make(chan []BatchResult)
+	go func() { done <- c.FetchBatch(ctx, []string{"a", "b", "c", "d", "e"}, 1) }()
+
+	select {
+	case results := <-done:
+		if len(results) != 5 {
+			t.Fatalf("got %d results, want 5", len(results))
+		}
+		for _, r := range results {
+			if r.Err == nil {
+				t.Errorf("%s: no error after cancellation", r.ID)
+			}
+		}
+		if results[4].ID != "e" || !errors.Is(results[4].Err, context.Canceled) {
+			t.Errorf("last result = %+v, want e failing with context.Canceled", results[4])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("FetchBatch did not return after the context was cancelled")
+	}
+}
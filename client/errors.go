@@ -0,0 +1,106 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Sentinel errors for each failure the service distinguishes. Errors returned
+// by Client can be matched against them with errors.Is.
+var (
+	ErrBadRequest   = errors.New("client: bad request")
+	ErrUnauthorized = errors.New("client: authentication required")
+	ErrAccessDenied = errors.New("client: access denied")
+	ErrNotFound     = errors.New("client: image not found")
+	ErrJobNotFound  = errors.New("client: job not found")
+	ErrShareLink    = errors.New("client: share link invalid, expired or used up")
+	ErrTimeout      = errors.New("client: upstream timeout")
+	ErrUpstream     = errors.New("client: upstream error")
+	ErrUnavailable  = errors.New("client: service unavailable")
+	ErrInvalidImage = errors.New("client: upstream sent an invalid image")
+	ErrTooLarge     = errors.New("client: image too large")
+	ErrInternal     = errors.New("client: internal server error")
+
+	ErrMethodNotAllowed      = errors.New("client: method not allowed")
+	ErrUnknownEndpoint       = errors.New("client: unknown endpoint")
+	ErrJobNotFinished        = errors.New("client: job not finished")
+	ErrJobFinished           = errors.New("client: job already finished")
+	ErrWebhooksNotConfigured = errors.New("client: webhooks not configured")
+	ErrWatermarkUnavailable  = errors.New("client: watermark unavailable")
+)
+
+// codeErrors maps the service's error codes to the sentinel errors. It has
+// every code the server sends; TestCodeErrorsCoverServerCodes checks that.
+var codeErrors = map[string]error{
+	"missing_id":                 ErrBadRequest,
+	"too_many_ids":               ErrBadRequest,
+	"invalid_parameter":          ErrBadRequest,
+	"method_not_allowed":         ErrMethodNotAllowed,
+	"unknown_endpoint":           ErrUnknownEndpoint,
+	"authentication_required":    ErrUnauthorized,
+	"api_key_required":           ErrUnauthorized,
+	"invalid_api_key":            ErrUnauthorized,
+	"access_denied":              ErrAccessDenied,
+	"image_not_found":            ErrNotFound,
+	"job_not_found":              ErrJobNotFound,
+	"job_not_finished":           ErrJobNotFinished,
+	"job_finished":               ErrJobFinished,
+	"webhooks_not_configured":    ErrWebhooksNotConfigured,
+	"watermark_unavailable":      ErrWatermarkUnavailable,
+	"share_link_invalid":         ErrShareLink,
+	"share_link_expired":         ErrShareLink,
+	"share_link_used_up":         ErrShareLink,
+	"upstream_timeout":           ErrTimeout,
+	"upstream_connection_failed": ErrUpstream,
+	"upstream_error":             ErrUpstream,
+	"upstream_unexpected_status": ErrUpstream,
+	"upstream_unavailable":       ErrUnavailable,
+	"upstream_circuit_open":      ErrUnavailable,
+	"memory_budget_exhausted":    ErrUnavailable,
+	"job_queue_full":             ErrUnavailable,
+	"upstream_invalid_image":     ErrInvalidImage,
+	"unsupported_image":          ErrInvalidImage,
+	"upstream_too_large":         ErrTooLarge,
+	"image_too_large":            ErrTooLarge,
+	"internal_error":             ErrInternal,
+}
+
+// Error is an ErrorResponse returned by the service.
+type Error struct {
+	Message string `json:"error"`
+	Code    string `json:"code"`
+	Details string `json:"details,omitempty"`
+	Status  int    `json:"status"`
+}
+
+func (e *Error) Error() string {
+	if e.Details == "" {
+		return fmt.Sprintf("client: %s (%d)", e.Message, e.Status)
+	}
+	return fmt.Sprintf("client: %s (%d): %s", e.Message, e.Status, e.Details)
+}
+
+// Is matches e against the sentinel error for its code. A response without
+// a code, such as an error page from a proxy in front of the service, only
+// matches ErrUnavailable, and only for 502, 503 and 504.
+func (e *Error) Is(target error) bool {
+	if e.Code == "" {
+		switch e.Status {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return target == ErrUnavailable
+		}
+		return false
+	}
+	sentinel, ok := codeErrors[e.Code]
+	return ok && target == sentinel
+}
+
+// temporary reports whether the request may succeed if retried.
+func (e *Error) temporary() bool {
+	switch e.Status {
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serverCodes returns the error codes the server declares as code*
+// constants in main.go.
+func serverCodes(t *testing.T) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "../main.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parsing main.go: %v", err)
+	}
+	var codes []string
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, name := range vs.Names {
+				if !strings.HasPrefix(name.Name, "code") || i >= len(vs.Values) {
+					continue
+				}
+				if lit, ok := vs.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					code, _ := strconv.Unquote(lit.Value)
+					codes = append(codes, code)
+				}
+			}
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func TestCodeErrorsCoverServerCodes(t *testing.T) {
+	codes := serverCodes(t)
+	if len(codes) == 0 {
+		t.Fatal("found no code constants in main.go")
+	}
+	server := make(map[string]bool)
+	for _, code := range codes {
+		server[code] = true
+		if codeErrors[code] == nil {
+			t.Errorf("the server sends %s but codeErrors has no error for it", code)
+		}
+	}
+	for code := range codeErrors {
+		if !server[code] {
+			t.Errorf("codeErrors has %s, which the server doesn't send", code)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Settings given on the command line.
+var (
+	verifyDecode      = flag.Bool("verify-decode", false, "fully decode every image from Tempest before serving or caching it")
+	maxUpstreamBytes  = flag.Int64("max-upstream-bytes", 64<<20, "largest image body accepted from Tempest, in bytes")
+	maxImagePixels    = flag.Int64("max-image-pixels", 50_000_000, "largest image, in width × height pixels, that will be decoded for processing")
+	memoryBudgetBytes = flag.Int64("memory-budget", 512<<20, "total bytes of image data that may be buffered by in-flight requests")
+
+	stripSensitiveMetadata = flag.Bool("strip-sensitive-metadata", false, "remove the GPS position, serial numbers, owner and comments from the EXIF of images served by /fetch-photo, and leave the position out of /exif; short for -sanitize-metadata=gps,identifiers,comments")
+	sanitizeMetadata       = flag.String("sanitize-metadata", "", "comma-separated metadata to remove from JPEGs served by /fetch-photo and /fetch-photos without re-encoding them: gps, identifiers, comments, thumbnail, exif, xmp, iptc, or all")
+
+	srcsetWidths = flag.String("srcset-widths", "320,640,960,1280,1920,2560", "comma-separated image widths offered by /api/v1/images/{id}/srcset")
+
+	publicURL  = flag.String("public-url", "", "URL clients reach the server at, such as https://images.example.com, used in share links, IIIF image IDs, srcsets and job archive URLs; without it they are built from the Host header of each request")
+	trustProxy = flag.Bool("trust-proxy", false, "believe the X-Forwarded-Proto header of a proxy in front of the server when building links without -public-url")
+
+	apiKeysFile   = flag.String("api-keys-file", "", "file of API keys accepted in the X-API-Key header, one per line; needed to mint share links")
+	shareKeysFile = flag.String("share-keys-file", "", "file of share link signing keys, one \"id secret [retired-at]\" per line with the newest first; reread when it changes. Without it a random key is used and links stop working on restart")
+	shareKeyGrace = flag.Duration("share-key-grace", 7*24*time.Hour, "how long share links signed with a retired key keep working after its retired-at time")
+	shareMaxTTL   = flag.Duration("share-max-ttl", 30*24*time.Hour, "longest lifetime a share link can be minted with")
+
+	watermarkLogo     = flag.String("watermark-logo", "", "PNG logo composited onto images that ask for a watermark")
+	watermarkText     = flag.String("watermark-text", "", "text drawn onto images that ask for a watermark, instead of a logo")
+	watermarkPosition = flag.String("watermark-position", "bottom-right", "where the watermark goes: top-left, top, top-right, left, center, right, bottom-left, bottom or bottom-right")
+	watermarkOpacity  = flag.Float64("watermark-opacity", 0.5, "opacity of the watermark, from 0 to 1")
+	watermarkScale    = flag.Float64("watermark-scale", 0.2, "width of the watermark as a fraction of the image width")
+
+	jobsDir      = flag.String("jobs-dir", filepath.Join(os.TempDir(), "tempest-jobs"), "directory where background jobs keep their store, the images they fetch and their archives, and where share link view counts are kept; unfinished jobs found there at startup are resumed")
+	jobWorkers   = flag.Int("job-workers", 4, "images a background job fetches at once; jobs run one at a time")
+	jobRetention = flag.Duration("job-retention", 7*24*time.Hour, "how long finished jobs and their archives are kept")
+	jobsMaxBytes = flag.Int64("jobs-max-bytes", 10<<30, "total size of job archives kept; the oldest are removed first once it is exceeded")
+
+	webhooksFile   = flag.String("webhooks-file", "", "file of webhooks, one \"url secret [event...]\" per line, with a rotated secret's new and old values separated by a comma; events are job.completed, job.failed, circuit.opened, circuit.closed and upstream.errors, all of them when none are listed")
+	webhookLogFile = flag.String("webhook-log", "", "store of webhook deliveries, kept so failed ones are retried after a restart; webhooks.db in -jobs-dir by default")
+
+	circuitFailures  = flag.Int("circuit-failures", 5, "Tempest requests in a row that must fail before requests are paused for -circuit-cooldown; 0 never pauses them")
+	circuitCooldown  = flag.Duration("circuit-cooldown", 30*time.Second, "how long requests to Tempest are paused once -circuit-failures is reached")
+	upstream5xxAlert = flag.Int("upstream-5xx-alert", 10, "5xx responses from Tempest within a minute that trigger an upstream.errors webhook; 0 never does")
+
+	negotiatedJPEGQuality = flag.Int("negotiated-jpeg-quality", 80, "JPEG quality used when Accept negotiation converts an image to JPEG")
+)
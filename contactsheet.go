@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	maxContactSheetIDs = 200
+	sheetMargin        = 16
+	sheetGap           = 12
+	defaultPDFRows     = 6
+)
+
+var (
+	sheetBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	tileBackground  = color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+	labelColor      = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	failureColor    = color.RGBA{0xb0, 0x30, 0x30, 0xff}
+)
+
+// contactSheetOptions are the layout parameters of /api/v1/contact-sheet.
+type contactSheetOptions struct {
+	Columns int
+	Size    int // each thumbnail fits in Size×Size pixels
+	Labels  bool
+	Format  string // "jpeg", "png" or "pdf"
+	Rows    int    // rows per PDF page; JPEG and PNG sheets have one page
+}
+
+// parseContactSheetOptions reads the layout from a query string.
+func parseContactSheetOptions(q url.Values) (contactSheetOptions, error) {
+	o := contactSheetOptions{Columns: 5, Size: 200, Labels: true, Format: "jpeg", Rows: defaultPDFRows}
+	var err error
+	if s := q.Get("columns"); s != "" {
+		if o.Columns, err = strconv.Atoi(s); err != nil || o.Columns < 1 || o.Columns > 20 {
+			return o, invalidParameterError("columns must be a whole number between 1 and 20")
+		}
+	}
+	if s := q.Get("size"); s != "" {
+		if o.Size, err = strconv.Atoi(s); err != nil || o.Size < 32 || o.Size > 1024 {
+			return o, invalidParameterError("size must be a whole number of pixels between 32 and 1024")
+		}
+	}
+	if s := q.Get("labels"); s != "" {
+		if o.Labels, err = strconv.ParseBool(s); err != nil {
+			return o, invalidParameterError("labels must be true or false")
+		}
+	}
+	switch format := q.Get("format"); format {
+	case "":
+	case "jpeg", "jpg":
+		o.Format = "jpeg"
+	case "png", "pdf":
+		o.Format = format
+	default:
+		return o, invalidParameterError("format must be jpeg, png or pdf")
+	}
+	if s := q.Get("rows"); s != "" {
+		if o.Rows, err = strconv.Atoi(s); err != nil || o.Rows < 1 || o.Rows > 50 {
+			return o, invalidParameterError("rows must be a whole number between 1 and 50")
+		}
+	}
+	return o, nil
+}
+
+// labelScale is how many pixels square each font pixel of a label is.
+func (o contactSheetOptions) labelScale() int {
+	if o.Size >= 160 {
+		return 2
+	}
+	return 1
+}
+
+// cellHeight is the height of one tile including its label.
+func (o contactSheetOptions) cellHeight() int {
+	if !o.Labels {
+		return o.Size
+	}
+	return o.Size + glyphHeight*o.labelScale() + 8
+}
+
+// pageSize is the size of a page holding rows rows of tiles.
+func (o contactSheetOptions) pageSize(rows int) (int, int) {
+	w := 2*sheetMargin + o.Columns*o.Size + (o.Columns-1)*sheetGap
+	h := 2*sheetMargin + rows*o.cellHeight() + (rows-1)*sheetGap
+	return w, h
+}
+
+// contactSheetTile is the thumbnail of one image, or why there isn't one.
+type contactSheetTile struct {
+	photoId string
+	thumb   *image.RGBA
+	err     error
+}
+
+// fetchContactSheetTile loads one image and shrinks it to fit a tile,
+// watermarking the tile if asked to.
+func fetchContactSheetTile(ctx context.Context, photoId string, size int, watermark bool) contactSheetTile {
+	if watermark && studioMark == nil {
+		return contactSheetTile{photoId: photoId, err: watermarkUnavailableError()}
+	}
+	entry, _, err := loadImage(ctx, photoId)
+	if err != nil {
+		return contactSheetTile{photoId: photoId, err: err}
+	}
+	thumb, release, err := renderPixels(photoId, entry, renderOptions{Width: size, Height: size})
+	if err != nil {
+		return contactSheetTile{photoId: photoId, err: err}
+	}
+	release()
+	if watermark {
+		studioMark.draw(thumb)
+	}
+	return contactSheetTile{photoId: photoId, thumb: thumb}
+}
+
+// handleContactSheet composes thumbnails of the images listed in ids into one
+// JPEG or PNG, or a PDF with a page per rows rows. Images that can't be
+// fetched get a tile saying why and are listed in X-Contact-Sheet-Failed.
+func handleContactSheet(w http.ResponseWriter, r *http.Request) {
+	ids := parsePhotoIDs(r.URL.Query().Get("ids"))
+	clientIP := r.RemoteAddr
+
+	logf("%s /api/v1/contact-sheet - Client: %s - IDs: %d", r.Method, clientIP, len(ids))
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(ids) == 0 {
+		sendJSONError(w, codeMissingID, "Image IDs required", "Please provide one or more image identifiers separated by commas, spaces or newlines", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxContactSheetIDs {
+		sendJSONError(w, codeTooManyIDs, "Too many image IDs", fmt.Sprintf("At most %d images fit on a contact sheet", maxContactSheetIDs), http.StatusBadRequest)
+		return
+	}
+	o, err := parseContactSheetOptions(r.URL.Query())
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	watermark := keyWatermarks(w, r)
+
+	rowsPerPage := (len(ids) + o.Columns - 1) / o.Columns
+	if o.Format == "pdf" && o.Rows < rowsPerPage {
+		rowsPerPage = o.Rows
+	}
+	pw, ph := o.pageSize(rowsPerPage)
+	if int64(pw)*int64(ph) > *maxImagePixels {
+		sendTempestError(w, invalidParameterError(fmt.Sprintf("A %dx%d pixel page is too large; use fewer columns or rows, a smaller size, or format=pdf", pw, ph)))
+		return
+	}
+
+	// Thumbnails are kept until the end; pages are drawn one at a time.
+	need := int64(len(ids))*int64(o.Size)*int64(o.Size)*4 + int64(pw)*int64(ph)*4
+	if !inflight.reserve(need) {
+		sendTempestError(w, memoryBudgetError())
+		return
+	}
+	defer inflight.release(need)
+
+	tiles := make([]contactSheetTile, len(ids))
+	slots := make(chan struct{}, archiveFetchSlots)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			tiles[i] = fetchContactSheetTile(r.Context(), id, o.Size, watermark)
+		}(i, id)
+	}
+	wg.Wait()
+	if r.Context().Err() != nil {
+		return
+	}
+
+	var failed []string
+	for _, t := range tiles {
+		if t.err != nil {
+			failed = append(failed, t.photoId)
+		}
+	}
+	if len(failed) == len(tiles) {
+		sendTempestError(w, tiles[0].err)
+		return
+	}
+
+	// Pages are encoded as they are drawn so only one is held at a time.
+	var pages []pdfPage
+	var data []byte
+	for start := 0; start < len(tiles); start += rowsPerPage * o.Columns {
+		end := start + rowsPerPage*o.Columns
+		if end > len(tiles) {
+			end = len(tiles)
+		}
+		page := drawContactSheetPage(tiles[start:end], o, pw, ph)
+		format := o.Format
+		if format == "pdf" {
+			format = "jpeg"
+		}
+		data, err = encodeImage(page, format, defaultJPEGQuality)
+		if err != nil {
+			sendTempestError(w, &tempestError{codeInternal, "Encoding failed", fmt.Sprintf("Unable to encode the contact sheet as %s: %v", format, err), http.StatusInternalServerError})
+			return
+		}
+		pages = append(pages, pdfPage{JPEG: data, Width: pw, Height: ph})
+	}
+
+	contentType := "image/" + o.Format
+	if o.Format == "pdf" {
+		contentType = "application/pdf"
+		data = buildPDF(fmt.Sprintf("Contact sheet of %d images", len(ids)), pages)
+	}
+
+	extension := map[string]string{"jpeg": ".jpg", "png": ".png", "pdf": ".pdf"}[o.Format]
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `inline; filename="contact-sheet`+extension+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Repr-Digest", reprDigest(contentDigest(data)))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if len(failed) > 0 {
+		w.Header().Set("X-Contact-Sheet-Failed", strings.Join(failed, ", "))
+		w.Header().Set("Access-Control-Expose-Headers", "X-Contact-Sheet-Failed")
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+
+	logf("SUCCESS: Served %s contact sheet of %d/%d images (%d pages, %d bytes) to %s", o.Format, len(ids)-len(failed), len(ids), len(pages), len(data), clientIP)
+}
+
+// drawContactSheetPage lays tiles out on a pw×ph page, left to right and top
+// to bottom.
+func drawContactSheetPage(tiles []contactSheetTile, o contactSheetOptions, pw, ph int) *image.RGBA {
+	page := image.NewRGBA(image.Rect(0, 0, pw, ph))
+	draw.Draw(page, page.Rect, image.NewUniform(sheetBackground), image.Point{}, draw.Src)
+
+	scale := o.labelScale()
+	for i, t := range tiles {
+		x := sheetMargin + (i%o.Columns)*(o.Size+sheetGap)
+		y := sheetMargin + (i/o.Columns)*(o.cellHeight()+sheetGap)
+		box := image.Rect(x, y, x+o.Size, y+o.Size)
+		draw.Draw(page, box, image.NewUniform(tileBackground), image.Point{}, draw.Src)
+
+		if t.thumb != nil {
+			tw, th := t.thumb.Rect.Dx(), t.thumb.Rect.Dy()
+			at := image.Pt(x+(o.Size-tw)/2, y+(o.Size-th)/2)
+			draw.Draw(page, image.Rectangle{at, at.Add(image.Pt(tw, th))}, t.thumb, image.Point{}, draw.Over)
+		} else {
+			msg := fitText(errorResponseFor(t.err).Error, o.Size-8, scale)
+			drawText(page, x+(o.Size-textWidth(msg, scale))/2, y+(o.Size-glyphHeight*scale)/2, msg, scale, failureColor)
+		}
+
+		if o.Labels {
+			label := fitText(t.photoId, o.Size, scale)
+			drawText(page, x+(o.Size-textWidth(label, scale))/2, y+o.Size+4, label, scale, labelColor)
+		}
+	}
+	return page
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	manifestJSON = "manifest.json"
+	manifestCSV  = "manifest.csv"
+	// manifestInterval is how often the manifest is saved during a run, so
+	// little is lost if the run is killed rather than interrupted.
+	manifestInterval = 2 * time.Second
+)
+
+// downloadServerFlags are the server flags that also apply to the download
+// command, since it fetches and renders images the way the server does.
+var downloadServerFlags = []string{
+	"verify-decode", "max-upstream-bytes", "max-image-pixels", "memory-budget",
+	"strip-sensitive-metadata", "sanitize-metadata",
+	"watermark-logo", "watermark-text", "watermark-position", "watermark-opacity", "watermark-scale",
+	"circuit-failures", "circuit-cooldown",
+}
+
+// Download outcomes. An ID is pending until it has been tried. An ID counts
+// as complete, and is skipped by the next run, if its outcome is downloaded
+// or skipped and its file still has the recorded size and SHA-256.
+const (
+	outcomePending    = "pending"
+	outcomeDownloaded = "downloaded"
+	outcomeSkipped    = "skipped"
+	outcomeFailed     = "failed"
+)
+
+// ManifestEntry is what the download command recorded about one image ID.
+type ManifestEntry struct {
+	ID       string    `json:"id"`
+	Outcome  string    `json:"outcome"`
+	Path     string    `json:"path,omitempty"` // relative to the output directory
+	Bytes    int64     `json:"bytes,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Category string    `json:"category"`        // see statusCategory
+	Status   int       `json:"status"`          // the status /fetch-photo would have answered with
+	Code     string    `json:"code,omitempty"`  // ErrorResponse code of a failure
+	Error    string    `json:"error,omitempty"` // ErrorResponse details of a failure
+	Updated  time.Time `json:"updated_at"`
+}
+
+// Manifest is the content of manifest.json.
+type Manifest struct {
+	UpdatedAt time.Time       `json:"updated_at"`
+	Params    string          `json:"params,omitempty"`
+	Entries   []ManifestEntry `json:"entries"`
+}
+
+// statusCategory sorts the error codes /fetch-photo answers with into the
+// broad kinds of upstream outcome an archivist cares about.
+func statusCategory(code string) string {
+	switch code {
+	case "":
+		return "ok"
+	case codeImageNotFound:
+		return "not_found"
+	case codeAccessDenied, codeAuthRequired:
+		return "denied"
+	case codeUpstreamTimeout:
+		return "timeout"
+	case codeUpstreamConnection:
+		return "connection"
+	case codeUpstreamError, codeUpstreamUnavailable, codeUpstreamUnexpected, codeCircuitOpen:
+		return "server_error"
+	case codeUpstreamInvalidImage, codeUnsupportedImage:
+		return "invalid_image"
+	case codeUpstreamTooLarge, codeImageTooLarge:
+		return "too_large"
+	case codeMemoryBudget:
+		return "busy"
+	default:
+		return "other"
+	}
+}
+
+// complete reports whether e's file is still on disk as it was downloaded.
+func (e ManifestEntry) complete(dir string) bool {
+	if e.Outcome != outcomeDownloaded && e.Outcome != outcomeSkipped || e.Path == "" {
+		return false
+	}
+	return fileMatches(filepath.Join(dir, e.Path), e.Bytes, e.SHA256)
+}
+
+// fileMatches reports whether the file at path has the given size and
+// hex SHA-256. An empty sum only checks the size.
+func fileMatches(path string, size int64, sum string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if sum == "" {
+		info, err := f.Stat()
+		return err == nil && info.Size() == size
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return err == nil && n == size && hex.EncodeToString(h.Sum(nil)) == sum
+}
+
+// readManifest loads the manifest left in dir by an earlier run, if any.
+func readManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestJSON))
+	if os.IsNotExist(err) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", manifestJSON, err)
+	}
+	return &m, nil
+}
+
+// writeManifest saves m in dir as JSON and CSV, replacing each file only
+// once the new one is complete.
+func writeManifest(dir string, m *Manifest) error {
+	m.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, manifestJSON), append(data, '\n')); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write([]string{"id", "outcome", "path", "bytes", "sha256", "category", "status", "code", "error", "updated_at"})
+	for _, e := range m.Entries {
+		w.Write([]string{e.ID, e.Outcome, e.Path, strconv.FormatInt(e.Bytes, 10), e.SHA256, e.Category, strconv.Itoa(e.Status), e.Code, e.Error, e.Updated.Format(time.RFC3339)})
+	}
+	w.Flush()
+	return writeFileAtomic(filepath.Join(dir, manifestCSV), []byte(b.String()))
+}
+
+// writeFileAtomic writes data to path through a temporary file, so path
+// never holds half a file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// downloadImage fetches one image into dir, the same way /fetch-photo would
+// serve it with the given rendering options.
+func downloadImage(dir, photoId string, o renderOptions) ManifestEntry {
+	e := ManifestEntry{ID: photoId, Updated: time.Now().UTC()}
+	res := fetchJobImage(context.Background(), photoId, o)
+	if res.err == nil {
+		e.Path = archiveEntryName(photoId, res.contentType)
+		res.err = writeFileAtomic(filepath.Join(dir, e.Path), res.data)
+	}
+	if res.err != nil {
+		er := errorResponseFor(res.err)
+		e.Outcome, e.Path = outcomeFailed, ""
+		e.Category, e.Status, e.Code, e.Error = statusCategory(er.Code), er.Status, er.Code, er.Details
+		return e
+	}
+	e.Outcome = outcomeDownloaded
+	e.Bytes = int64(len(res.data))
+	e.SHA256 = hex.EncodeToString(contentDigest(res.data))
+	e.Category, e.Status = statusCategory(""), 200
+	return e
+}
+
+// runDownload is the download subcommand: it saves images straight from
+// Tempest into a directory with a manifest, and can be interrupted and run
+// again. IDs already downloaded and unchanged on disk are skipped; every
+// other ID, including those that failed, is tried again. It returns the exit
+// status: 0 if every image was downloaded, 1 if any failed.
+func runDownload(args []string) int {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	out := fs.String("out", "tempest-images", "directory to save the images and manifest in")
+	idsFile := fs.String("ids-file", "", "file of image IDs separated by commas, spaces or newlines, or - for standard input; IDs can also be given as arguments")
+	workers := fs.Int("workers", 4, "images to fetch at once")
+	params := fs.String("params", "", "rendering parameters applied to every image, as a query string such as w=1600&format=jpeg")
+	for _, name := range downloadServerFlags {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s download [flags] [id...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	text := strings.Join(fs.Args(), ",")
+	if *idsFile != "" {
+		var data []byte
+		var err error
+		if *idsFile == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*idsFile)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "download: %v\n", err)
+			return 2
+		}
+		text += "," + string(data)
+	}
+	ids := parsePhotoIDs(text)
+	if len(ids) == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *workers < 1 {
+		fmt.Fprintf(os.Stderr, "download: -workers must be at least 1\n")
+		return 2
+	}
+	removal, err := parseMetadataRemoval(*sanitizeMetadata, *stripSensitiveMetadata)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "download: -sanitize-metadata: %v\n", err)
+		return 2
+	}
+	metadataToRemove = removal
+	if studioMark, err = loadWatermark(*watermarkLogo, *watermarkText, *watermarkPosition, *watermarkOpacity, *watermarkScale); err != nil {
+		fmt.Fprintf(os.Stderr, "download: watermark: %v\n", err)
+		return 2
+	}
+	q, err := url.ParseQuery(*params)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "download: -params: %v\n", err)
+		return 2
+	}
+	paramMap := make(map[string]string, len(q))
+	for k := range q {
+		paramMap[k] = q.Get(k)
+	}
+	opts, err := jobRenderOptions(paramMap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "download: -params: %v\n", err)
+		return 2
+	}
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "download: %v\n", err)
+		return 2
+	}
+	m, err := readManifest(*out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "download: %v\n", err)
+		return 2
+	}
+	if len(m.Entries) > 0 && m.Params != q.Encode() {
+		fmt.Fprintf(os.Stderr, "download: %s was downloaded with -params %q; use another -out for different parameters\n", *out, m.Params)
+		return 2
+	}
+	m.Params = q.Encode()
+
+	// Entries from earlier runs are kept, in their order, followed by new
+	// IDs.
+	index := make(map[string]int, len(m.Entries))
+	for i, e := range m.Entries {
+		index[e.ID] = i
+	}
+	var todo []int
+	skipped := 0
+	for _, id := range ids {
+		i, ok := index[id]
+		if !ok {
+			i = len(m.Entries)
+			index[id] = i
+			m.Entries = append(m.Entries, ManifestEntry{ID: id, Outcome: outcomePending, Updated: time.Now().UTC()})
+		}
+		if m.Entries[i].complete(*out) {
+			if m.Entries[i].Outcome != outcomeSkipped {
+				m.Entries[i].Outcome = outcomeSkipped
+				m.Entries[i].Updated = time.Now().UTC()
+			}
+			skipped++
+			continue
+		}
+		todo = append(todo, i)
+	}
+	logf("Downloading %d images to %s; %d already done", len(todo), *out, skipped)
+
+	var mu sync.Mutex
+	save := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := writeManifest(*out, m); err != nil {
+			fmt.Fprintf(os.Stderr, "download: saving the manifest: %v\n", err)
+		}
+	}
+	save()
+
+	// On Ctrl-C, finish the images in flight and save the manifest.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+
+	results := make(chan ManifestEntry)
+	slots := make(chan struct{}, *workers)
+	var wg sync.WaitGroup
+	go func() {
+		defer close(results)
+		interrupted := false
+	fetch:
+		for _, i := range todo {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				logf("Interrupted; waiting for the images in flight")
+				interrupted = true
+				break fetch
+			}
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				results <- downloadImage(*out, id, opts)
+			}(m.Entries[i].ID)
+		}
+		wg.Wait()
+		if interrupted {
+			logf("Run the same command again to carry on")
+		}
+	}()
+
+	ticker := time.NewTicker(manifestInterval)
+	defer ticker.Stop()
+	done, failed := 0, 0
+	for {
+		select {
+		case e, ok := <-results:
+			if !ok {
+				save()
+				logf("Downloaded %d, skipped %d, failed %d of %d images; manifest in %s", done, skipped, failed, len(ids), filepath.Join(*out, manifestJSON))
+				if done+skipped < len(ids) {
+					return 1
+				}
+				return 0
+			}
+			if e.Outcome == outcomeFailed {
+				failed++
+				logf("FAILED: %s: %s (%s)", e.ID, e.Error, e.Category)
+			} else {
+				done++
+				logf("DOWNLOADED: %s (%d bytes)", e.ID, e.Bytes)
+			}
+			mu.Lock()
+			m.Entries[index[e.ID]] = e
+			mu.Unlock()
+		case <-ticker.C:
+			save()
+		}
+	}
+}
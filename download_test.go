@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// manifestOutcomes runs the download command into dir with args and returns
+// its exit status and the outcome recorded for each ID.
+func manifestOutcomes(t *testing.T, dir string, args ...string) (int, map[string]ManifestEntry) {
+	status := runDownload(append([]string{"-out", dir}, args...))
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("readManifest: %v", err)
+	}
+	entries := make(map[string]ManifestEntry)
+	for _, e := range m.Entries {
+		entries[e.ID] = e
+	}
+	return status, entries
+}
+
+func TestDownloadResume(t *testing.T) {
+	oldRemoval, oldMark := metadataToRemove, studioMark
+	t.Cleanup(func() { metadataToRemove, studioMark = oldRemoval, oldMark })
+	files := map[string][]byte{"a": testJPEG(t), "b": testJPEG(t)}
+	fakeTempest(t, files)
+	dir := t.TempDir()
+
+	status, got := manifestOutcomes(t, dir, "a", "b", "c")
+	if status != 1 {
+		t.Errorf("first run exited %d, want 1", status)
+	}
+	if got["a"].Outcome != outcomeDownloaded || got["b"].Outcome != outcomeDownloaded {
+		t.Errorf("first run: a is %s, b is %s; want both downloaded", got["a"].Outcome, got["b"].Outcome)
+	}
+	if c := got["c"]; c.Outcome != outcomeFailed || c.Category != "not_found" {
+		t.Errorf("first run: c is %s (%s), want failed (not_found)", c.Outcome, c.Category)
+	}
+
+	// The second run skips the verified files, re-fetches the one that
+	// changed on disk and retries the failure.
+	files["c"] = testJPEG(t)
+	if err := os.WriteFile(filepath.Join(dir, got["b"].Path), []byte("truncated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	status, got = manifestOutcomes(t, dir, "a", "b", "c")
+	if status != 0 {
+		t.Errorf("second run exited %d, want 0", status)
+	}
+	for id, want := range map[string]string{"a": outcomeSkipped, "b": outcomeDownloaded, "c": outcomeDownloaded} {
+		if got[id].Outcome != want {
+			t.Errorf("second run: %s is %s, want %s", id, got[id].Outcome, want)
+		}
+		if want != outcomeSkipped && !got[id].complete(dir) {
+			t.Errorf("second run: %s does not match its manifest entry", id)
+		}
+	}
+
+	if status := runDownload([]string{"-out", dir, "-params", "w=8", "a"}); status != 2 {
+		t.Errorf("run with different -params exited %d, want 2", status)
+	}
+}
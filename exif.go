@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// TIFF and EXIF tags read or removed by the proxy.
+const (
+	tagImageDescription  = 0x010E
+	tagMake              = 0x010F
+	tagModel             = 0x0110
+	tagOrientation       = 0x0112
+	tagSoftware          = 0x0131
+	tagDateTime          = 0x0132
+	tagArtist            = 0x013B
+	tagHostComputer      = 0x013C
+	tagCopyright         = 0x8298
+	tagExposureTime      = 0x829A
+	tagFNumber           = 0x829D
+	tagExifIFD           = 0x8769
+	tagGPSIFD            = 0x8825
+	tagISO               = 0x8827
+	tagDateTimeOriginal  = 0x9003
+	tagDateTimeDigitized = 0x9004
+	tagOffsetTimeOrig    = 0x9011
+	tagFocalLength       = 0x920A
+	tagMakerNote         = 0x927C
+	tagUserComment       = 0x9286
+	tagImageUniqueID     = 0xA420
+	tagCameraOwnerName   = 0xA430
+	tagBodySerialNumber  = 0xA431
+	tagLensModel         = 0xA434
+	tagLensSerialNumber  = 0xA435
+	tagCameraSerial      = 0xC62F
+)
+
+// GPS IFD tags.
+const (
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+// jpegSegment is one marker segment from the header of a JPEG file. Data
+// excludes the marker and length bytes.
+type jpegSegment struct {
+	Marker byte
+	Offset int // of the 0xFF that starts the segment
+	Data   []byte
+}
+
+// jpegSegments returns the marker segments of a JPEG up to the start of the
+// scan data. It stops quietly at the first thing it doesn't understand.
+func jpegSegments(data []byte) []jpegSegment {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	var segments []jpegSegment
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return segments
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			i++ // fill byte
+			continue
+		}
+		if marker == 0xD9 || marker == 0xDA {
+			return segments
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return segments
+		}
+		segments = append(segments, jpegSegment{Marker: marker, Offset: i, Data: data[i+4 : i+2+n]})
+		i += 2 + n
+	}
+	return segments
+}
+
+// exifPayload returns the TIFF structure inside a JPEG's Exif APP1 segment,
+// or nil if there isn't one.
+func exifPayload(data []byte) []byte {
+	for _, s := range jpegSegments(data) {
+		if s.Marker == 0xE1 && bytes.HasPrefix(s.Data, []byte("Exif\x00\x00")) {
+			return s.Data[6:]
+		}
+	}
+	return nil
+}
+
+// tiffEntry is one field of a TIFF image file directory.
+type tiffEntry struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+	Value []byte // the raw value bytes, wherever they are stored
+
+	valueAt int // offset of Value when stored outside the entry, else -1
+}
+
+// tiffReader reads image file directories from a TIFF structure.
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFFReader(data []byte) (*tiffReader, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, false
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return nil, false
+	}
+	return &tiffReader{data: data, order: order}, true
+}
+
+// firstIFD returns the offset of IFD0.
+func (t *tiffReader) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:])
+}
+
+// tiffTypeSizes gives the size in bytes of one value of each TIFF field type.
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// ifd reads the directory at offset. Entries whose values lie outside the
+// data are skipped.
+func (t *tiffReader) ifd(offset uint32) []tiffEntry {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	var entries []tiffEntry
+	for i := 0; i < n; i++ {
+		p := uint64(offset) + 2 + uint64(i)*12
+		if p+12 > uint64(len(t.data)) {
+			break
+		}
+		if entry, ok := t.entryAt(p); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// entryAt decodes the 12-byte directory entry at p.
+func (t *tiffReader) entryAt(p uint64) (tiffEntry, bool) {
+	e := t.data[p : p+12]
+	entry := tiffEntry{Tag: t.order.Uint16(e), Type: t.order.Uint16(e[2:]), Count: t.order.Uint32(e[4:]), valueAt: -1}
+	size := uint64(tiffTypeSizes[entry.Type]) * uint64(entry.Count)
+	if size <= 4 {
+		entry.Value = e[8 : 8+size]
+		return entry, true
+	}
+	at := uint64(t.order.Uint32(e[8:]))
+	if at+size > uint64(len(t.data)) {
+		return entry, false
+	}
+	entry.Value = t.data[at : at+size]
+	entry.valueAt = int(at)
+	return entry, true
+}
+
+// uint returns the first value of a BYTE, SHORT or LONG entry.
+func (t *tiffReader) uint(e tiffEntry) (uint32, bool) {
+	switch {
+	case e.Type == 1 && len(e.Value) >= 1:
+		return uint32(e.Value[0]), true
+	case e.Type == 3 && len(e.Value) >= 2:
+		return uint32(t.order.Uint16(e.Value)), true
+	case e.Type == 4 && len(e.Value) >= 4:
+		return t.order.Uint32(e.Value), true
+	}
+	return 0, false
+}
+
+// string returns the text of an ASCII entry.
+func (t *tiffReader) string(e tiffEntry) string {
+	if e.Type != 2 {
+		return ""
+	}
+	v := e.Value
+	if i := bytes.IndexByte(v, 0); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(string(v))
+}
+
+// rationals returns the values of a RATIONAL or SRATIONAL entry.
+func (t *tiffReader) rationals(e tiffEntry) []float64 {
+	if e.Type != 5 && e.Type != 10 {
+		return nil
+	}
+	var vs []float64
+	for p := 0; p+8 <= len(e.Value); p += 8 {
+		num, den := t.order.Uint32(e.Value[p:]), t.order.Uint32(e.Value[p+4:])
+		if den == 0 {
+			return nil
+		}
+		if e.Type == 10 {
+			vs = append(vs, float64(int32(num))/float64(int32(den)))
+		} else {
+			vs = append(vs, float64(num)/float64(den))
+		}
+	}
+	return vs
+}
+
+// exifOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when it
+// has none.
+func exifOrientation(data []byte) int {
+	t, ok := newTIFFReader(exifPayload(data))
+	if !ok {
+		return 1
+	}
+	for _, e := range t.ifd(t.firstIFD()) {
+		if e.Tag != tagOrientation {
+			continue
+		}
+		if v, ok := t.uint(e); ok && v >= 1 && v <= 8 {
+			return int(v)
+		}
+	}
+	return 1
+}
+
+// exifData is the EXIF of a JPEG, indexed by tag for each directory.
+type exifData struct {
+	t    *tiffReader
+	ifd0 map[uint16]tiffEntry
+	exif map[uint16]tiffEntry
+	gps  map[uint16]tiffEntry
+}
+
+// readEXIF parses the EXIF of a JPEG, returning false if it has none.
+func readEXIF(data []byte) (*exifData, bool) {
+	t, ok := newTIFFReader(exifPayload(data))
+	if !ok {
+		return nil, false
+	}
+	x := &exifData{t: t, ifd0: t.fields(t.firstIFD())}
+	if e, ok := x.ifd0[tagExifIFD]; ok {
+		if off, ok := t.uint(e); ok {
+			x.exif = t.fields(off)
+		}
+	}
+	if e, ok := x.ifd0[tagGPSIFD]; ok {
+		if off, ok := t.uint(e); ok {
+			x.gps = t.fields(off)
+		}
+	}
+	return x, true
+}
+
+// fields is ifd indexed by tag.
+func (t *tiffReader) fields(offset uint32) map[uint16]tiffEntry {
+	m := make(map[uint16]tiffEntry)
+	for _, e := range t.ifd(offset) {
+		m[e.Tag] = e
+	}
+	return m
+}
+
+// string returns the text of tag in dir, or "".
+func (x *exifData) string(dir map[uint16]tiffEntry, tag uint16) string {
+	if e, ok := dir[tag]; ok {
+		return x.t.string(e)
+	}
+	return ""
+}
+
+// rationals returns the values of tag in dir, or nil.
+func (x *exifData) rationals(dir map[uint16]tiffEntry, tag uint16) []float64 {
+	if e, ok := dir[tag]; ok {
+		return x.t.rationals(e)
+	}
+	return nil
+}
+
+// uint returns the first value of tag in dir.
+func (x *exifData) uint(dir map[uint16]tiffEntry, tag uint16) (uint32, bool) {
+	if e, ok := dir[tag]; ok {
+		return x.t.uint(e)
+	}
+	return 0, false
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setImageHeaders sets the headers shared by every image response.
+func setImageHeaders(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+}
+
+// upstreamETag derives a strong ETag from the validators Tempest sent: its
+// own ETag when that is strong, or one built from Last-Modified and the
+// length. It returns "" when neither is usable and the content has to be
+// hashed instead.
+func upstreamETag(header http.Header, contentLength int64) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil && contentLength >= 0 {
+		return fmt.Sprintf(`"%x-%x"`, lm.Unix(), contentLength)
+	}
+	return ""
+}
+
+// contentETag is a strong ETag computed from the image bytes.
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// contentDigest is the SHA-256 of an image.
+func contentDigest(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// reprDigest formats a SHA-256 as an RFC 9530 Repr-Digest value. It covers
+// the whole image, so it is the same on a 206 for part of it.
+func reprDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// upstreamDigest returns the SHA-256 of the whole image when Tempest sent
+// one, as Repr-Digest or, on a complete unencoded GET response,
+// Content-Digest. It returns nil otherwise.
+func upstreamDigest(resp *http.Response) []byte {
+	fields := []string{"Repr-Digest"}
+	complete := resp.StatusCode == http.StatusOK && resp.Request != nil && resp.Request.Method == http.MethodGet
+	if complete && resp.Header.Get("Content-Encoding") == "" {
+		fields = append(fields, "Content-Digest")
+	}
+	for _, field := range fields {
+		for _, member := range strings.Split(resp.Header.Get(field), ",") {
+			alg, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+			if alg != "sha-256" || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+			if err == nil && len(sum) == sha256.Size {
+				return sum
+			}
+		}
+	}
+	return nil
+}
+
+// newCacheEntry builds the cache entry for a complete upstream response.
+func newCacheEntry(header http.Header, data []byte, latency time.Duration) *cacheEntry {
+	entry := &cacheEntry{
+		ContentType:     header.Get("Content-Type"),
+		Data:            data,
+		FetchedAt:       time.Now(),
+		UpstreamLatency: latency,
+		ETag:            upstreamETag(header, int64(len(data))),
+		Digest:          contentDigest(data),
+	}
+	if entry.ETag == "" {
+		entry.ETag = contentETag(data)
+	}
+	if lm, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		entry.LastModified = lm
+	}
+	return entry
+}
+
+func setValidators(w http.ResponseWriter, etag string, lastModified time.Time) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether the client's cached copy, as described by
+// If-None-Match or If-Modified-Since, is still current.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// sendNotModified answers a conditional request whose validators matched.
+// The caller must already have set the validators.
+func sendNotModified(w http.ResponseWriter) {
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// serveImageEntry writes a complete image. http.ServeContent answers
+// conditional requests with 304 and Range/If-Range requests with 206.
+func serveImageEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry, hit bool) {
+	setImageHeaders(w, entry.ContentType)
+	setValidators(w, entry.ETag, time.Time{})
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	if len(entry.MetadataRemoved) > 0 {
+		w.Header().Set("X-Metadata-Removed", strings.Join(entry.MetadataRemoved, ", "))
+	}
+	if entry.Digest != nil {
+		w.Header().Set("Repr-Digest", reprDigest(entry.Digest))
+	}
+	http.ServeContent(w, r, "", entry.LastModified, bytes.NewReader(entry.Data))
+}
+
+// servePartialUpstream relays a 206 response from Tempest.
+func servePartialUpstream(w http.ResponseWriter, r *http.Request, photoId string, resp *http.Response) {
+	if err := checkDeclaredType(photoId, resp.Header.Get("Content-Type")); err != nil {
+		sendTempestError(w, err)
+		return
+	}
+
+	contentRange := resp.Header.Get("Content-Range")
+	etag := upstreamETag(resp.Header, contentRangeTotal(contentRange))
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	setImageHeaders(w, resp.Header.Get("Content-Type"))
+	setValidators(w, etag, lastModified)
+	w.Header().Set("X-Cache", "MISS")
+	if notModified(r, etag, lastModified) {
+		sendNotModified(w)
+		return
+	}
+	// Only part of the image passes through here, so the digest of the
+	// whole comes from Tempest or from an earlier full download.
+	digest := upstreamDigest(resp)
+	if digest == nil {
+		digest = upstreamDigests.Lookup(photoId, etag)
+	}
+	if digest != nil {
+		w.Header().Set("Repr-Digest", reprDigest(digest))
+	}
+
+	logf("SUCCESS: Serving %s of image %s to %s", contentRange, photoId, r.RemoteAddr)
+	w.Header().Set("Content-Range", contentRange)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusPartialContent)
+	io.Copy(w, resp.Body)
+}
+
+func handleFetchPhoto(w http.ResponseWriter, r *http.Request) {
+	photoId := r.URL.Query().Get("id")
+	clientIP := r.RemoteAddr
+
+	logf("%s /fetch-photo - Client: %s - ID: %s", r.Method, clientIP, photoId)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if photoId == "" {
+		logf("ERROR: Missing photo ID from %s", clientIP)
+		sendJSONError(w, codeMissingID, "Image ID required", "Please provide a valid image identifier", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parseRenderOptions(r.URL.Query())
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	if keyWatermarks(w, r) {
+		opts.Watermark = true
+	}
+	// Without an explicit format the response depends on Accept.
+	if opts.Format == "" {
+		w.Header().Add("Vary", "Accept")
+	}
+	if !opts.isZero() {
+		serveRendered(w, r, photoId, opts)
+		return
+	}
+	accept := r.Header.Get("Accept")
+
+	if entry, ok := images.Get(photoId); ok {
+		logf("CACHE HIT: Serving image %s (%d bytes) to %s", photoId, len(entry.Data), clientIP)
+		serveVariant(w, r, photoId, entry, true, opts)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), tempestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if r.Method == http.MethodHead {
+		probe, err := probeTempestImage(ctx, photoId)
+		if err == nil {
+			err = checkDeclaredType(photoId, probe.ContentType)
+		}
+		if err != nil {
+			sendTempestError(w, err)
+			return
+		}
+		if !streamsUnchanged(accept, probe.ContentType) || metadataToRemove.enabled() {
+			// The format served depends on the pixels, or the size on
+			// the metadata, so fetch them.
+			serveRendered(w, r, photoId, opts)
+			return
+		}
+		logf("SUCCESS: Image %s exists (Content-Length: %d) for %s", photoId, probe.Size, clientIP)
+		setImageHeaders(w, probe.ContentType)
+		setValidators(w, probe.ETag, probe.LastModified)
+		w.Header().Set("X-Cache", "MISS")
+		if notModified(r, probe.ETag, probe.LastModified) {
+			sendNotModified(w)
+			return
+		}
+		if probe.Size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(probe.Size, 10))
+		}
+		digest := probe.Digest
+		if digest == nil {
+			digest = upstreamDigests.Lookup(photoId, probe.ETag)
+		}
+		if digest != nil {
+			w.Header().Set("Repr-Digest", reprDigest(digest))
+		}
+		return
+	}
+
+	// Ranges are forwarded to Tempest, except If-Range requests: those
+	// depend on our own ETag, so they are answered from the full image.
+	// The same goes for every range when metadata is being stripped.
+	rangeHeader := r.Header.Get("Range")
+	var resp *http.Response
+	if rangeHeader != "" && r.Header.Get("If-Range") == "" && !metadataToRemove.enabled() {
+		resp, err = fetchTempestRange(ctx, photoId, rangeHeader)
+	} else {
+		resp, err = fetchTempestImage(ctx, photoId)
+	}
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPartialContent {
+		servePartialUpstream(w, r, photoId, resp)
+		return
+	}
+
+	contentLength := resp.Header.Get("Content-Length")
+	etag := upstreamETag(resp.Header, resp.ContentLength)
+	if etag == "" || rangeHeader != "" || *verifyDecode || metadataToRemove.enabled() || !streamsUnchanged(accept, resp.Header.Get("Content-Type")) {
+		// Without validators from Tempest the ETag is a hash of the
+		// content, a range Tempest didn't honour has to be cut out
+		// locally, and decoding, stripping metadata or negotiating a
+		// format needs every byte. In each case the whole image has to
+		// arrive before the headers can be sent.
+		entry, err := readUpstreamImage(photoId, resp, start)
+		if err != nil {
+			sendTempestError(w, err)
+			return
+		}
+		images.Put(photoId, entry)
+		upstreamDigests.Remember(photoId, entry.ETag, entry.Digest)
+		logf("SUCCESS: Serving image %s (Content-Length: %d) to %s", photoId, len(entry.Data), clientIP)
+		serveVariant(w, r, photoId, entry, false, opts)
+		return
+	}
+
+	if resp.ContentLength > *maxUpstreamBytes {
+		sendTempestError(w, upstreamTooLargeError(photoId, resp.ContentLength))
+		return
+	}
+
+	// Check the first bytes before committing to a 200.
+	body := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, _ := body.Peek(sniffLen)
+	contentType, err := checkImageType(photoId, resp.Header.Get("Content-Type"), head)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	resp.Header.Set("Content-Type", contentType)
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	setImageHeaders(w, contentType)
+	setValidators(w, etag, lastModified)
+	w.Header().Set("X-Cache", "MISS")
+	if notModified(r, etag, lastModified) {
+		logf("NOT MODIFIED: Image %s unchanged for %s", photoId, clientIP)
+		sendNotModified(w)
+		return
+	}
+
+	logf("SUCCESS: Serving image %s (Content-Length: %s) to %s", photoId, contentLength, clientIP)
+	// The digest comes from Tempest or an earlier download of the same
+	// version. Without one it is only known once the image has gone out,
+	// so it follows as a trailer. Trailers need a chunked body on
+	// HTTP/1.1, so Content-Length is then left out.
+	digest := upstreamDigest(resp)
+	if digest == nil {
+		digest = upstreamDigests.Lookup(photoId, etag)
+	}
+	if digest != nil {
+		w.Header().Set("Repr-Digest", reprDigest(digest))
+		if resp.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+	} else {
+		w.Header().Set("Trailer", "Repr-Digest")
+	}
+
+	// Keep a copy while streaming so the next request is served locally.
+	// A body that ends early or outgrows the limits is never cached, and
+	// the transfer is cut short.
+	buf := &imageBuffer{photoId: photoId}
+	defer buf.Release()
+	hash := sha256.New()
+	if _, err := io.Copy(w, io.TeeReader(body, io.MultiWriter(buf, hash))); err != nil {
+		if _, ok := err.(*tempestError); ok {
+			// The 200 is already on its way; dropping the connection is
+			// the only way to tell the client the image is incomplete.
+			panic(http.ErrAbortHandler)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			logf("INVALID IMAGE: Tempest returned a bad image for ID %s: declared %d bytes but the body ended after %d", photoId, resp.ContentLength, buf.Len())
+			return
+		}
+		logf("ERROR: Transfer of image %s to %s failed after %d bytes: %v", photoId, clientIP, buf.Len(), err)
+		return
+	}
+	if resp.ContentLength >= 0 && int64(buf.Len()) != resp.ContentLength {
+		logf("INVALID IMAGE: Tempest returned a bad image for ID %s: declared %d bytes but sent %d", photoId, resp.ContentLength, buf.Len())
+		return
+	}
+	sum := hash.Sum(nil)
+	if digest != nil && !bytes.Equal(sum, digest) {
+		// The last bytes are still buffered; dropping the connection
+		// keeps them from the client along with the image.
+		logf("INVALID IMAGE: Tempest returned a bad image for ID %s: it doesn't match its digest %s", photoId, reprDigest(digest))
+		upstreamDigests.Forget(photoId)
+		panic(http.ErrAbortHandler)
+	}
+	if digest == nil {
+		w.Header().Set("Repr-Digest", reprDigest(sum))
+	}
+	entry := newCacheEntry(resp.Header, buf.Bytes(), time.Since(start))
+	images.Put(photoId, entry)
+	upstreamDigests.Remember(photoId, entry.ETag, entry.Digest)
+}
+
+// loadImage returns the complete image for photoId, from the cache when
+// possible and otherwise from Tempest, caching the result. The second return
+// value reports whether the cache was used.
+func loadImage(ctx context.Context, photoId string) (*cacheEntry, bool, error) {
+	return loadUpstream(ctx, photoId, photoId, fetchTempestImage)
+}
+
+// rawCacheKey is the cache key of the raw preview of photoId.
+func rawCacheKey(photoId string) string {
+	return photoId + "|raw"
+}
+
+// loadRawImage is loadImage for the unrotated, uncropped preview.
+func loadRawImage(ctx context.Context, photoId string) (*cacheEntry, bool, error) {
+	return loadUpstream(ctx, rawCacheKey(photoId), photoId, fetchTempestRawImage)
+}
+
+// loadUpstream returns the cache entry under key, fetching photoId with fetch
+// and caching it on a miss. The fetch is abandoned if ctx is cancelled.
+func loadUpstream(ctx context.Context, key string, photoId string, fetch func(context.Context, string) (*http.Response, error)) (*cacheEntry, bool, error) {
+	if entry, ok := images.Get(key); ok {
+		return entry, true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tempestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := fetch(ctx, photoId)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	entry, err := readUpstreamImage(photoId, resp, start)
+	if err != nil {
+		return nil, false, err
+	}
+	images.Put(key, entry)
+	if key == photoId {
+		upstreamDigests.Remember(photoId, entry.ETag, entry.Digest)
+	}
+	return entry, false, nil
+}
+
+// readUpstreamImage reads and validates a complete 200 response from Tempest.
+// start is when the request was sent.
+func readUpstreamImage(photoId string, resp *http.Response, start time.Time) (*cacheEntry, error) {
+	if resp.ContentLength > *maxUpstreamBytes {
+		return nil, upstreamTooLargeError(photoId, resp.ContentLength)
+	}
+
+	buf := &imageBuffer{photoId: photoId}
+	defer buf.Release()
+	if _, err := io.Copy(buf, resp.Body); err != nil {
+		if te, ok := err.(*tempestError); ok {
+			return nil, te
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, invalidImageError(photoId, fmt.Sprintf("Tempest declared %d bytes but the body ended early", resp.ContentLength))
+		}
+		return nil, &tempestError{codeUpstreamConnection, "Connection failed", fmt.Sprintf("Unable to read image from Tempest API: %v", err), http.StatusInternalServerError}
+	}
+	data := buf.Bytes()
+
+	contentType, err := checkImageBody(photoId, resp.Header, resp.ContentLength, data)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("Content-Type", contentType)
+	entry := newCacheEntry(resp.Header, data, time.Since(start))
+	if digest := upstreamDigest(resp); digest != nil && !bytes.Equal(digest, entry.Digest) {
+		return nil, invalidImageError(photoId, fmt.Sprintf("The image doesn't match its digest %s", reprDigest(digest)))
+	}
+	return entry, nil
+}
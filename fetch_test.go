@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fakeTempestWithValidators serves data as every preview with an ETag, so
+// /fetch-photo streams it and forwards ranges, adding digestHeader if set.
+func fakeTempestWithValidators(t *testing.T, data []byte, digestHeader string) {
+	srv := fakeTempest(t, nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("ETag", `"v1"`)
+		if digestHeader != "" {
+			w.Header().Set("Repr-Digest", digestHeader)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	})
+}
+
+func fetchPhoto(method, rangeHeader string) (rec *httptest.ResponseRecorder, aborted bool) {
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(method, "/fetch-photo?id=abc", nil)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	defer func() {
+		if recover() == http.ErrAbortHandler {
+			aborted = true
+		}
+	}()
+	handleFetchPhoto(rec, req)
+	return rec, false
+}
+
+// Without a known digest the image is sent chunked, so that HTTP/1.1
+// clients also get the trailer.
+func TestStreamedImageSendsDigestTrailer(t *testing.T) {
+	data := testJPEG(t)
+	fakeTempestWithValidators(t, data, "")
+
+	rec, aborted := fetchPhoto(http.MethodGet, "")
+	if aborted || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, aborted %v", rec.Code, aborted)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "" {
+		t.Errorf("Content-Length = %q alongside a trailer", got)
+	}
+	if got, want := rec.Result().Trailer.Get("Repr-Digest"), reprDigest(contentDigest(data)); got != want {
+		t.Errorf("Repr-Digest trailer = %q, want %q", got, want)
+	}
+	if !bytes.Equal(upstreamDigests.Lookup("abc", `"v1"`), contentDigest(data)) {
+		t.Error("the digest of the streamed image wasn't remembered")
+	}
+}
+
+func TestStreamedImageUsesUpstreamDigest(t *testing.T) {
+	data := testJPEG(t)
+	fakeTempestWithValidators(t, data, reprDigest(contentDigest(data)))
+
+	rec, aborted := fetchPhoto(http.MethodGet, "")
+	if aborted || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, aborted %v", rec.Code, aborted)
+	}
+	if got := rec.Header().Get("Repr-Digest"); got != reprDigest(contentDigest(data)) {
+		t.Errorf("Repr-Digest header = %q, want Tempest's", got)
+	}
+	if rec.Header().Get("Trailer") != "" {
+		t.Error("a trailer was declared although the digest was known")
+	}
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(data)) {
+		t.Errorf("Content-Length = %q, want %d", got, len(data))
+	}
+}
+
+func TestStreamedImageMismatchingDigestIsAborted(t *testing.T) {
+	data := testJPEG(t)
+	fakeTempestWithValidators(t, data, reprDigest(contentDigest([]byte("something else"))))
+
+	if _, aborted := fetchPhoto(http.MethodGet, ""); !aborted {
+		t.Error("the response wasn't aborted")
+	}
+	if _, ok := images.Get("abc"); ok {
+		t.Error("an image that doesn't match its digest was cached")
+	}
+}
+
+func TestRememberedDigestOnRangeAndHead(t *testing.T) {
+	data := testJPEG(t)
+	fakeTempestWithValidators(t, data, "")
+	if rec, _ := fetchPhoto(http.MethodGet, ""); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	// Once the image has left the cache, ranges and HEAD go to Tempest.
+	images = newImageCache(imageCacheMaxBytes, imageCacheTTL)
+	want := reprDigest(contentDigest(data))
+
+	rec, _ := fetchPhoto(http.MethodGet, "bytes=0-9")
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("range: status %d", rec.Code)
+	}
+	if got := rec.Header().Get("Repr-Digest"); got != want {
+		t.Errorf("range: Repr-Digest = %q, want %q", got, want)
+	}
+
+	rec, _ = fetchPhoto(http.MethodHead, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("HEAD: status %d", rec.Code)
+	}
+	if got := rec.Header().Get("Repr-Digest"); got != want {
+		t.Errorf("HEAD: Repr-Digest = %q, want %q", got, want)
+	}
+}
+
+func TestUpstreamDigest(t *testing.T) {
+	sum := contentDigest([]byte("image"))
+	get := &http.Request{Method: http.MethodGet}
+	head := &http.Request{Method: http.MethodHead}
+	tests := []struct {
+		name   string
+		status int
+		req    *http.Request
+		header http.Header
+		want   []byte
+	}{
+		{"repr-digest", 200, get, http.Header{"Repr-Digest": {reprDigest(sum)}}, sum},
+		{"among other algorithms", 200, get, http.Header{"Repr-Digest": {"sha-512=:AAAA:, " + reprDigest(sum)}}, sum},
+		{"repr-digest on a 206", 206, get, http.Header{"Repr-Digest": {reprDigest(sum)}}, sum},
+		{"content-digest", 200, get, http.Header{"Content-Digest": {reprDigest(sum)}}, sum},
+		{"content-digest on a 206", 206, get, http.Header{"Content-Digest": {reprDigest(sum)}}, nil},
+		{"content-digest on HEAD", 200, head, http.Header{"Content-Digest": {reprDigest(sum)}}, nil},
+		{"content-digest when encoded", 200, get, http.Header{"Content-Digest": {reprDigest(sum)}, "Content-Encoding": {"gzip"}}, nil},
+		{"wrong length", 200, get, http.Header{"Repr-Digest": {"sha-256=:AAAA:"}}, nil},
+		{"not a byte sequence", 200, get, http.Header{"Repr-Digest": {"sha-256=" + reprDigest(sum)[9:]}}, nil},
+		{"none", 200, get, http.Header{}, nil},
+	}
+	for _, tt := range tests {
+		got := upstreamDigest(&http.Response{StatusCode: tt.status, Request: tt.req, Header: tt.header})
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContentRangeTotal(t *testing.T) {
+	for header, want := range map[string]int64{
+		"bytes 0-0/12345":   12345,
+		"bytes 100-199/200": 200,
+		"bytes 0-0/*":       -1,
+		"bytes */500":       500,
+		"":                  -1,
+		"garbage":           -1,
+	} {
+		if got := contentRangeTotal(header); got != want {
+			t.Errorf("contentRangeTotal(%q) = %d, want %d", header, got, want)
+		}
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	data := testJPEG(t)
+	fakeTempestWithValidators(t, data, "")
+	total := strconv.Itoa(len(data))
+
+	// Not cached yet: the range is forwarded to Tempest.
+	rec, _ := fetchPhoto(http.MethodGet, "bytes=0-9")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[:10]) {
+		t.Fatalf("forwarded range: status %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 0-9/"+total {
+		t.Errorf("forwarded range: Content-Range %q", got)
+	}
+
+	full, _ := fetchPhoto(http.MethodGet, "")
+	etag := full.Header().Get("ETag")
+
+	tests := []struct {
+		name, rangeHeader, ifRange string
+		status                     int
+		body                       []byte
+	}{
+		{"cached range", "bytes=10-19", "", http.StatusPartialContent, data[10:20]},
+		{"suffix range", "bytes=-5", "", http.StatusPartialContent, data[len(data)-5:]},
+		{"If-Range with the current ETag", "bytes=0-3", etag, http.StatusPartialContent, data[:4]},
+		{"If-Range with an old ETag", "bytes=0-3", `"old"`, http.StatusOK, data},
+		{"unsatisfiable", "bytes=" + total + "-", "", http.StatusRequestedRangeNotSatisfiable, nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/fetch-photo?id=abc", nil)
+		req.Header.Set("Range", tt.rangeHeader)
+		if tt.ifRange != "" {
+			req.Header.Set("If-Range", tt.ifRange)
+		}
+		rec := httptest.NewRecorder()
+		handleFetchPhoto(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		if tt.body != nil && !bytes.Equal(rec.Body.Bytes(), tt.body) {
+			t.Errorf("%s: got %d bytes, want %d", tt.name, rec.Body.Len(), len(tt.body))
+		}
+		if rec.Header().Get("X-Cache") != "HIT" {
+			t.Errorf("%s: not served from the cache", tt.name)
+		}
+	}
+}
+
+func TestRangeIgnoredByTempest(t *testing.T) {
+	data := testJPEG(t)
+	srv := fakeTempest(t, nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(data)
+	})
+
+	rec, _ := fetchPhoto(http.MethodGet, "bytes=5-14")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[5:15]) {
+		t.Errorf("status %d with %d bytes; want 206 with bytes 5-14", rec.Code, rec.Body.Len())
+	}
+	if _, ok := images.Get("abc"); !ok {
+		t.Error("the whole image Tempest sent wasn't cached")
+	}
+}
+
+// A client that goes away cancels the request to Tempest, without counting
+// against Tempest in the circuit breaker.
+func TestClientGoneCancelsUpstreamRequest(t *testing.T) {
+	withCircuitSettings(t, 1, time.Minute)
+	srv := fakeTempest(t, nil)
+	cancelled := make(chan struct{})
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	handleFetchPhoto(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fetch-photo?id=abc", nil).WithContext(ctx))
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request to Tempest wasn't cancelled")
+	}
+	if _, err := tempestCircuit.allow(); err != nil {
+		t.Errorf("the abandoned request opened the circuit: %v", err)
+	}
+}
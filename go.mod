@@ -0,0 +1,3 @@
+module tempest-image-finder
+
+go 1.22
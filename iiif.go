@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	iiifContext   = "http://iiif.io/api/image/3/context.json"
+	iiifProfile   = "http://iiif.io/api/image/3/level2.json"
+	iiifTileWidth = 512
+)
+
+// iiifPaths are the OpenAPI paths served under /iiif/.
+var iiifPaths = []string{
+	"/iiif/{id}",
+	"/iiif/{id}/info.json",
+	"/iiif/{id}/{region}/{size}/{rotation}/{quality}.{format}",
+}
+
+// iiifOrientations maps a IIIF rotation, and whether it is mirrored first,
+// to the EXIF orientation applyOrientation corrects the same way.
+var iiifOrientations = map[int][2]int{
+	0:   {1, 2},
+	90:  {6, 7},
+	180: {3, 4},
+	270: {8, 5},
+}
+
+// IIIFInfo is the info.json of a IIIF Image API 3.0 image service.
+type IIIFInfo struct {
+	Context        string     `json:"@context"`
+	ID             string     `json:"id"`
+	Type           string     `json:"type"`
+	Protocol       string     `json:"protocol"`
+	Profile        string     `json:"profile"`
+	Width          int        `json:"width"`
+	Height         int        `json:"height"`
+	MaxWidth       int        `json:"maxWidth"`
+	MaxHeight      int        `json:"maxHeight"`
+	MaxArea        int64      `json:"maxArea"`
+	Tiles          []IIIFTile `json:"tiles"`
+	ExtraFormats   []string   `json:"extraFormats"`
+	ExtraQualities []string   `json:"extraQualities"`
+	ExtraFeatures  []string   `json:"extraFeatures"`
+}
+
+// IIIFTile describes the tiles a viewer may ask for.
+type IIIFTile struct {
+	Width        int   `json:"width"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+// iiifRequest is a parsed IIIF image request, in pixels of the image.
+type iiifRequest struct {
+	Region      image.Rectangle
+	Width       int
+	Height      int
+	Orientation int    // EXIF orientation that performs the rotation
+	Quality     string // "default", "color", "gray" or "bitonal"
+	Format      string // "jpeg", "png" or "gif"
+	Watermark   bool   // set by the caller's API key, not by IIIF
+}
+
+func (req iiifRequest) cacheKey(photoId string) string {
+	return fmt.Sprintf("%s|iiif|region=%d,%d,%d,%d|size=%dx%d|orientation=%d|quality=%s|format=%s|watermark=%t",
+		photoId, req.Region.Min.X, req.Region.Min.Y, req.Region.Dx(), req.Region.Dy(), req.Width, req.Height, req.Orientation, req.Quality, req.Format, req.Watermark)
+}
+
+// handleIIIF serves the images as a IIIF Image API 3.0 service at level 2:
+// /iiif/{id}/info.json describes an image, and
+// /iiif/{id}/{region}/{size}/{rotation}/{quality}.{format} renders part of
+// it. Images come through the same cache as /fetch-photo, and the results
+// are cached next to them.
+func handleIIIF(w http.ResponseWriter, r *http.Request) {
+	// Work on the escaped path so IDs can contain an escaped slash.
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/iiif/"), "/")
+	for i, segment := range segments {
+		segments[i], _ = url.PathUnescape(segment)
+	}
+	photoId := segments[0]
+	if photoId == "" {
+		sendJSONError(w, codeMissingID, "Image ID required", "Please provide a valid image identifier", http.StatusBadRequest)
+		return
+	}
+
+	logf("%s %s - Client: %s", r.Method, r.URL.Path, r.RemoteAddr)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch {
+	case len(segments) == 1 || len(segments) == 2 && segments[1] == "":
+		http.Redirect(w, r, "/iiif/"+url.PathEscape(photoId)+"/info.json", http.StatusSeeOther)
+	case len(segments) == 2 && segments[1] == "info.json":
+		serveIIIFInfo(w, r, photoId)
+	case len(segments) == 5:
+		serveIIIFImage(w, r, photoId, segments[1:])
+	default:
+		sendJSONError(w, codeUnknownEndpoint, "Not found", fmt.Sprintf("Unknown endpoint %s", r.URL.Path), http.StatusNotFound)
+	}
+}
+
+// iiifImageSize loads photoId and reads its size.
+func iiifImageSize(ctx context.Context, photoId string) (*cacheEntry, int, int, error) {
+	entry, _, err := loadImage(ctx, photoId)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(entry.Data))
+	if err != nil {
+		return nil, 0, 0, &tempestError{codeUnsupportedImage, "Unsupported image", fmt.Sprintf("The %s image can't be processed: %v", normalizeImageType(entry.ContentType), err), http.StatusUnprocessableEntity}
+	}
+	return entry, cfg.Width, cfg.Height, nil
+}
+
+func serveIIIFInfo(w http.ResponseWriter, r *http.Request, photoId string) {
+	_, width, height, err := iiifImageSize(r.Context(), photoId)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+
+	// Offer tiles down to the scale at which the whole image fits in one.
+	tile := IIIFTile{Width: iiifTileWidth}
+	for f := 1; ; f *= 2 {
+		tile.ScaleFactors = append(tile.ScaleFactors, f)
+		if width <= iiifTileWidth*f && height <= iiifTileWidth*f {
+			break
+		}
+	}
+
+	info := IIIFInfo{
+		Context:        iiifContext,
+		ID:             requestBaseURL(r) + "/iiif/" + url.PathEscape(photoId),
+		Type:           "ImageService3",
+		Protocol:       "http://iiif.io/api/image",
+		Profile:        "level2",
+		Width:          width,
+		Height:         height,
+		MaxWidth:       maxRenderDimension,
+		MaxHeight:      maxRenderDimension,
+		MaxArea:        *maxImagePixels,
+		Tiles:          []IIIFTile{tile},
+		ExtraFormats:   []string{"gif"},
+		ExtraQualities: []string{"color", "gray", "bitonal"},
+		ExtraFeatures:  []string{"cors", "jsonldMediaType", "mirroring", "profileLinkHeader", "regionSquare", "sizeUpscaling"},
+	}
+
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		contentType = `application/ld+json;profile="` + iiifContext + `"`
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Link", "<"+iiifProfile+`>;rel="profile"`)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+func serveIIIFImage(w http.ResponseWriter, r *http.Request, photoId string, params []string) {
+	original, width, height, err := iiifImageSize(r.Context(), photoId)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	req, err := parseIIIFRequest(params, width, height)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	req.Watermark = keyWatermarks(w, r)
+
+	w.Header().Set("Link", "<"+iiifProfile+`>;rel="profile"`)
+	key := req.cacheKey(photoId)
+	if entry, ok := images.Get(key); ok {
+		logf("CACHE HIT: Serving variant %s (%d bytes) to %s", key, len(entry.Data), r.RemoteAddr)
+		serveImageEntry(w, r, entry, true)
+		return
+	}
+
+	entry, err := renderIIIF(photoId, original, req)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	images.Put(key, entry)
+
+	logf("SUCCESS: Serving variant %s (%d bytes) to %s", key, len(entry.Data), r.RemoteAddr)
+	serveImageEntry(w, r, entry, false)
+}
+
+// renderIIIF extracts, scales, rotates, watermarks and recolours original as
+// req asks.
+func renderIIIF(photoId string, original *cacheEntry, req iiifRequest) (*cacheEntry, error) {
+	if req.Watermark && studioMark == nil {
+		return nil, watermarkUnavailableError()
+	}
+	o := renderOptions{Width: req.Width, Height: req.Height, Fit: "fill", Crop: req.Region}
+	img, release, err := renderPixels(photoId, original, o)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var out image.Image = img
+	if req.Orientation != 1 {
+		need := int64(req.Width) * int64(req.Height) * 4
+		if !inflight.reserve(need) {
+			return nil, memoryBudgetError()
+		}
+		defer inflight.release(need)
+		out = applyOrientation(out, req.Orientation)
+	}
+	if req.Watermark {
+		// Marked after the rotation so the mark reads the right way up.
+		marked := toRGBA(out)
+		studioMark.draw(marked)
+		out = marked
+	}
+	if req.Quality == "gray" || req.Quality == "bitonal" {
+		out = grayscale(out, req.Quality == "bitonal")
+	}
+
+	data, err := encodeImage(out, req.Format, defaultJPEGQuality)
+	if err != nil {
+		return nil, &tempestError{codeInternal, "Encoding failed", fmt.Sprintf("Unable to encode the image as %s: %v", req.Format, err), http.StatusInternalServerError}
+	}
+	return &cacheEntry{
+		ContentType:     "image/" + req.Format,
+		Data:            data,
+		FetchedAt:       time.Now(),
+		UpstreamLatency: original.UpstreamLatency,
+		ETag:            contentETag(data),
+		LastModified:    original.LastModified,
+		Digest:          contentDigest(data),
+	}, nil
+}
+
+// grayscale converts img to gray, or to pure black and white if bitonal.
+func grayscale(img image.Image, bitonal bool) *image.Gray {
+	b := img.Bounds()
+	out := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			g := color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray)
+			if bitonal {
+				if g.Y < 128 {
+					g.Y = 0
+				} else {
+					g.Y = 255
+				}
+			}
+			out.Pix[y*out.Stride+x] = g.Y
+		}
+	}
+	return out
+}
+
+// parseIIIFRequest reads the region, size, rotation and quality.format
+// segments of an image request for a width×height image.
+func parseIIIFRequest(params []string, width, height int) (iiifRequest, error) {
+	var req iiifRequest
+	var err error
+	if req.Region, err = parseIIIFRegion(params[0], width, height); err != nil {
+		return req, err
+	}
+	if req.Width, req.Height, err = parseIIIFSize(params[1], req.Region.Dx(), req.Region.Dy()); err != nil {
+		return req, err
+	}
+
+	rotation := params[2]
+	mirrored := strings.HasPrefix(rotation, "!")
+	degrees, err := strconv.ParseFloat(strings.TrimPrefix(rotation, "!"), 64)
+	if err != nil || degrees < 0 || degrees > 360 {
+		return req, invalidParameterError("rotation must be a number of degrees between 0 and 360, optionally preceded by ! to mirror")
+	}
+	orientations, ok := iiifOrientations[int(degrees)%360]
+	if !ok || degrees != math.Trunc(degrees) {
+		return req, invalidParameterError("rotation must be a multiple of 90 degrees")
+	}
+	req.Orientation = orientations[0]
+	if mirrored {
+		req.Orientation = orientations[1]
+	}
+
+	quality, format, ok := strings.Cut(params[3], ".")
+	switch quality {
+	case "default", "color", "gray", "bitonal":
+		req.Quality = quality
+	default:
+		return req, invalidParameterError("quality must be default, color, gray or bitonal")
+	}
+	switch format {
+	case "jpg":
+		req.Format = "jpeg"
+	case "png", "gif":
+		req.Format = format
+	default:
+		return req, invalidParameterError("format must be jpg, png or gif")
+	}
+	return req, nil
+}
+
+// parseIIIFRegion reads full, square, x,y,w,h or pct:x,y,w,h. Regions that
+// extend past the image are cut at its edge.
+func parseIIIFRegion(s string, width, height int) (image.Rectangle, error) {
+	bounds := image.Rect(0, 0, width, height)
+	switch s {
+	case "full":
+		return bounds, nil
+	case "square":
+		side := width
+		if height < side {
+			side = height
+		}
+		x, y := (width-side)/2, (height-side)/2
+		return image.Rect(x, y, x+side, y+side), nil
+	}
+
+	pct := strings.HasPrefix(s, "pct:")
+	parts := strings.Split(strings.TrimPrefix(s, "pct:"), ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, invalidParameterError("region must be full, square, x,y,w,h or pct:x,y,w,h")
+	}
+	var v [4]float64
+	for i, p := range parts {
+		n, err := strconv.ParseFloat(p, 64)
+		if err != nil || n < 0 || (!pct && n != math.Trunc(n)) {
+			return image.Rectangle{}, invalidParameterError("region must be full, square, x,y,w,h or pct:x,y,w,h")
+		}
+		v[i] = n
+	}
+	if pct {
+		v[0], v[2] = v[0]*float64(width)/100, v[2]*float64(width)/100
+		v[1], v[3] = v[1]*float64(height)/100, v[3]*float64(height)/100
+	}
+	x, y := int(math.Round(v[0])), int(math.Round(v[1]))
+	region := image.Rect(x, y, x+int(math.Round(v[2])), y+int(math.Round(v[3]))).Intersect(bounds)
+	if region.Empty() {
+		return image.Rectangle{}, invalidParameterError(fmt.Sprintf("region must overlap the %dx%d image", width, height))
+	}
+	return region, nil
+}
+
+// parseIIIFSize reads max, w,, ,h, pct:n, w,h or !w,h, each optionally
+// preceded by ^ to allow enlarging, for a region of rw×rh pixels.
+func parseIIIFSize(s string, rw, rh int) (int, int, error) {
+	upscale := strings.HasPrefix(s, "^")
+	s = strings.TrimPrefix(s, "^")
+	invalid := invalidParameterError("size must be max, w,, ,h, pct:n, w,h or !w,h, optionally preceded by ^")
+
+	var w, h int
+	switch {
+	case s == "max":
+		w, h = rw, rh
+		if scale := math.Min(float64(maxRenderDimension)/float64(rw), float64(maxRenderDimension)/float64(rh)); scale < 1 {
+			w, h = int(float64(rw)*scale), int(float64(rh)*scale)
+		}
+		if area := int64(w) * int64(h); area > *maxImagePixels {
+			scale := math.Sqrt(float64(*maxImagePixels) / float64(area))
+			w, h = int(float64(w)*scale), int(float64(h)*scale)
+		}
+	case strings.HasPrefix(s, "pct:"):
+		n, err := strconv.ParseFloat(strings.TrimPrefix(s, "pct:"), 64)
+		if err != nil || n <= 0 {
+			return 0, 0, invalid
+		}
+		w, h = int(math.Round(float64(rw)*n/100)), int(math.Round(float64(rh)*n/100))
+	default:
+		confined := strings.HasPrefix(s, "!")
+		ws, hs, ok := strings.Cut(strings.TrimPrefix(s, "!"), ",")
+		if !ok || (ws == "" && hs == "") || (confined && (ws == "" || hs == "")) {
+			return 0, 0, invalid
+		}
+		var err error
+		if ws != "" {
+			if w, err = strconv.Atoi(ws); err != nil || w < 1 {
+				return 0, 0, invalid
+			}
+		}
+		if hs != "" {
+			if h, err = strconv.Atoi(hs); err != nil || h < 1 {
+				return 0, 0, invalid
+			}
+		}
+		switch {
+		case confined:
+			scale := math.Min(float64(w)/float64(rw), float64(h)/float64(rh))
+			w, h = int(math.Round(float64(rw)*scale)), int(math.Round(float64(rh)*scale))
+		case h == 0:
+			h = int(math.Round(float64(rh) * float64(w) / float64(rw)))
+		case w == 0:
+			w = int(math.Round(float64(rw) * float64(h) / float64(rh)))
+		}
+	}
+
+	w, h = maxInt(1, w), maxInt(1, h)
+	if !upscale && (w > rw || h > rh) {
+		return 0, 0, invalidParameterError(fmt.Sprintf("size %dx%d is larger than the %dx%d region; prefix it with ^ to enlarge", w, h, rw, rh))
+	}
+	if w > maxRenderDimension || h > maxRenderDimension {
+		return 0, 0, invalidParameterError(fmt.Sprintf("size %dx%d is larger than the %dx%d pixel maximum", w, h, maxRenderDimension, maxRenderDimension))
+	}
+	if int64(w)*int64(h) > *maxImagePixels {
+		return 0, 0, invalidParameterError(fmt.Sprintf("size %dx%d has more than the maximum of %d pixels", w, h, *maxImagePixels))
+	}
+	return w, h, nil
+}
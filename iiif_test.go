@@ -0,0 +1,100 @@
+package main
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestParseIIIFRegion(t *testing.T) {
+	tests := []struct {
+		region string
+		want   image.Rectangle
+		ok     bool
+	}{
+		{"full", image.Rect(0, 0, 1000, 800), true},
+		{"square", image.Rect(100, 0, 900, 800), true},
+		{"125,15,120,140", image.Rect(125, 15, 245, 155), true},
+		{"pct:10,10,50,50", image.Rect(100, 80, 600, 480), true},
+		{"pct:1.5,0,10,10", image.Rect(15, 0, 115, 80), true},
+		{"900,700,500,500", image.Rect(900, 700, 1000, 800), true},
+		{"1000,0,10,10", image.Rectangle{}, false},
+		{"1.5,0,10,10", image.Rectangle{}, false},
+		{"-1,0,10,10", image.Rectangle{}, false},
+		{"0,0,10", image.Rectangle{}, false},
+		{"everything", image.Rectangle{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseIIIFRegion(tt.region, 1000, 800)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("region %q = %v, %v; want %v, ok=%v", tt.region, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseIIIFSize(t *testing.T) {
+	tests := []struct {
+		size string
+		w, h int
+		ok   bool
+	}{
+		{"max", 1000, 800, true},
+		{"500,", 500, 400, true},
+		{",400", 500, 400, true},
+		{"pct:50", 500, 400, true},
+		{"500,500", 500, 500, true},
+		{"!500,500", 500, 400, true},
+		{"^2000,", 2000, 1600, true},
+		{"^max", 1000, 800, true},
+		{"2000,", 0, 0, false},
+		{"1000,801", 0, 0, false},
+		{"0,", 0, 0, false},
+		{",", 0, 0, false},
+		{"!500,", 0, 0, false},
+		{"pct:0", 0, 0, false},
+		{"^9000,", 0, 0, false},
+		{"big", 0, 0, false},
+	}
+	for _, tt := range tests {
+		w, h, err := parseIIIFSize(tt.size, 1000, 800)
+		if (err == nil) != tt.ok || w != tt.w || h != tt.h {
+			t.Errorf("size %q = %dx%d, %v; want %dx%d, ok=%v", tt.size, w, h, err, tt.w, tt.h, tt.ok)
+		}
+	}
+}
+
+func TestParseIIIFRequest(t *testing.T) {
+	tests := []struct {
+		path        string
+		orientation int
+		quality     string
+		format      string
+		ok          bool
+	}{
+		{"full/max/0/default.jpg", 1, "default", "jpeg", true},
+		{"full/max/!0/default.jpg", 2, "default", "jpeg", true},
+		{"full/max/90/color.png", 6, "color", "png", true},
+		{"full/max/!90/gray.gif", 7, "gray", "gif", true},
+		{"full/max/180/bitonal.jpg", 3, "bitonal", "jpeg", true},
+		{"full/max/!180/default.jpg", 4, "default", "jpeg", true},
+		{"full/max/270/default.jpg", 8, "default", "jpeg", true},
+		{"full/max/!270/default.jpg", 5, "default", "jpeg", true},
+		{"full/max/360/default.jpg", 1, "default", "jpeg", true},
+		{"full/max/45/default.jpg", 0, "", "", false},
+		{"full/max/90.5/default.jpg", 0, "", "", false},
+		{"full/max/-90/default.jpg", 0, "", "", false},
+		{"full/max/0/native.jpg", 0, "", "", false},
+		{"full/max/0/default.webp", 0, "", "", false},
+		{"full/max/0/default", 0, "", "", false},
+	}
+	for _, tt := range tests {
+		req, err := parseIIIFRequest(strings.Split(tt.path, "/"), 1000, 800)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok=%v", tt.path, err, tt.ok)
+			continue
+		}
+		if tt.ok && (req.Orientation != tt.orientation || req.Quality != tt.quality || req.Format != tt.format) {
+			t.Errorf("%s = orientation %d, %s.%s; want %d, %s.%s", tt.path, req.Orientation, req.Quality, req.Format, tt.orientation, tt.quality, tt.format)
+		}
+	}
+}
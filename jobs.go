@@ -0,0 +1,855 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxJobIDs     = 5000
+	maxQueuedJobs = 20
+)
+
+// jobPaths are the OpenAPI paths served under /api/v1/jobs/.
+var jobPaths = []string{"/api/v1/jobs/{id}", "/api/v1/jobs/{id}/archive"}
+
+// jobParameters are the /fetch-photo parameters a job can apply to every
+// image.
+var jobParameters = []string{"w", "h", "fit", "format", "q", "raw", "orient", "crop", "watermark"}
+
+// Job and item states. A job is finished once it is completed, failed or
+// cancelled; a completed job has an archive even if some images failed.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+
+	itemPending  = "pending"
+	itemFetching = "fetching"
+	itemDone     = "done"
+	itemFailed   = "failed"
+)
+
+// JobRequest is the body of POST /api/v1/jobs.
+type JobRequest struct {
+	IDs    []string          `json:"ids"`
+	Params map[string]string `json:"params"`
+}
+
+// Job is the body of GET /api/v1/jobs/{id}: the progress of a background
+// download and, once it has completed, where to fetch the archive.
+type Job struct {
+	ID          string            `json:"id"`
+	State       string            `json:"state"`
+	CreatedAt   time.Time         `json:"created_at"`
+	StartedAt   *time.Time        `json:"started_at,omitempty"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Params      map[string]string `json:"params,omitempty"`
+	Total       int               `json:"total"`
+	Done        int               `json:"done"`
+	Failed      int               `json:"failed"`
+	Items       []JobItem         `json:"items"`
+	ArchiveURL  string            `json:"archive_url,omitempty"`
+	ArchiveSize int64             `json:"archive_size,omitempty"`
+}
+
+// JobItem is the progress of one image in a Job.
+type JobItem struct {
+	ID          string         `json:"id"`
+	State       string         `json:"state"`
+	ContentType string         `json:"content_type,omitempty"`
+	Size        int64          `json:"size,omitempty"`
+	SHA256      string         `json:"sha256,omitempty"`
+	ArchiveName string         `json:"archive_name,omitempty"`
+	Error       *ErrorResponse `json:"error,omitempty"`
+}
+
+// job is a queued or finished download. status is guarded by mu and copied
+// out by snapshot; everything else is fixed when the job is created. Every
+// change to status is saved in db, so the job can carry on where it left off
+// if the server restarts.
+type job struct {
+	mu     sync.Mutex
+	status Job
+	files  []string // file of each done item, relative to dir
+	owner  string   // apiKeyID of the key that queued it
+	opts   renderOptions
+	dir    string
+	db     *kvStore
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// jobRecord is how a job is kept in the job store, under "job/{id}". The
+// outcome of each image is kept separately, under "item/{id}/{index}", so
+// that it can be saved cheaply as each image finishes.
+type jobRecord struct {
+	ID          string            `json:"id"`
+	State       string            `json:"state"`
+	CreatedAt   time.Time         `json:"created_at"`
+	StartedAt   *time.Time        `json:"started_at,omitempty"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Params      map[string]string `json:"params,omitempty"`
+	Watermark   bool              `json:"watermark,omitempty"` // also set when the caller's API key forced it
+	Owner       string            `json:"owner"`               // apiKeyID of the key that queued it
+	IDs         []string          `json:"ids"`
+	ArchiveSize int64             `json:"archive_size,omitempty"`
+}
+
+// jobItemRecord is the saved outcome of one image of a job.
+type jobItemRecord struct {
+	JobItem
+	File string `json:"file,omitempty"`
+}
+
+// jobQueue holds every job and runs them one at a time, in the order they
+// were queued, each with -job-workers fetches in flight.
+type jobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	pending chan *job
+	db      *kvStore
+}
+
+var jobs = &jobQueue{
+	jobs:    make(map[string]*job),
+	pending: make(chan *job, maxQueuedJobs),
+}
+
+// run works through the queue forever.
+func (q *jobQueue) run() {
+	for j := range q.pending {
+		j.run()
+	}
+}
+
+// add queues a new job, reporting false if the queue is full.
+func (q *jobQueue) add(j *job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case q.pending <- j:
+	default:
+		return false
+	}
+	q.jobs[j.status.ID] = j
+	return true
+}
+
+func (q *jobQueue) get(id string) (*job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	return j, ok
+}
+
+// forget deletes a job and everything it fetched.
+func (q *jobQueue) forget(j *job) {
+	q.mu.Lock()
+	delete(q.jobs, j.status.ID)
+	q.mu.Unlock()
+
+	os.RemoveAll(j.dir)
+	err := q.db.Delete("item/" + j.status.ID + "/")
+	if err == nil {
+		err = q.db.Delete("job/" + j.status.ID)
+	}
+	if err != nil {
+		logf("JOB %s: ERROR: Unable to delete: %v", j.status.ID, err)
+	}
+}
+
+// restore loads the jobs kept in the job store and queues the unfinished
+// ones again. Images they already fetched are kept rather than fetched
+// again. Directories in -jobs-dir that belong to no job are removed.
+func (q *jobQueue) restore() error {
+	var unfinished []*job
+	for _, key := range q.db.Keys("job/") {
+		var rec jobRecord
+		if _, err := q.db.Get(key, &rec); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		j, err := restoreJob(q.db, rec)
+		if err != nil {
+			return fmt.Errorf("job %s: %v", rec.ID, err)
+		}
+		q.jobs[rec.ID] = j
+		if !j.finished() {
+			unfinished = append(unfinished, j)
+		}
+	}
+
+	entries, err := os.ReadDir(*jobsDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, ok := q.jobs[e.Name()]; e.IsDir() && !ok {
+			os.RemoveAll(filepath.Join(*jobsDir, e.Name()))
+		}
+	}
+
+	sort.Slice(unfinished, func(a, b int) bool {
+		return unfinished[a].status.CreatedAt.Before(unfinished[b].status.CreatedAt)
+	})
+	for _, j := range unfinished {
+		logf("JOB %s: Resuming with %d of %d images left", j.status.ID, j.status.Total-j.status.Done-j.status.Failed, j.status.Total)
+	}
+	// More jobs may have been unfinished than the queue holds; the rest
+	// wait their turn.
+	go func() {
+		for _, j := range unfinished {
+			q.pending <- j
+		}
+	}()
+	return nil
+}
+
+// restoreJob rebuilds a job from its record and the outcomes of its images.
+// An image whose file has gone missing from an unfinished job is fetched
+// again.
+func restoreJob(db *kvStore, rec jobRecord) (*job, error) {
+	items := make([]JobItem, len(rec.IDs))
+	for i, photoId := range rec.IDs {
+		items[i] = JobItem{ID: photoId, State: itemPending}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		status: Job{
+			ID:          rec.ID,
+			State:       rec.State,
+			CreatedAt:   rec.CreatedAt,
+			StartedAt:   rec.StartedAt,
+			FinishedAt:  rec.FinishedAt,
+			Params:      rec.Params,
+			Total:       len(rec.IDs),
+			Items:       items,
+			ArchiveSize: rec.ArchiveSize,
+		},
+		files:  make([]string, len(rec.IDs)),
+		owner:  rec.Owner,
+		dir:    filepath.Join(*jobsDir, rec.ID),
+		db:     db,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	prefix := "item/" + rec.ID + "/"
+	for _, key := range db.Keys(prefix) {
+		i, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+		if err != nil || i < 0 || i >= len(items) {
+			continue
+		}
+		var item jobItemRecord
+		if _, err := db.Get(key, &item); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if !j.finished() {
+			// Images that failed are tried again, as are those whose
+			// file is missing or damaged.
+			switch item.State {
+			case itemFailed:
+				continue
+			case itemDone:
+				if !fileMatches(filepath.Join(j.dir, item.File), item.Size, item.SHA256) {
+					continue
+				}
+				j.files[i] = item.File
+			}
+		}
+		items[i] = item.JobItem
+		switch item.State {
+		case itemDone:
+			j.status.Done++
+		case itemFailed:
+			j.status.Failed++
+		}
+	}
+	if j.finished() {
+		return j, nil
+	}
+
+	var err error
+	j.opts, err = jobRenderOptions(rec.Params)
+	if err == nil && rec.Watermark && studioMark == nil {
+		err = watermarkUnavailableError()
+	}
+	if err != nil {
+		// The server's settings changed, e.g. it no longer has a
+		// watermark.
+		logf("JOB %s: ERROR: Can't be resumed: %v", rec.ID, err)
+		j.end(jobFailed)
+		return j, nil
+	}
+	j.opts.Watermark = j.opts.Watermark || rec.Watermark
+	if err := os.MkdirAll(j.dir, 0o700); err != nil {
+		return nil, err
+	}
+	j.status.State = jobQueued
+	j.save()
+	return j, nil
+}
+
+// expireEvery runs expire now and then once every interval.
+func (q *jobQueue) expireEvery(interval time.Duration) {
+	for {
+		q.expire()
+		time.Sleep(interval)
+	}
+}
+
+// expire deletes jobs that finished more than -job-retention ago, then the
+// oldest completed jobs until their archives fit in -jobs-max-bytes.
+func (q *jobQueue) expire() {
+	type finishedJob struct {
+		j    *job
+		at   time.Time
+		size int64
+	}
+	var done []finishedJob
+	var total int64
+	q.mu.Lock()
+	for _, j := range q.jobs {
+		s := j.snapshot()
+		if s.FinishedAt == nil {
+			continue
+		}
+		done = append(done, finishedJob{j, *s.FinishedAt, s.ArchiveSize})
+		total += s.ArchiveSize
+	}
+	q.mu.Unlock()
+
+	sort.Slice(done, func(a, b int) bool { return done[a].at.Before(done[b].at) })
+	for _, f := range done {
+		reason := ""
+		switch {
+		case time.Since(f.at) > *jobRetention:
+			reason = fmt.Sprintf("older than %s", *jobRetention)
+		case total > *jobsMaxBytes && f.size > 0:
+			reason = fmt.Sprintf("archives over %d bytes", *jobsMaxBytes)
+		default:
+			continue
+		}
+		q.forget(f.j)
+		total -= f.size
+		logf("JOB %s: Removed, %s", f.j.status.ID, reason)
+	}
+}
+
+// newJob prepares a job for ids, queued by the API key owner, creating its
+// directory under -jobs-dir and saving it in db.
+func newJob(db *kvStore, owner string, ids []string, params map[string]string, opts renderOptions) (*job, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+	dir := filepath.Join(*jobsDir, id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	items := make([]JobItem, len(ids))
+	for i, photoId := range ids {
+		items[i] = JobItem{ID: photoId, State: itemPending}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		status: Job{ID: id, State: jobQueued, CreatedAt: time.Now().UTC(), Params: params, Total: len(ids), Items: items},
+		files:  make([]string, len(ids)),
+		owner:  owner,
+		opts:   opts,
+		dir:    dir,
+		db:     db,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	j.save()
+	return j, nil
+}
+
+// save writes the job's record to the job store, waiting until it is on
+// disk. The caller must hold mu, except while the job is being created.
+func (j *job) save() {
+	rec := jobRecord{
+		ID:          j.status.ID,
+		State:       j.status.State,
+		CreatedAt:   j.status.CreatedAt,
+		StartedAt:   j.status.StartedAt,
+		FinishedAt:  j.status.FinishedAt,
+		Params:      j.status.Params,
+		Watermark:   j.opts.Watermark,
+		Owner:       j.owner,
+		IDs:         make([]string, len(j.status.Items)),
+		ArchiveSize: j.status.ArchiveSize,
+	}
+	for i, item := range j.status.Items {
+		rec.IDs[i] = item.ID
+	}
+	if err := j.db.Put("job/"+rec.ID, rec, true); err != nil {
+		logf("JOB %s: ERROR: Unable to save: %v", rec.ID, err)
+	}
+}
+
+// saveItem writes the outcome of the i'th image to the job store. A crash
+// of the whole machine may lose the last few, which are then fetched again.
+// The caller must hold mu.
+func (j *job) saveItem(i int) {
+	rec := jobItemRecord{JobItem: j.status.Items[i], File: j.files[i]}
+	if err := j.db.Put(fmt.Sprintf("item/%s/%05d", j.status.ID, i), rec, false); err != nil {
+		logf("JOB %s: ERROR: Unable to save progress: %v", j.status.ID, err)
+	}
+}
+
+// snapshot copies the job's status so it can be sent without holding mu.
+func (j *job) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.status
+	s.Items = append([]JobItem(nil), j.status.Items...)
+	return s
+}
+
+func (j *job) finished() bool {
+	switch j.status.State {
+	case jobCompleted, jobFailed, jobCancelled:
+		return true
+	}
+	return false
+}
+
+// run fetches every image of the job, then writes its archive.
+func (j *job) run() {
+	j.mu.Lock()
+	if j.finished() {
+		// Cancelled while it was queued.
+		j.mu.Unlock()
+		return
+	}
+	if j.status.StartedAt == nil {
+		now := time.Now().UTC()
+		j.status.StartedAt = &now
+	}
+	j.status.State = jobRunning
+	j.save()
+	// Images that have an outcome from before a restart are skipped.
+	var todo []int
+	for i, item := range j.status.Items {
+		if item.State != itemDone && item.State != itemFailed {
+			todo = append(todo, i)
+		}
+	}
+	j.mu.Unlock()
+
+	logf("JOB %s: Started fetching %d images", j.status.ID, len(todo))
+
+	slots := make(chan struct{}, *jobWorkers)
+	var wg sync.WaitGroup
+fetch:
+	for _, i := range todo {
+		select {
+		case slots <- struct{}{}:
+		case <-j.ctx.Done():
+			break fetch
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			j.fetch(i)
+		}(i)
+	}
+	wg.Wait()
+	j.finish()
+}
+
+// fetch loads the i'th image and saves it in the job's directory.
+func (j *job) fetch(i int) {
+	j.mu.Lock()
+	photoId := j.status.Items[i].ID
+	j.status.Items[i].State = itemFetching
+	j.mu.Unlock()
+
+	res := fetchJobImage(j.ctx, photoId, j.opts)
+	if j.ctx.Err() != nil {
+		// Cancelled while fetching; the job keeps nothing.
+		j.mu.Lock()
+		j.status.Items[i].State = itemPending
+		j.mu.Unlock()
+		return
+	}
+	name := fmt.Sprintf("%05d%s", i, imageExtension(res.contentType))
+	if res.err == nil {
+		res.err = os.WriteFile(filepath.Join(j.dir, name), res.data, 0o600)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.saveItem(i)
+	item := &j.status.Items[i]
+	if res.err != nil {
+		e := errorResponseFor(res.err)
+		item.State = itemFailed
+		item.Error = &e
+		j.status.Failed++
+		return
+	}
+	item.State = itemDone
+	item.ContentType = res.contentType
+	item.Size = int64(len(res.data))
+	item.SHA256 = hex.EncodeToString(contentDigest(res.data))
+	item.ArchiveName = archiveEntryName(photoId, res.contentType)
+	j.files[i] = name
+	j.status.Done++
+}
+
+// fetchJobImage loads one image for a job, rendered as o asks.
+func fetchJobImage(ctx context.Context, photoId string, o renderOptions) archiveResult {
+	if o.isZero() {
+		return fetchArchiveImage(ctx, photoId)
+	}
+
+	load := loadImage
+	sourceKey := photoId
+	if o.Raw {
+		load = loadRawImage
+		sourceKey = rawCacheKey(photoId)
+	}
+	original, _, err := load(ctx, photoId)
+	if err != nil {
+		return archiveResult{photoId: photoId, err: err}
+	}
+	if o.passesThrough(original) {
+		entry := sanitizedEntry(sourceKey, original)
+		return archiveResult{photoId: photoId, contentType: entry.ContentType, data: entry.Data}
+	}
+
+	key := o.cacheKey(photoId)
+	entry, ok := images.Get(key)
+	if !ok {
+		if entry, err = renderImage(photoId, original, o); err != nil {
+			return archiveResult{photoId: photoId, err: err}
+		}
+		images.Put(key, entry)
+	}
+	return archiveResult{photoId: photoId, contentType: entry.ContentType, data: entry.Data}
+}
+
+// finish records how the job ended, writing the archive unless it was
+// cancelled or every image failed.
+//
+// Every fetch has returned by now, so the items and files no longer change
+// and the archive is written from a copy without holding mu; status polls
+// carry on meanwhile.
+func (j *job) finish() {
+	j.mu.Lock()
+	items := append([]JobItem(nil), j.status.Items...)
+	files := append([]string(nil), j.files...)
+	done := j.status.Done
+	j.mu.Unlock()
+
+	state := jobCompleted
+	var size int64
+	switch {
+	case j.ctx.Err() != nil:
+		state = jobCancelled
+	case done == 0:
+		state = jobFailed
+	default:
+		var err error
+		if size, err = writeJobArchive(j.dir, items, files); err != nil {
+			logf("JOB %s: ERROR: Unable to write archive: %v", j.status.ID, err)
+			state = jobFailed
+		}
+	}
+
+	j.mu.Lock()
+	j.status.ArchiveSize = size
+	j.end(state)
+	logf("JOB %s: %s with %d/%d images", j.status.ID, strings.ToUpper(state), j.status.Done, j.status.Total)
+	if state == jobCancelled {
+		j.mu.Unlock()
+		return
+	}
+	event := eventJobCompleted
+	if state == jobFailed {
+		event = eventJobFailed
+	}
+	data := map[string]interface{}{
+		"job_id":      j.status.ID,
+		"state":       state,
+		"total":       j.status.Total,
+		"done":        j.status.Done,
+		"failed":      j.status.Failed,
+		"finished_at": j.status.FinishedAt,
+	}
+	if state == jobCompleted {
+		data["archive_path"] = "/api/v1/jobs/" + j.status.ID + "/archive"
+		data["archive_size"] = j.status.ArchiveSize
+	}
+	j.mu.Unlock()
+	// Saving the delivery syncs to disk, so it is done without mu.
+	notifyWebhooks(event, data)
+}
+
+// end marks the job finished and removes the images it fetched, leaving
+// only the archive. The caller must hold mu.
+func (j *job) end(state string) {
+	now := time.Now().UTC()
+	j.status.State = state
+	j.status.FinishedAt = &now
+	for i, name := range j.files {
+		if name != "" {
+			os.Remove(filepath.Join(j.dir, name))
+			j.files[i] = ""
+		}
+	}
+	if state != jobCompleted {
+		os.RemoveAll(j.dir)
+	}
+	j.save()
+}
+
+// writeJobArchive zips the fetched images in dir in the order they were
+// listed, with errors.json describing the ones that failed, as
+// /fetch-photos does. files holds the file name of each done item.
+func writeJobArchive(dir string, items []JobItem, files []string) (int64, error) {
+	path := filepath.Join(dir, "archive.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	var failures []archiveFailure
+	for i, item := range items {
+		if item.State != itemDone {
+			if item.Error != nil {
+				failures = append(failures, archiveFailure{ID: item.ID, ErrorResponse: *item.Error})
+			}
+			continue
+		}
+		if err := copyToArchive(zw, item.ArchiveName, filepath.Join(dir, files[i])); err != nil {
+			return 0, err
+		}
+	}
+	if len(failures) > 0 {
+		w, err := zw.Create("errors.json")
+		if err != nil {
+			return 0, err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(failures); err != nil {
+			return 0, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// copyToArchive stores the file at path in zw as name. Images are already
+// compressed, so it isn't compressed again.
+func copyToArchive(zw *zip.Writer, name, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// cancelJob stops a job, reporting false if it had already finished. A
+// running job stops starting new fetches at once, abandons those in flight
+// and is marked cancelled when they return.
+func (j *job) cancelJob() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.finished() {
+		return false
+	}
+	j.cancel()
+	if j.status.State == jobQueued {
+		j.end(jobCancelled)
+	}
+	return true
+}
+
+func jobNotFoundError(id string) *tempestError {
+	return &tempestError{codeJobNotFound, "Job not found", fmt.Sprintf("There is no job with the ID '%s'", id), http.StatusNotFound}
+}
+
+// jobRenderOptions validates the params of a job request.
+func jobRenderOptions(params map[string]string) (renderOptions, error) {
+	q := url.Values{}
+	for name, value := range params {
+		if !containsString(jobParameters, name) {
+			return renderOptions{}, invalidParameterError(fmt.Sprintf("params can only contain %s", strings.Join(jobParameters, ", ")))
+		}
+		q.Set(name, value)
+	}
+	return parseRenderOptions(q)
+}
+
+// jobStatus is the Job sent for j, with its archive URL once there is one.
+func jobStatus(r *http.Request, j *job) Job {
+	s := j.snapshot()
+	if s.State == jobCompleted {
+		s.ArchiveURL = requestBaseURL(r) + "/api/v1/jobs/" + s.ID + "/archive"
+	}
+	return s
+}
+
+// handleJobs queues a background download of the images listed in a
+// JobRequest. Unlike /fetch-photos, the caller gets the job's ID straight
+// away and polls /api/v1/jobs/{id} for its progress. It needs an API key,
+// and only that key can see the job afterwards.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	logf("%s /api/v1/jobs - Client: %s", r.Method, r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	caller, ok := requireAPIKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req JobRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		sendTempestError(w, invalidParameterError(fmt.Sprintf("The body must be a JSON JobRequest: %v", err)))
+		return
+	}
+
+	ids := parsePhotoIDs(strings.Join(req.IDs, ","))
+	if len(ids) == 0 {
+		sendJSONError(w, codeMissingID, "Image IDs required", "Please provide one or more image identifiers in ids", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxJobIDs {
+		sendJSONError(w, codeTooManyIDs, "Too many image IDs", fmt.Sprintf("A job can download at most %d images", maxJobIDs), http.StatusBadRequest)
+		return
+	}
+	opts, err := jobRenderOptions(req.Params)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	// Keys that watermark everything they fetch watermark their jobs.
+	opts.Watermark = opts.Watermark || caller.Watermark
+
+	j, err := newJob(jobs.db, apiKeyID(caller), ids, req.Params, opts)
+	if err != nil {
+		sendJSONError(w, codeInternal, "Unable to create job", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !jobs.add(j) {
+		jobs.forget(j)
+		sendJSONError(w, codeJobQueueFull, "Too many jobs", fmt.Sprintf("At most %d jobs can wait at once. Please try again when one has finished.", maxQueuedJobs), http.StatusServiceUnavailable)
+		return
+	}
+
+	logf("JOB %s: Queued %d images for %s", j.status.ID, len(ids), r.RemoteAddr)
+	w.Header().Set("Location", "/api/v1/jobs/"+j.status.ID)
+	sendJSON(w, jobStatus(r, j), http.StatusAccepted)
+}
+
+// handleJob serves /api/v1/jobs/{id}, which reports a job's progress and
+// cancels it on DELETE, and /api/v1/jobs/{id}/archive. Other API keys than
+// the one that queued the job are told it doesn't exist.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/"), "/")
+
+	logf("%s /api/v1/jobs/%s - Client: %s", r.Method, id, r.RemoteAddr)
+
+	if action != "" && action != "archive" {
+		sendJSONError(w, codeUnknownEndpoint, "Not found", fmt.Sprintf("Unknown endpoint %s", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	allowed := r.Method == http.MethodGet || r.Method == http.MethodHead || (action == "" && r.Method == http.MethodDelete)
+	if !allowed {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	caller, ok := requireAPIKey(w, r)
+	if !ok {
+		return
+	}
+	j, ok := jobs.get(id)
+	if !ok || j.owner != apiKeyID(caller) {
+		sendTempestError(w, jobNotFoundError(id))
+		return
+	}
+
+	switch {
+	case action == "archive":
+		serveJobArchive(w, r, j)
+	case r.Method == http.MethodDelete:
+		if !j.cancelJob() {
+			sendJSONError(w, codeJobFinished, "Job already finished", fmt.Sprintf("Job %s is already %s", id, j.snapshot().State), http.StatusConflict)
+			return
+		}
+		logf("JOB %s: Cancelled by %s", id, r.RemoteAddr)
+		sendJSON(w, jobStatus(r, j), http.StatusOK)
+	default:
+		w.Header().Set("Cache-Control", "no-store")
+		sendJSON(w, jobStatus(r, j), http.StatusOK)
+	}
+}
+
+// serveJobArchive sends the archive of a completed job.
+func serveJobArchive(w http.ResponseWriter, r *http.Request, j *job) {
+	s := j.snapshot()
+	if s.State != jobCompleted {
+		sendJSONError(w, codeJobNotFinished, "Archive not ready", fmt.Sprintf("Job %s is %s; its archive is ready once it has completed", s.ID, s.State), http.StatusConflict)
+		return
+	}
+	f, err := os.Open(filepath.Join(j.dir, "archive.zip"))
+	if err != nil {
+		sendJSONError(w, codeInternal, "Archive missing", err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	logf("SUCCESS: Serving archive of job %s (%d bytes) to %s", s.ID, s.ArchiveSize, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tempest-images-%s.zip"`, s.ID[:8]))
+	http.ServeContent(w, r, "", *s.FinishedAt, f)
+}
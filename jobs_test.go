@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withJobStore points -jobs-dir at a temporary directory for one test and
+// opens a job store in it.
+func withJobStore(t *testing.T) *kvStore {
+	old := *jobsDir
+	*jobsDir = t.TempDir()
+	t.Cleanup(func() { *jobsDir = old })
+	return openTestStore(t, filepath.Join(*jobsDir, "jobs.db"))
+}
+
+func TestRestoreJobRetriesFailedItems(t *testing.T) {
+	db := withJobStore(t)
+	image := []byte("fetched before the restart")
+	dir := filepath.Join(*jobsDir, "j1")
+	os.MkdirAll(dir, 0o700)
+	if err := os.WriteFile(filepath.Join(dir, "00000.jpg"), image, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	done := jobItemRecord{
+		JobItem: JobItem{ID: "a", State: itemDone, ContentType: "image/jpeg", Size: int64(len(image)), SHA256: hex.EncodeToString(contentDigest(image))},
+		File:    "00000.jpg",
+	}
+	failed := jobItemRecord{JobItem: JobItem{ID: "b", State: itemFailed, Error: &ErrorResponse{Code: codeUpstreamTimeout}}}
+	db.Put("item/j1/0", done, false)
+	db.Put("item/j1/1", failed, false)
+
+	j, err := restoreJob(db, jobRecord{ID: "j1", State: jobRunning, IDs: []string{"a", "b", "c"}})
+	if err != nil {
+		t.Fatalf("restoreJob: %v", err)
+	}
+	s := j.snapshot()
+	if s.State != jobQueued || s.Done != 1 || s.Failed != 0 {
+		t.Errorf("restored job is %s with %d done, %d failed; want queued, 1, 0", s.State, s.Done, s.Failed)
+	}
+	for i, want := range []string{itemDone, itemPending, itemPending} {
+		if got := s.Items[i].State; got != want {
+			t.Errorf("item %d is %s, want %s", i, got, want)
+		}
+	}
+	if s.Items[1].Error != nil {
+		t.Error("the retried item kept its old error")
+	}
+}
+
+func TestRestoreJobNeedsItsWatermark(t *testing.T) {
+	db := withJobStore(t)
+	old := studioMark
+	studioMark = nil
+	t.Cleanup(func() { studioMark = old })
+
+	j, err := restoreJob(db, jobRecord{ID: "j2", State: jobQueued, Watermark: true, IDs: []string{"a"}})
+	if err != nil {
+		t.Fatalf("restoreJob: %v", err)
+	}
+	if s := j.snapshot(); s.State != jobFailed {
+		t.Errorf("job forced to watermark restored as %s without a watermark, want failed", s.State)
+	}
+}
+
+func TestWatermarkedImageWithoutWatermark(t *testing.T) {
+	fakeTempest(t, map[string][]byte{"abc": grayJPEG(t, 64)})
+	old := studioMark
+	studioMark = nil
+	t.Cleanup(func() { studioMark = old })
+
+	res := fetchJobImage(context.Background(), "abc", renderOptions{Watermark: true})
+	if te, ok := res.err.(*tempestError); !ok || te.Code != codeWatermarkUnavailable {
+		t.Fatalf("error = %v, want %s", res.err, codeWatermarkUnavailable)
+	}
+	if tile := fetchContactSheetTile(context.Background(), "abc", 32, true); tile.err == nil {
+		t.Error("contact sheet tile was drawn without its watermark")
+	}
+}
+
+// withJobQueue gives one test an empty job queue that nothing runs.
+func withJobQueue(t *testing.T) {
+	db := withJobStore(t)
+	old := jobs
+	jobs = &jobQueue{jobs: make(map[string]*job), pending: make(chan *job, maxQueuedJobs), db: db}
+	t.Cleanup(func() { jobs = old })
+}
+
+func TestJobsBelongToTheirAPIKey(t *testing.T) {
+	withJobQueue(t)
+	oldKeys := apiKeys
+	apiKeys = []apiKey{{Key: "owner-key-0123456789"}, {Key: "other-key-0123456789"}}
+	t.Cleanup(func() { apiKeys = oldKeys })
+
+	send := func(method, path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"ids":["a","b"]}`))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		if path == "/api/v1/jobs" {
+			handleJobs(rec, req)
+		} else {
+			handleJob(rec, req)
+		}
+		return rec
+	}
+
+	if rec := send(http.MethodPost, "/api/v1/jobs", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST without a key: status %d, want 401", rec.Code)
+	}
+	rec := send(http.MethodPost, "/api/v1/jobs", "owner-key-0123456789")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST: status %d: %s", rec.Code, rec.Body)
+	}
+	path := rec.Header().Get("Location")
+
+	tests := []struct {
+		method, path, key string
+		status            int
+	}{
+		{http.MethodGet, path, "", http.StatusUnauthorized},
+		{http.MethodGet, path, "other-key-0123456789", http.StatusNotFound},
+		{http.MethodGet, path + "/archive", "other-key-0123456789", http.StatusNotFound},
+		{http.MethodDelete, path, "other-key-0123456789", http.StatusNotFound},
+		{http.MethodGet, path, "owner-key-0123456789", http.StatusOK},
+		{http.MethodDelete, path, "owner-key-0123456789", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := send(tt.method, tt.path, tt.key); rec.Code != tt.status {
+			t.Errorf("%s %s with key %q: status %d, want %d", tt.method, tt.path, tt.key, rec.Code, tt.status)
+		}
+	}
+}
+
+// Cancelling a running job abandons the fetches in flight and keeps
+// nothing they return.
+func TestCancelStopsFetchesInFlight(t *testing.T) {
+	withJobQueue(t)
+	srv := fakeTempest(t, nil)
+	started, stopped := make(chan struct{}), make(chan struct{})
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(stopped)
+	})
+
+	j, err := newJob(jobs.db, "owner", []string{"a"}, nil, renderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan struct{})
+	go func() {
+		j.run()
+		close(ran)
+	}()
+	<-started
+	j.cancelJob()
+	for _, ch := range []chan struct{}{stopped, ran} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the fetch in flight wasn't abandoned")
+		}
+	}
+	if s := j.snapshot(); s.State != jobCancelled || s.Items[0].State != itemPending {
+		t.Errorf("job is %s with its image %s; want cancelled, pending", s.State, s.Items[0].State)
+	}
+	if _, err := os.Stat(j.dir); !os.IsNotExist(err) {
+		t.Errorf("the cancelled job's directory is still there: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"net/http"
+	"sync"
+)
+
+// budgetChunk is how much memory a growing buffer reserves at a time.
+const budgetChunk = 1 << 20
+
+// memoryBudget caps the memory held by in-flight image buffers across all
+// requests.
+type memoryBudget struct {
+	mu   sync.Mutex
+	used int64
+}
+
+var inflight memoryBudget
+
+func (b *memoryBudget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > *memoryBudgetBytes {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+// memoryBudgetError is the 503 sent when -memory-budget is used up.
+func memoryBudgetError() *tempestError {
+	return &tempestError{codeMemoryBudget, "Server busy", "Too many large images are being processed right now. Please try again shortly.", http.StatusServiceUnavailable}
+}
+
+func upstreamTooLargeError(photoId string, size int64) *tempestError {
+	logf("TOO LARGE: Image %s from Tempest exceeds %d bytes (%d)", photoId, *maxUpstreamBytes, size)
+	return &tempestError{codeUpstreamTooLarge, "Image too large", fmt.Sprintf("The image is larger than the %d byte limit", *maxUpstreamBytes), http.StatusBadGateway}
+}
+
+// imageBuffer accumulates an upstream body up to -max-upstream-bytes,
+// reserving memory from the global budget as it grows. Release must be
+// called once the bytes are no longer in flight.
+type imageBuffer struct {
+	photoId  string
+	buf      bytes.Buffer
+	reserved int64
+}
+
+func (b *imageBuffer) Write(p []byte) (int, error) {
+	need := int64(b.buf.Len() + len(p))
+	if need > *maxUpstreamBytes {
+		return 0, upstreamTooLargeError(b.photoId, need)
+	}
+	if need > b.reserved {
+		grow := need - b.reserved
+		if grow < budgetChunk {
+			grow = budgetChunk
+		}
+		if !inflight.reserve(grow) {
+			logf("BUSY: Memory budget exhausted while reading image %s", b.photoId)
+			return 0, memoryBudgetError()
+		}
+		b.reserved += grow
+	}
+	return b.buf.Write(p)
+}
+
+func (b *imageBuffer) Bytes() []byte { return b.buf.Bytes() }
+
+func (b *imageBuffer) Len() int { return b.buf.Len() }
+
+func (b *imageBuffer) Release() {
+	inflight.release(b.reserved)
+	b.reserved = 0
+}
+
+// checkPixelLimit rejects images whose dimensions exceed -max-image-pixels
+// before anything decodes them.
+func checkPixelLimit(photoId string, data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil // let the decoder report it
+	}
+	if pixels := int64(cfg.Width) * int64(cfg.Height); pixels > *maxImagePixels {
+		logf("TOO LARGE: Image %s is %dx%d, over the %d pixel limit", photoId, cfg.Width, cfg.Height, *maxImagePixels)
+		return &tempestError{codeImageTooLarge, "Image too large to process", fmt.Sprintf("The image is %dx%d pixels; at most %d pixels can be processed", cfg.Width, cfg.Height, *maxImagePixels), http.StatusRequestEntityTooLarge}
+	}
+	return nil
+}
+
+// decodeImage decodes data after checking it against the pixel limit.
+// Every decode of a full image goes through here.
+func decodeImage(photoId string, data []byte) (image.Image, string, error) {
+	if err := checkPixelLimit(photoId, data); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(bytes.NewReader(data))
+}
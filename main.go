@@ -1,13 +1,16 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -53,7 +56,7 @@ const htmlTemplate = `
             border-radius: 24px;
             padding: 48px;
             box-shadow: 0 32px 64px rgba(0, 0, 0, 0.4);
-            max-width: 580px;
+            max-width: 880px;
             width: 100%;
             text-align: center;
             position: relative;
@@ -137,7 +140,7 @@ const htmlTemplate = `
         .input-container {
             position: relative;
         }
-        input {
+        input, textarea {
             width: 100%;
             padding: 18px 24px;
             border: 2px solid #374151;
@@ -149,14 +152,19 @@ const htmlTemplate = `
             font-family: 'JetBrains Mono', 'Courier New', monospace;
             font-weight: 500;
         }
-        input:focus {
+        textarea {
+            min-height: 120px;
+            resize: vertical;
+            line-height: 1.5;
+        }
+        input:focus, textarea:focus {
             outline: none;
             border-color: #3b82f6;
             box-shadow: 0 0 0 4px rgba(59, 130, 246, 0.2);
             transform: translateY(-2px);
             background: rgba(30, 41, 59, 1);
         }
-        input::placeholder {
+        input::placeholder, textarea::placeholder {
             color: #6b7280;
             font-weight: 400;
         }
@@ -200,14 +208,44 @@ const htmlTemplate = `
             cursor: not-allowed;
             transform: none;
         }
-        .image-container {
+        .form-hint {
+            margin-top: 8px;
+            color: #6b7280;
+            font-size: 0.8rem;
+        }
+        .actions {
+            display: flex;
+            gap: 12px;
+            justify-content: center;
+            flex-wrap: wrap;
+        }
+        button.secondary {
+            background: rgba(71, 85, 105, 0.6);
+            display: none;
+        }
+        .gallery {
             margin-top: 40px;
+            display: none;
+            grid-template-columns: repeat(auto-fill, minmax(200px, 1fr));
+            gap: 16px;
+        }
+        .gallery.single {
+            grid-template-columns: 1fr;
+        }
+        .image-container {
             border-radius: 20px;
             overflow: hidden;
             box-shadow: 0 25px 50px rgba(0, 0, 0, 0.5);
-            display: none;
             border: 3px solid rgba(71, 85, 105, 0.5);
             position: relative;
+            min-height: 160px;
+            display: flex;
+            flex-direction: column;
+            justify-content: center;
+            background: rgba(30, 41, 59, 0.6);
+        }
+        .image-container.failed {
+            border-color: rgba(248, 113, 113, 0.3);
         }
         .image-container::before {
             content: '';
@@ -223,15 +261,70 @@ const htmlTemplate = `
         .image-container img {
             width: 100%;
             height: auto;
-            display: block;
+            display: none;
             transition: transform 0.3s ease;
             max-width: 100%;
             height: auto;
             border-radius: 16px;
         }
+        .image-container.loaded img {
+            display: block;
+        }
         .image-container:hover img {
             transform: scale(1.02);
         }
+        .tile-id {
+            padding: 8px 12px;
+            color: #94a3b8;
+            font-family: 'JetBrains Mono', 'Courier New', monospace;
+            font-size: 0.75rem;
+            word-break: break-all;
+        }
+        .tile-loading {
+            display: flex;
+            justify-content: center;
+            padding: 24px;
+        }
+        .tile-loading .loading-spinner {
+            width: 32px;
+            height: 32px;
+        }
+        .image-container.loaded .tile-loading,
+        .image-container.failed .tile-loading {
+            display: none;
+        }
+        .tile-placeholder {
+            display: none;
+            width: 100%;
+            background-size: cover;
+            background-position: center;
+            filter: blur(12px);
+            transform: scale(1.1);
+        }
+        .image-container.previewing .tile-placeholder {
+            display: block;
+        }
+        .image-container.previewing .tile-loading {
+            position: absolute;
+            top: 50%;
+            left: 50%;
+            transform: translate(-50%, -50%);
+            z-index: 2;
+        }
+        .image-container.loaded .tile-placeholder,
+        .image-container.failed .tile-placeholder {
+            display: none;
+        }
+        .tile-error {
+            display: none;
+            color: #f87171;
+            padding: 16px;
+            font-size: 0.85rem;
+            font-weight: 500;
+        }
+        .image-container.failed .tile-error {
+            display: block;
+        }
         .image-download-hint {
             margin-top: 16px;
             color: #94a3b8;
@@ -326,6 +419,9 @@ const htmlTemplate = `
             .image-download-hint {
                 font-size: 0.8rem;
             }
+            .gallery {
+                grid-template-columns: repeat(auto-fill, minmax(140px, 1fr));
+            }
         }
     </style>
 </head>
@@ -347,28 +443,33 @@ const htmlTemplate = `
 
         <form id="photoForm" novalidate>
             <div class="form-group">
-                <label for="photoId">Image ID</label>
+                <label for="photoId">Image IDs</label>
                 <div class="input-container">
-                    <input
-                        type="text"
+                    <textarea
                         id="photoId"
                         name="photoId"
-                        value=""
                         placeholder="Enter your image ID..."
                         autocomplete="off"
+                        spellcheck="false"
                         required
-                    >
+                    ></textarea>
                 </div>
+                <div class="form-hint">Separate several IDs with commas, spaces or new lines.</div>
             </div>
 
-            <button type="submit" id="submitBtn">
-                <span class="btn-text">Get Image</span>
-            </button>
+            <div class="actions">
+                <button type="submit" id="submitBtn">
+                    <span class="btn-text">Get Images</span>
+                </button>
+                <button type="button" class="secondary" id="downloadAllBtn">
+                    <span class="btn-text">Download All</span>
+                </button>
+            </div>
         </form>
 
         <div class="loading" id="loading">
             <div class="loading-spinner"></div>
-            <div class="loading-text">Finding your image...</div>
+            <div class="loading-text" id="loadingText">Finding your image...</div>
             <div class="loading-dots">
                 <div class="loading-dot"></div>
                 <div class="loading-dot"></div>
@@ -379,113 +480,316 @@ const htmlTemplate = `
         <div class="error" id="error"></div>
         <div class="status-info" id="statusInfo"></div>
 
-        <div class="image-container" id="imageContainer" aria-live="polite">
-            <img id="photo" src="" alt="Retrieved Image">
-            <div class="image-download-hint">
-                📱 On mobile: Long press the image to save to your camera roll
-            </div>
+        <div class="gallery" id="gallery" aria-live="polite"></div>
+        <div class="image-download-hint" id="downloadHint" style="display: none;">
+            📱 On mobile: Long press an image to save it to your camera roll
         </div>
     </div>
 
     <script>
         const photoIdInput = document.getElementById('photoId');
         const form = document.getElementById('photoForm');
+        const loading = document.getElementById('loading');
+        const loadingText = document.getElementById('loadingText');
+        const error = document.getElementById('error');
+        const statusInfo = document.getElementById('statusInfo');
+        const gallery = document.getElementById('gallery');
+        const downloadHint = document.getElementById('downloadHint');
+        const submitBtn = document.getElementById('submitBtn');
+        const downloadAllBtn = document.getElementById('downloadAllBtn');
+
+        const maxParallelFetches = 4;
+        const maxPreviewWidth = 2048;
+        let objectUrls = [];
+        let currentIds = [];
+
+        function parsePhotoIds(text) {
+            const seen = new Set();
+            return text.split(/[\s,]+/).filter(id => {
+                if (!id || seen.has(id)) {
+                    return false;
+                }
+                seen.add(id);
+                return true;
+            });
+        }
+
+        async function describeError(response, photoId) {
+            const contentType = response.headers.get('content-type');
+            let errorMessage = ` + "`" + `Failed to fetch image (${response.status})` + "`" + `;
+
+            if (contentType && contentType.includes('application/json')) {
+                const errorData = await response.json();
+                errorMessage = errorData.error || errorMessage;
+
+                if (response.status === 404) {
+                    errorMessage = ` + "`" + `🔍 Image '${photoId}' not found. Double-check your ID!` + "`" + `;
+                } else if (response.status === 403) {
+                    errorMessage = ` + "`" + `🔒 Access denied for image '${photoId}'. You might not have permission.` + "`" + `;
+                } else if (response.status === 500) {
+                    errorMessage = ` + "`" + `⚠️ ${errorData.details || 'Server error occurred while fetching the image'}` + "`" + `;
+                } else if (response.status === 502) {
+                    errorMessage = ` + "`" + `🖼️ Tempest sent something that isn't a valid image for '${photoId}'.` + "`" + `;
+                } else if (response.status === 408) {
+                    errorMessage = ` + "`" + `⏱️ Request timed out. The image may be too large or the server is busy.` + "`" + `;
+                }
+            }
+
+            return errorMessage;
+        }
+
+        function createTile(photoId) {
+            const tile = document.createElement('div');
+            tile.className = 'image-container';
+
+            const spinner = document.createElement('div');
+            spinner.className = 'tile-loading';
+            spinner.innerHTML = '<div class="loading-spinner"></div>';
+
+            const placeholder = document.createElement('div');
+            placeholder.className = 'tile-placeholder';
+
+            const img = document.createElement('img');
+            img.alt = ` + "`" + `Image ${photoId}` + "`" + `;
+
+            const tileError = document.createElement('div');
+            tileError.className = 'tile-error';
+
+            const caption = document.createElement('div');
+            caption.className = 'tile-id';
+            caption.textContent = photoId;
+
+            tile.append(spinner, placeholder, img, tileError, caption);
+            gallery.appendChild(tile);
+            return tile;
+        }
+
+        // showPlaceholder shows a blurred thumbnail in the tile while the image
+        // loads. Errors that the image itself would hit too are thrown.
+        async function showPlaceholder(tile, photoId) {
+            let response;
+            try {
+                response = await fetch(` + "`" + `/api/v1/images/${encodeURIComponent(photoId)}/placeholder` + "`" + `);
+            } catch (err) {
+                return;
+            }
+            if (!response.ok) {
+                if ([401, 403, 404].includes(response.status)) {
+                    throw new Error(await describeError(response, photoId));
+                }
+                return;
+            }
+
+            const placeholder = await response.json();
+            const element = tile.querySelector('.tile-placeholder');
+            element.style.backgroundImage = ` + "`" + `url("${placeholder.data_uri}")` + "`" + `;
+            element.style.aspectRatio = ` + "`" + `${placeholder.width} / ${placeholder.height}` + "`" + `;
+            tile.classList.add('previewing');
+        }
+
+        async function loadTile(tile, photoId) {
+            const img = tile.querySelector('img');
+            const tileError = tile.querySelector('.tile-error');
+
+            try {
+                await showPlaceholder(tile, photoId);
+
+                // Ask for a preview sized for the tile rather than the original.
+                const width = Math.min(maxPreviewWidth, Math.round((tile.clientWidth || 400) * (window.devicePixelRatio || 1)));
+                const response = await fetch(` + "`" + `/fetch-photo?id=${encodeURIComponent(photoId)}&w=${width}` + "`" + `);
+                if (!response.ok) {
+                    throw new Error(await describeError(response, photoId));
+                }
+
+                const blob = await response.blob();
+                const imageUrl = URL.createObjectURL(blob);
+                objectUrls.push(imageUrl);
+
+                await new Promise((resolve, reject) => {
+                    img.onload = resolve;
+                    img.onerror = () => reject(new Error('❌ Failed to load the image. Please try again.'));
+                    img.src = imageUrl;
+                });
+
+                tile.classList.add('loaded');
+                return true;
+            } catch (err) {
+                tileError.textContent = err.message;
+                tile.classList.add('failed');
+                return false;
+            }
+        }
+
+        function resetGallery() {
+            for (const url of objectUrls) {
+                try {
+                    URL.revokeObjectURL(url);
+                } catch (err) {
+                }
+            }
+            objectUrls = [];
+            gallery.innerHTML = '';
+            gallery.style.display = 'none';
+            downloadHint.style.display = 'none';
+        }
 
         form.addEventListener('submit', async function(e) {
             e.preventDefault();
 
-            const photoId = photoIdInput.value.trim();
-            const loading = document.getElementById('loading');
-            const error = document.getElementById('error');
-            const statusInfo = document.getElementById('statusInfo');
-            const imageContainer = document.getElementById('imageContainer');
-            const photo = document.getElementById('photo');
-            const submitBtn = document.getElementById('submitBtn');
+            const photoIds = parsePhotoIds(photoIdInput.value);
 
-            if (!photoId) {
+            if (photoIds.length === 0) {
                 error.textContent = '🤔 Please enter an image ID first!';
                 error.style.display = 'block';
                 return;
             }
 
+            resetGallery();
+            currentIds = photoIds;
+            loadingText.textContent = photoIds.length === 1 ? 'Finding your image...' : ` + "`" + `Finding your ${photoIds.length} images...` + "`" + `;
             loading.style.display = 'flex';
             error.style.display = 'none';
             statusInfo.style.display = 'none';
-            imageContainer.style.display = 'none';
             submitBtn.disabled = true;
+            downloadAllBtn.style.display = 'none';
 
-            if (photo.src) {
-                try {
-                    URL.revokeObjectURL(photo.src);
-                } catch (err) {
-                }
-            }
+            gallery.classList.toggle('single', photoIds.length === 1);
+            gallery.style.display = 'grid';
+            const tiles = photoIds.map(createTile);
 
             const startTime = Date.now();
-
-            try {
-                const response = await fetch(` + "`" + `/fetch-photo?id=${encodeURIComponent(photoId)}` + "`" + `);
-
-                const contentType = response.headers.get('content-type');
-
-                if (!response.ok) {
-                    let errorMessage = ` + "`" + `Failed to fetch image (${response.status})` + "`" + `;
-
-                    if (contentType && contentType.includes('application/json')) {
-                        const errorData = await response.json();
-                        errorMessage = errorData.error || errorMessage;
-
-                        if (response.status === 404) {
-                            errorMessage = ` + "`" + `🔍 Image '${photoId}' not found. Double-check your ID!` + "`" + `;
-                        } else if (response.status === 403) {
-                            errorMessage = ` + "`" + `🔒 Access denied for image '${photoId}'. You might not have permission.` + "`" + `;
-                        } else if (response.status === 500) {
-                            errorMessage = ` + "`" + `⚠️ ${errorData.details || 'Server error occurred while fetching the image'}` + "`" + `;
-                        } else if (response.status === 408) {
-                            errorMessage = ` + "`" + `⏱️ Request timed out. The image may be too large or the server is busy.` + "`" + `;
-                        }
+            let next = 0;
+            let loaded = 0;
+
+            async function worker() {
+                while (next < photoIds.length) {
+                    const i = next++;
+                    if (await loadTile(tiles[i], photoIds[i])) {
+                        loaded++;
                     }
+                }
+            }
 
-                    throw new Error(errorMessage);
+            const workers = [];
+            for (let i = 0; i < Math.min(maxParallelFetches, photoIds.length); i++) {
+                workers.push(worker());
+            }
+            await Promise.all(workers);
+
+            const loadTime = ((Date.now() - startTime) / 1000).toFixed(2);
+            loading.style.display = 'none';
+            submitBtn.disabled = false;
+
+            if (loaded === 0) {
+                if (photoIds.length === 1) {
+                    error.textContent = tiles[0].querySelector('.tile-error').textContent;
+                    gallery.style.display = 'none';
+                } else {
+                    error.textContent = '❌ None of the images could be loaded.';
                 }
+                error.style.display = 'block';
+                return;
+            }
 
-                const blob = await response.blob();
-                const imageUrl = URL.createObjectURL(blob);
-                const loadTime = ((Date.now() - startTime) / 1000).toFixed(2);
+            statusInfo.textContent = photoIds.length === 1
+                ? ` + "`" + `✅ Image loaded successfully in ${loadTime}s` + "`" + `
+                : ` + "`" + `✅ Loaded ${loaded} of ${photoIds.length} images in ${loadTime}s` + "`" + `;
+            statusInfo.style.display = 'block';
+            downloadHint.style.display = 'block';
+            if (photoIds.length > 1) {
+                downloadAllBtn.style.display = 'inline-block';
+            }
 
-                photo.onload = function() {
-                    loading.style.display = 'none';
-                    statusInfo.textContent = ` + "`" + `✅ Image loaded successfully in ${loadTime}s` + "`" + `;
-                    statusInfo.style.display = 'block';
-                    imageContainer.style.display = 'block';
-                    submitBtn.disabled = false;
+            setTimeout(() => {
+                statusInfo.style.display = 'none';
+            }, 4000);
+        });
+
+        // Archives are built by a background job so a long download
+        // survives reloading the page; the job's ID is kept until it ends.
+        const jobStorageKey = 'tempestDownloadJob';
 
-                    setTimeout(() => {
+        function saveArchive(url) {
+            const link = document.createElement('a');
+            link.href = url;
+            link.download = '';
+            document.body.appendChild(link);
+            link.click();
+            link.remove();
+        }
+
+        async function followJob(jobId) {
+            downloadAllBtn.disabled = true;
+            downloadAllBtn.style.display = 'inline-block';
+            statusInfo.style.display = 'block';
+            try {
+                while (true) {
+                    const response = await fetch('/api/v1/jobs/' + encodeURIComponent(jobId));
+                    if (response.status === 404) {
+                        // Removed after -job-retention.
                         statusInfo.style.display = 'none';
-                    }, 4000);
-                };
-
-                photo.onerror = function() {
-                    loading.style.display = 'none';
-                    error.textContent = '❌ Failed to load the image. Please try again.';
-                    error.style.display = 'block';
-                    submitBtn.disabled = false;
-                    try {
-                        URL.revokeObjectURL(imageUrl);
-                    } catch (err) {
+                        return;
                     }
-                };
+                    if (!response.ok) {
+                        throw new Error(await describeError(response, jobId));
+                    }
+                    const job = await response.json();
+                    if (job.state === 'completed') {
+                        statusInfo.textContent = job.failed > 0
+                            ? '📦 Archive ready with ' + job.done + ' of ' + job.total + ' images'
+                            : '📦 Archive ready with all ' + job.total + ' images';
+                        saveArchive(job.archive_url);
+                        return;
+                    }
+                    if (job.state === 'failed' || job.state === 'cancelled') {
+                        throw new Error(job.state === 'failed' ? '❌ None of the images could be downloaded.' : 'The download was cancelled.');
+                    }
+                    statusInfo.textContent = job.state === 'queued'
+                        ? '⏳ Waiting for other downloads to finish...'
+                        : '📦 Preparing archive: ' + (job.done + job.failed) + ' of ' + job.total + ' images';
+                    await new Promise(resolve => setTimeout(resolve, 1000));
+                }
+            } catch (err) {
+                statusInfo.style.display = 'none';
+                error.textContent = err.message;
+                error.style.display = 'block';
+            } finally {
+                localStorage.removeItem(jobStorageKey);
+                downloadAllBtn.disabled = false;
+            }
+        }
 
-                photo.src = imageUrl;
+        downloadAllBtn.addEventListener('click', async function() {
+            if (currentIds.length === 0) {
+                return;
+            }
+
+            downloadAllBtn.disabled = true;
+            error.style.display = 'none';
 
+            try {
+                const response = await fetch('/api/v1/jobs', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({ids: currentIds})
+                });
+                if (!response.ok) {
+                    throw new Error(await describeError(response, currentIds.join(', ')));
+                }
+                const job = await response.json();
+                localStorage.setItem(jobStorageKey, job.id);
+                await followJob(job.id);
             } catch (err) {
-                loading.style.display = 'none';
                 error.textContent = err.message;
                 error.style.display = 'block';
-                statusInfo.style.display = 'none';
-                submitBtn.disabled = false;
+                downloadAllBtn.disabled = false;
             }
         });
+
+        const pendingJob = localStorage.getItem(jobStorageKey);
+        if (pendingJob) {
+            followJob(pendingJob);
+        }
     </script>
 </body>
 </html>
@@ -493,16 +797,59 @@ const htmlTemplate = `
 
 type ErrorResponse struct {
 	Error   string `json:"error"`
+	Code    string `json:"code"`
 	Details string `json:"details,omitempty"`
 	Status  int    `json:"status"`
 }
 
-func sendJSONError(w http.ResponseWriter, message string, details string, statusCode int) {
+// Machine-readable ErrorResponse codes. These are part of the API contract:
+// add new ones freely, but never rename or reuse an existing code.
+const (
+	codeMissingID             = "missing_id"
+	codeTooManyIDs            = "too_many_ids"
+	codeMethodNotAllowed      = "method_not_allowed"
+	codeUnknownEndpoint       = "unknown_endpoint"
+	codeImageNotFound         = "image_not_found"
+	codeAccessDenied          = "access_denied"
+	codeAuthRequired          = "authentication_required"
+	codeUpstreamTimeout       = "upstream_timeout"
+	codeUpstreamConnection    = "upstream_connection_failed"
+	codeUpstreamError         = "upstream_error"
+	codeUpstreamUnavailable   = "upstream_unavailable"
+	codeUpstreamUnexpected    = "upstream_unexpected_status"
+	codeUpstreamInvalidImage  = "upstream_invalid_image"
+	codeUpstreamTooLarge      = "upstream_too_large"
+	codeImageTooLarge         = "image_too_large"
+	codeMemoryBudget          = "memory_budget_exhausted"
+	codeInvalidParameter      = "invalid_parameter"
+	codeUnsupportedImage      = "unsupported_image"
+	codeInternal              = "internal_error"
+	codeAPIKeyRequired        = "api_key_required"
+	codeInvalidAPIKey         = "invalid_api_key"
+	codeShareLinkInvalid      = "share_link_invalid"
+	codeShareLinkExpired      = "share_link_expired"
+	codeShareLinkUsedUp       = "share_link_used_up"
+	codeJobNotFound           = "job_not_found"
+	codeJobQueueFull          = "job_queue_full"
+	codeJobNotFinished        = "job_not_finished"
+	codeJobFinished           = "job_finished"
+	codeCircuitOpen           = "upstream_circuit_open"
+	codeWebhooksNotConfigured = "webhooks_not_configured"
+	codeWatermarkUnavailable  = "watermark_unavailable"
+)
+
+// logf writes one line to the server log, prefixed with the time of day.
+func logf(format string, args ...interface{}) {
+	fmt.Printf("[%s] "+format+"\n", append([]interface{}{time.Now().Format("15:04:05")}, args...)...)
+}
+
+func sendJSONError(w http.ResponseWriter, code string, message string, details string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
 	errorResp := ErrorResponse{
 		Error:   message,
+		Code:    code,
 		Details: details,
 		Status:  statusCode,
 	}
@@ -510,93 +857,153 @@ func sendJSONError(w http.ResponseWriter, message string, details string, status
 	json.NewEncoder(w).Encode(errorResp)
 }
 
-func main() {
-	tmpl := template.Must(template.New("index").Parse(htmlTemplate))
+var indexTemplate = template.Must(template.New("index").Parse(htmlTemplate))
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("[%s] GET / - Client: %s\n", time.Now().Format("15:04:05"), r.RemoteAddr)
-		tmpl.Execute(w, nil)
-	})
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	logf("%s / - Client: %s", r.Method, r.RemoteAddr)
 
-	http.HandleFunc("/fetch-photo", func(w http.ResponseWriter, r *http.Request) {
-		photoId := r.URL.Query().Get("id")
-		clientIP := r.RemoteAddr
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	indexTemplate.Execute(w, nil)
+}
 
-		fmt.Printf("[%s] POST /fetch-photo - Client: %s - ID: %s\n", time.Now().Format("15:04:05"), clientIP, photoId)
+// routes lists every handler the server registers. Patterns ending in a
+// slash are routed further by their handler. TestOpenAPIMatchesRoutes
+// compares this table against the published specification.
+var routes = []struct {
+	pattern string
+	handler http.HandlerFunc
+}{
+	{"/", handleIndex},
+	{"/fetch-photo", handleFetchPhoto},
+	{"/fetch-photos", handleFetchPhotos},
+	{"/api/v1/images/", handleImagesAPI},
+	{"/api/v1/contact-sheet", handleContactSheet},
+	{"/iiif/", handleIIIF},
+	{"/api/v1/share-links", handleShareLinks},
+	{"/s/", handleShared},
+	{"/api/v1/jobs", handleJobs},
+	{"/api/v1/jobs/", handleJob},
+	{"/api/v1/webhooks/", handleWebhooks},
+	{"/openapi.json", handleOpenAPI},
+	{"/docs", handleDocs},
+}
 
-		if photoId == "" {
-			fmt.Printf("[%s] ERROR: Missing photo ID from %s\n", time.Now().Format("15:04:05"), clientIP)
-			sendJSONError(w, "Image ID required", "Please provide a valid image identifier", http.StatusBadRequest)
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "webhook-receiver":
+			runWebhookReceiver(os.Args[2:])
 			return
+		case "download":
+			os.Exit(runDownload(os.Args[2:]))
 		}
+	}
+	flag.Parse()
 
-		apiURL := fmt.Sprintf("https://us-central1-htempest-preproduction-prod.cloudfunctions.net/ImageApiProxy/image/%s/preview/?exifrotate=1&MaxSize=9999&ProofWatermark=FALSE&source=G&WithCrop=TRUE", photoId)
+	removal, err := parseMetadataRemoval(*sanitizeMetadata, *stripSensitiveMetadata)
+	if err != nil {
+		log.Fatalf("-sanitize-metadata: %v", err)
+	}
+	metadataToRemove = removal
+	if removal.enabled() {
+		logf("Removing metadata from served images: %s", removal)
+	}
 
-		fmt.Printf("[%s] Requesting Tempest API for ID: %s\n", time.Now().Format("15:04:05"), photoId)
+	ladder, err := parseWidthLadder(*srcsetWidths)
+	if err != nil {
+		log.Fatalf("-srcset-widths: %v", err)
+	}
+	srcsetLadder = ladder
 
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
+	if *publicURL != "" {
+		u, err := url.Parse(*publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			log.Fatalf("-public-url: %q is not an http or https URL", *publicURL)
+		}
+		*publicURL = strings.TrimSuffix(*publicURL, "/")
+	} else {
+		logf("No -public-url given; links are built from the Host header of each request")
+	}
+
+	mark, err := loadWatermark(*watermarkLogo, *watermarkText, *watermarkPosition, *watermarkOpacity, *watermarkScale)
+	if err != nil {
+		log.Fatalf("Watermark: %v", err)
+	}
+	studioMark = mark
+	if mark != nil {
+		logf("Watermark: %s", mark)
+	}
 
-		req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if *apiKeysFile != "" {
+		keys, err := loadAPIKeys(*apiKeysFile)
 		if err != nil {
-			fmt.Printf("[%s] ERROR: Failed to create request for ID %s: %v\n", time.Now().Format("15:04:05"), photoId, err)
-			sendJSONError(w, "Request creation failed", fmt.Sprintf("Unable to create API request: %v", err), http.StatusInternalServerError)
-			return
+			log.Fatalf("-api-keys-file: %v", err)
+		}
+		for _, key := range keys {
+			if key.Watermark && studioMark == nil {
+				log.Fatalf("-api-keys-file: a key asks for a watermark, but neither -watermark-logo nor -watermark-text is set")
+			}
 		}
+		apiKeys = keys
+	}
+	if err := shareKeys.configure(*shareKeysFile); err != nil {
+		log.Fatalf("-share-keys-file: %v", err)
+	}
+	if *shareKeysFile == "" {
+		logf("No -share-keys-file given; share links will stop working when the server restarts")
+	}
+	if *jobWorkers < 1 {
+		log.Fatalf("-job-workers must be at least 1")
+	}
+	if err := os.MkdirAll(*jobsDir, 0o700); err != nil {
+		log.Fatalf("-jobs-dir: %v", err)
+	}
+	db, err := openKVStore(filepath.Join(*jobsDir, "jobs.db"))
+	if err != nil {
+		log.Fatalf("-jobs-dir: %v", err)
+	}
+	jobs.db = db
+	shareDB, err := openKVStore(filepath.Join(*jobsDir, "shares.db"))
+	if err != nil {
+		log.Fatalf("-jobs-dir: %v", err)
+	}
+	if err := sharedViews.open(shareDB); err != nil {
+		log.Fatalf("-jobs-dir: %v", err)
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+	if *webhooksFile != "" {
+		hooks, err := loadWebhooks(*webhooksFile)
 		if err != nil {
-			if ctx.Err() == context.DeadlineExceeded {
-				fmt.Printf("[%s] TIMEOUT: Tempest API request timed out for ID %s after 20s\n", time.Now().Format("15:04:05"), photoId)
-				sendJSONError(w, "Request timeout", "The image request took too long to process (>20s). The image may be very large.", http.StatusRequestTimeout)
-				return
-			}
-			fmt.Printf("[%s] ERROR: Tempest API connection failed for ID %s: %v\n", time.Now().Format("15:04:05"), photoId, err)
-			sendJSONError(w, "Connection failed", fmt.Sprintf("Unable to connect to Tempest API: %v", err), http.StatusInternalServerError)
-			return
+			log.Fatalf("-webhooks-file: %v", err)
 		}
-		defer resp.Body.Close()
+		webhooks = hooks
+		logf("Sending events to %d webhooks", len(hooks))
+	}
+	logPath := *webhookLogFile
+	if logPath == "" {
+		logPath = filepath.Join(*jobsDir, "webhooks.db")
+	}
+	if webhookLog, err = openKVStore(logPath); err != nil {
+		log.Fatalf("-webhook-log: %v", err)
+	}
+	if err := resumeWebhookDeliveries(); err != nil {
+		log.Fatalf("-webhook-log: %v", err)
+	}
+	go pruneWebhookLogEvery(time.Hour)
 
-		fmt.Printf("[%s] Tempest API response for ID %s: %d %s\n", time.Now().Format("15:04:05"), photoId, resp.StatusCode, resp.Status)
+	if err := jobs.restore(); err != nil {
+		log.Fatalf("-jobs-dir: %v", err)
+	}
+	go jobs.run()
+	go jobs.expireEvery(time.Hour)
 
-		if resp.StatusCode == 204 {
-			fmt.Printf("[%s] NOT FOUND: Image ID %s not found in Tempest\n", time.Now().Format("15:04:05"), photoId)
-			sendJSONError(w, "Image not found", fmt.Sprintf("The image ID '%s' was not found in the Tempest system", photoId), http.StatusNotFound)
-			return
-		}
-		switch resp.StatusCode {
-		case http.StatusOK:
-			contentLength := resp.Header.Get("Content-Length")
-			fmt.Printf("[%s] SUCCESS: Serving image %s (Content-Length: %s) to %s\n", time.Now().Format("15:04:05"), photoId, contentLength, clientIP)
-			w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-			w.Header().Set("Cache-Control", "public, max-age=3600")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Headers", "*")
-			io.Copy(w, resp.Body)
-
-		case http.StatusForbidden:
-			fmt.Printf("[%s] FORBIDDEN: Access denied for image ID %s\n", time.Now().Format("15:04:05"), photoId)
-			sendJSONError(w, "Access denied", fmt.Sprintf("You don't have permission to access image '%s'", photoId), http.StatusForbidden)
-
-		case http.StatusUnauthorized:
-			fmt.Printf("[%s] UNAUTHORIZED: Authentication required for image ID %s\n", time.Now().Format("15:04:05"), photoId)
-			sendJSONError(w, "Authentication required", "The request requires valid authentication credentials", http.StatusUnauthorized)
-
-		case http.StatusInternalServerError:
-			fmt.Printf("[%s] SERVER ERROR: Tempest API internal error for image ID %s\n", time.Now().Format("15:04:05"), photoId)
-			sendJSONError(w, "Tempest API error", "The upstream image service is currently experiencing issues", http.StatusInternalServerError)
-
-		case http.StatusServiceUnavailable:
-			fmt.Printf("[%s] UNAVAILABLE: Tempest API service unavailable for image ID %s\n", time.Now().Format("15:04:05"), photoId)
-			sendJSONError(w, "Service unavailable", "The Tempest API is temporarily unavailable. Please try again later.", http.StatusServiceUnavailable)
-
-		default:
-			fmt.Printf("[%s] UNEXPECTED: Tempest API returned %d for image ID %s\n", time.Now().Format("15:04:05"), resp.StatusCode, photoId)
-			sendJSONError(w, "Unexpected error", fmt.Sprintf("Tempest API returned status %d", resp.StatusCode), resp.StatusCode)
-		}
-	})
+	for _, rt := range routes {
+		http.HandleFunc(rt.pattern, rt.handler)
+	}
 
-	fmt.Printf("[%s] 🚀 Image Finder starting on http://localhost:8080\n", time.Now().Format("15:04:05"))
+	logf("🚀 Image Finder starting on http://localhost:8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+	"time"
+)
+
+// describeMetadata reads the EXIF and XMP of an image into an ImageEXIF.
+// EXIF wins where both have a field. Whatever hide says is removed from
+// served images is left out: the GPS position, the XMP properties holding
+// the same, and all of the EXIF or XMP when the whole segment goes.
+func describeMetadata(data []byte, hide metadataRemoval) ImageEXIF {
+	info := ImageEXIF{Orientation: 1, Found: []string{}}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+
+	if x, ok := readEXIF(data); ok && !hide["exif"] {
+		info.Found = append(info.Found, "exif")
+		if v, ok := x.uint(x.ifd0, tagOrientation); ok && v >= 1 && v <= 8 {
+			info.Orientation = int(v)
+		}
+		info.Make = x.string(x.ifd0, tagMake)
+		info.Model = x.string(x.ifd0, tagModel)
+		info.Software = x.string(x.ifd0, tagSoftware)
+		info.Artist = x.string(x.ifd0, tagArtist)
+		info.Copyright = x.string(x.ifd0, tagCopyright)
+		info.Description = x.string(x.ifd0, tagImageDescription)
+		info.LensModel = x.string(x.exif, tagLensModel)
+
+		info.CaptureDate = exifDate(x.string(x.exif, tagDateTimeOriginal), x.string(x.exif, tagOffsetTimeOrig))
+		if info.CaptureDate == "" {
+			info.CaptureDate = exifDate(x.string(x.exif, tagDateTimeDigitized), "")
+		}
+		if info.CaptureDate == "" {
+			info.CaptureDate = exifDate(x.string(x.ifd0, tagDateTime), "")
+		}
+
+		if v := x.rationals(x.exif, tagExposureTime); len(v) > 0 && v[0] > 0 {
+			if v[0] < 1 {
+				info.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(1/v[0])))
+			} else {
+				info.ExposureTime = fmt.Sprintf("%g", v[0])
+			}
+		}
+		if v := x.rationals(x.exif, tagFNumber); len(v) > 0 {
+			info.FNumber = math.Round(v[0]*10) / 10
+		}
+		if v := x.rationals(x.exif, tagFocalLength); len(v) > 0 {
+			info.FocalLength = math.Round(v[0]*10) / 10
+		}
+		if v, ok := x.uint(x.exif, tagISO); ok {
+			info.ISO = int(v)
+		}
+		if !hide["gps"] {
+			info.GPS = gpsPosition(x)
+		}
+	}
+
+	if packet := xmpPayload(data); packet != nil && !hide["xmp"] {
+		if props := parseXMP(packet); props != nil {
+			info.Found = append(info.Found, "xmp")
+			for name := range props {
+				if hide.hidesXMPProperty(name) {
+					delete(props, name)
+				}
+			}
+			fillFromXMP(&info, props)
+			if len(props) > 0 {
+				info.XMP = props
+			}
+		}
+	}
+	return info
+}
+
+// fillFromXMP sets the fields of info that EXIF left empty from the
+// equivalent XMP properties.
+func fillFromXMP(info *ImageEXIF, props map[string]interface{}) {
+	fill := func(field *string, names ...string) {
+		for _, name := range names {
+			if *field != "" {
+				return
+			}
+			switch v := props[name].(type) {
+			case string:
+				*field = v
+			case []string:
+				*field = strings.Join(v, ", ")
+			}
+		}
+	}
+	fill(&info.CaptureDate, "exif:DateTimeOriginal", "xmp:CreateDate", "photoshop:DateCreated")
+	fill(&info.Make, "tiff:Make")
+	fill(&info.Model, "tiff:Model")
+	fill(&info.LensModel, "exifEX:LensModel", "aux:Lens")
+	fill(&info.Software, "xmp:CreatorTool")
+	fill(&info.Artist, "dc:creator")
+	fill(&info.Copyright, "dc:rights")
+	fill(&info.Description, "dc:description")
+
+	switch v := props["dc:subject"].(type) {
+	case string:
+		info.Keywords = []string{v}
+	case []string:
+		info.Keywords = v
+	}
+}
+
+// exifDate turns an EXIF date such as "2019:05:04 10:11:12" and an optional
+// offset such as "+01:00" into RFC 3339 form. It returns "" for the blank
+// dates some cameras write.
+func exifDate(date string, offset string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", date)
+	if err != nil {
+		return ""
+	}
+	s := t.Format("2006-01-02T15:04:05")
+	if _, err := time.Parse("-07:00", offset); err == nil {
+		s += offset
+	}
+	return s
+}
+
+// gpsPosition reads the position from the GPS directory, or returns nil if
+// there isn't a usable one.
+func gpsPosition(x *exifData) *GPSPosition {
+	lat := degrees(x.rationals(x.gps, tagGPSLatitude))
+	lon := degrees(x.rationals(x.gps, tagGPSLongitude))
+	if math.IsNaN(lat) || math.IsNaN(lon) {
+		return nil
+	}
+	if x.string(x.gps, tagGPSLatitudeRef) == "S" {
+		lat = -lat
+	}
+	if x.string(x.gps, tagGPSLongitudeRef) == "W" {
+		lon = -lon
+	}
+	pos := &GPSPosition{Latitude: math.Round(lat*1e6) / 1e6, Longitude: math.Round(lon*1e6) / 1e6}
+	if v := x.rationals(x.gps, tagGPSAltitude); len(v) > 0 {
+		alt := v[0]
+		if ref, ok := x.uint(x.gps, tagGPSAltitudeRef); ok && ref == 1 {
+			alt = -alt
+		}
+		pos.Altitude = &alt
+	}
+	return pos
+}
+
+// degrees converts degrees, minutes and seconds to decimal degrees, or NaN.
+func degrees(dms []float64) float64 {
+	if len(dms) != 3 {
+		return math.NaN()
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// acceptQuality returns the q-value an Accept header gives mediaType, using
+// the most specific matching range. An empty header accepts everything.
+func acceptQuality(accept string, mediaType string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+
+	best, bestSpecificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		specificity := -1
+		switch {
+		case rangeType == mediaType:
+			specificity = 2
+		case rangeType == major+"/*":
+			specificity = 1
+		case rangeType == "*/*":
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(s, 64); err == nil {
+				q = v
+			}
+		}
+		best, bestSpecificity = q, specificity
+	}
+	return best
+}
+
+// negotiateFormat picks the output format for an original of the given
+// content type from what the client accepts. It returns "" to serve the
+// original as it is.
+//
+// Transparent images stay in a format that keeps transparency. Opaque PNGs
+// become JPEG when the client likes it at least as much, since that is
+// usually far smaller. Otherwise the original wins if acceptable, then the
+// client's favourite.
+func negotiateFormat(accept string, contentType string, transparent bool) string {
+	original := normalizeImageType(contentType)
+	q := func(mediaType string) float64 { return acceptQuality(accept, mediaType) }
+
+	if transparent {
+		switch {
+		case q(original) > 0:
+			return ""
+		case q("image/png") > 0:
+			return "png"
+		case q("image/gif") > 0:
+			return "gif"
+		}
+		return ""
+	}
+
+	if original == "image/png" && q("image/jpeg") > 0 && q("image/jpeg") >= q(original) {
+		return "jpeg"
+	}
+	if q(original) > 0 {
+		return ""
+	}
+
+	best, bestQ := "", 0.0
+	for _, format := range []string{"jpeg", "png", "gif"} {
+		if fq := q("image/" + format); fq > bestQ {
+			best, bestQ = format, fq
+		}
+	}
+	return best
+}
+
+// streamsUnchanged reports whether an original of contentType can be passed
+// straight through without looking at its pixels: a JPEG the client accepts.
+func streamsUnchanged(accept string, contentType string) bool {
+	return normalizeImageType(contentType) == "image/jpeg" && negotiateFormat(accept, contentType, false) == ""
+}
+
+// mayBeTransparent reports whether an encoded image can contain transparent
+// pixels, judging by its colour model.
+func mayBeTransparent(data []byte) bool {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	switch m := cfg.ColorModel.(type) {
+	case color.Palette:
+		for _, c := range m {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+		return false
+	}
+	switch cfg.ColorModel {
+	case color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+	return false
+}
+
+// negotiatedOptions fills in the format of o from the Accept header when the
+// request didn't name one. Converted JPEGs use -negotiated-jpeg-quality.
+func negotiatedOptions(accept string, original *cacheEntry, o renderOptions) renderOptions {
+	if o.Format != "" {
+		return o
+	}
+	o.Format = negotiateFormat(accept, original.ContentType, mayBeTransparent(original.Data))
+	if o.Format == "jpeg" && normalizeImageType(original.ContentType) != "image/jpeg" && o.Quality == 0 {
+		o.Quality = *negotiatedJPEGQuality
+	}
+	return o
+}
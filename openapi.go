@@ -0,0 +1,874 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// openAPISpec describes every route in the routes table. Keep it in step with
+// the handlers: TestOpenAPIMatchesRoutes fails when the two disagree.
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Tempest Image Finder",
+    "version": "1.0.0",
+    "description": "Proxy for retrieving preview images from Tempest. Every error is returned as an ErrorResponse whose code field is stable and safe to match on. Responses from Tempest that aren't valid images are reported as 502 with code upstream_invalid_image, and images over the configured size limits as 502 upstream_too_large or 413 image_too_large. After -circuit-failures Tempest requests in a row fail, requests are paused for -circuit-cooldown and answered with 503 upstream_circuit_open."
+  },
+  "paths": {
+    "/": {
+      "get": {
+        "summary": "Image Finder web page",
+        "responses": {
+          "200": {"description": "HTML page", "content": {"text/html": {"schema": {"type": "string"}}}}
+        }
+      }
+    },
+    "/fetch-photo": {
+      "get": {
+        "summary": "Fetch one image",
+        "parameters": [
+          {"$ref": "#/components/parameters/QueryID"},
+          {"$ref": "#/components/parameters/Width"},
+          {"$ref": "#/components/parameters/Height"},
+          {"$ref": "#/components/parameters/Fit"},
+          {"$ref": "#/components/parameters/Format"},
+          {"$ref": "#/components/parameters/Quality"},
+          {"$ref": "#/components/parameters/Raw"},
+          {"$ref": "#/components/parameters/Orient"},
+          {"$ref": "#/components/parameters/Crop"},
+          {"$ref": "#/components/parameters/Watermark"},
+          {"$ref": "#/components/parameters/IfNoneMatch"},
+          {"$ref": "#/components/parameters/IfModifiedSince"},
+          {"$ref": "#/components/parameters/Range"},
+          {"$ref": "#/components/parameters/IfRange"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Image"},
+          "206": {"$ref": "#/components/responses/PartialImage"},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "416": {"description": "The requested range can't be satisfied"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "head": {
+        "summary": "Check that an image exists without downloading it",
+        "parameters": [
+          {"$ref": "#/components/parameters/QueryID"},
+          {"$ref": "#/components/parameters/Width"},
+          {"$ref": "#/components/parameters/Height"},
+          {"$ref": "#/components/parameters/Fit"},
+          {"$ref": "#/components/parameters/Format"},
+          {"$ref": "#/components/parameters/Quality"},
+          {"$ref": "#/components/parameters/Raw"},
+          {"$ref": "#/components/parameters/Orient"},
+          {"$ref": "#/components/parameters/Crop"},
+          {"$ref": "#/components/parameters/Watermark"},
+          {"$ref": "#/components/parameters/IfNoneMatch"},
+          {"$ref": "#/components/parameters/IfModifiedSince"}
+        ],
+        "responses": {
+          "200": {
+            "description": "The image exists. Content-Type and Content-Length describe it.",
+            "headers": {
+              "X-Cache": {"$ref": "#/components/headers/X-Cache"},
+              "ETag": {"$ref": "#/components/headers/ETag"},
+              "Repr-Digest": {"$ref": "#/components/headers/Repr-Digest"},
+              "Last-Modified": {"$ref": "#/components/headers/Last-Modified"},
+              "X-Metadata-Removed": {"$ref": "#/components/headers/X-Metadata-Removed"}
+            }
+          },
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"description": "No ID was given"},
+          "401": {"description": "Tempest requires authentication"},
+          "403": {"description": "Access to the image is denied"},
+          "404": {"description": "The image does not exist"},
+          "408": {"description": "Tempest did not answer in time"},
+          "500": {"description": "Tempest or the connection to it failed"},
+          "502": {"description": "Tempest answered with something that isn't an image"},
+          "503": {"description": "Tempest is unavailable"}
+        }
+      }
+    },
+    "/fetch-photos": {
+      "get": {
+        "summary": "Download several images as one zip archive",
+        "description": "Each image is named after its ID, with characters that can't go in a file name replaced by _ and, when any were, the first 8 hex digits of the ID's SHA-256 appended. Images that can't be fetched are left out of the archive and listed in errors.json inside it. HEAD checks the IDs without fetching any images.",
+        "parameters": [{
+          "name": "ids",
+          "in": "query",
+          "required": true,
+          "description": "Image IDs separated by commas, spaces or newlines (at most 200)",
+          "schema": {"type": "string"}
+        }],
+        "responses": {
+          "200": {"description": "Zip archive", "content": {"application/zip": {"schema": {"type": "string", "format": "binary"}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/images/{id}": {
+      "get": {
+        "summary": "Describe an image",
+        "parameters": [{"$ref": "#/components/parameters/PathID"}],
+        "responses": {
+          "200": {"description": "Image metadata", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ImageMetadata"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/images/{id}/content": {
+      "get": {
+        "summary": "Fetch the image bytes",
+        "parameters": [
+          {"$ref": "#/components/parameters/PathID"},
+          {"$ref": "#/components/parameters/IfNoneMatch"},
+          {"$ref": "#/components/parameters/IfModifiedSince"},
+          {"$ref": "#/components/parameters/Range"},
+          {"$ref": "#/components/parameters/IfRange"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Image"},
+          "206": {"$ref": "#/components/responses/PartialImage"},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "416": {"description": "The requested range can't be satisfied"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/images/{id}/status": {
+      "get": {
+        "summary": "Check that an image exists without downloading it",
+        "parameters": [{"$ref": "#/components/parameters/PathID"}],
+        "responses": {
+          "200": {"description": "The image exists", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ImageStatus"}}}},
+          "404": {"description": "The image does not exist", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ImageStatus"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/images/{id}/exif": {
+      "get": {
+        "summary": "Read the EXIF and XMP metadata of an image",
+        "description": "Capture date, camera, lens, exposure and position are normalized from EXIF, falling back to XMP. The GPS position and other sensitive XMP properties are left out when the server runs with -strip-sensitive-metadata.",
+        "parameters": [
+          {"$ref": "#/components/parameters/PathID"},
+          {"name": "raw", "in": "query", "description": "Read the raw preview, which keeps more of the camera's metadata", "schema": {"type": "boolean", "default": false}}
+        ],
+        "responses": {
+          "200": {"description": "Image metadata", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ImageEXIF"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/images/{id}/placeholder": {
+      "get": {
+        "summary": "Get a blurred placeholder to show while an image loads",
+        "description": "A BlurHash and a JPEG data URI at most 32 pixels a side, computed from the image and cached alongside it.",
+        "parameters": [
+          {"$ref": "#/components/parameters/PathID"}
+        ],
+        "responses": {
+          "200": {
+            "description": "The placeholder",
+            "headers": {
+              "ETag": {"description": "Hash of the placeholder", "schema": {"type": "string"}},
+              "X-Cache": {"$ref": "#/components/headers/X-Cache"}
+            },
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ImagePlaceholder"}}}
+          },
+          "304": {"description": "The client's copy is current"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/images/{id}/srcset": {
+      "get": {
+        "summary": "List /fetch-photo URLs of an image at several widths for <img srcset>",
+        "description": "Offers every width of the server's -srcset-widths ladder, or of widths, that is smaller than the image, plus the image at full width. The URLs are absolute and start with the server's -public-url, or else the host the request was made to. Variants are rendered and cached by /fetch-photo when first requested.",
+        "parameters": [
+          {"$ref": "#/components/parameters/PathID"},
+          {"name": "widths", "in": "query", "description": "Comma-separated widths to offer instead of the server's ladder (at most 12)", "schema": {"type": "string", "example": "400,800,1600"}},
+          {"name": "output", "in": "query", "description": "json, or html for a ready-made <img> element", "schema": {"type": "string", "enum": ["json", "html"], "default": "json"}},
+          {"name": "sizes", "in": "query", "description": "The sizes attribute of the <img> element", "schema": {"type": "string", "default": "100vw"}},
+          {"name": "alt", "in": "query", "description": "The alt text of the <img> element", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/Format"},
+          {"$ref": "#/components/parameters/Quality"},
+          {"$ref": "#/components/parameters/Raw"},
+          {"$ref": "#/components/parameters/Orient"},
+          {"$ref": "#/components/parameters/Crop"},
+          {"$ref": "#/components/parameters/Watermark"}
+        ],
+        "responses": {
+          "200": {
+            "description": "The variants",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/SrcSet"}},
+              "text/html": {"schema": {"type": "string"}, "example": "<img src=\"http://localhost:8080/fetch-photo?id=abc&w=1280\" srcset=\"...\" sizes=\"100vw\" width=\"1600\" height=\"1200\" alt=\"Image abc\" loading=\"lazy\" decoding=\"async\">"}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/contact-sheet": {
+      "get": {
+        "summary": "Compose thumbnails of several images into one contact sheet",
+        "description": "Each image is fetched like /fetch-photo and shrunk to fit a square tile, optionally labelled with its ID. Images that can't be fetched get a tile saying why and are listed in X-Contact-Sheet-Failed.",
+        "parameters": [
+          {"name": "ids", "in": "query", "required": true, "description": "Image IDs separated by commas, spaces or newlines (at most 200)", "schema": {"type": "string"}},
+          {"name": "columns", "in": "query", "description": "Tiles per row", "schema": {"type": "integer", "minimum": 1, "maximum": 20, "default": 5}},
+          {"name": "size", "in": "query", "description": "Width and height of each tile in pixels", "schema": {"type": "integer", "minimum": 32, "maximum": 1024, "default": 200}},
+          {"name": "labels", "in": "query", "description": "Write the ID under each tile", "schema": {"type": "boolean", "default": true}},
+          {"name": "format", "in": "query", "description": "One JPEG or PNG image, or a PDF with several pages", "schema": {"type": "string", "enum": ["jpeg", "png", "pdf"], "default": "jpeg"}},
+          {"name": "rows", "in": "query", "description": "Rows of tiles per PDF page", "schema": {"type": "integer", "minimum": 1, "maximum": 50, "default": 6}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The contact sheet",
+            "headers": {
+              "X-Contact-Sheet-Failed": {"description": "IDs of the images that couldn't be fetched", "schema": {"type": "string"}},
+              "Repr-Digest": {"$ref": "#/components/headers/Repr-Digest"}
+            },
+            "content": {
+              "image/jpeg": {"schema": {"type": "string", "format": "binary"}},
+              "image/png": {"schema": {"type": "string", "format": "binary"}},
+              "application/pdf": {"schema": {"type": "string", "format": "binary"}}
+            }
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/iiif/{id}": {
+      "get": {
+        "summary": "IIIF image service base URI",
+        "parameters": [{"$ref": "#/components/parameters/PathID"}],
+        "responses": {
+          "303": {"description": "Redirect to the image's info.json"}
+        }
+      }
+    },
+    "/iiif/{id}/info.json": {
+      "get": {
+        "summary": "Describe an image as a IIIF Image API 3.0 service at level 2",
+        "description": "Sent as application/ld+json when the Accept header asks for it.",
+        "parameters": [{"$ref": "#/components/parameters/PathID"}],
+        "responses": {
+          "200": {
+            "description": "The image information",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/IIIFInfo"}},
+              "application/ld+json": {"schema": {"$ref": "#/components/schemas/IIIFInfo"}}
+            }
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/iiif/{id}/{region}/{size}/{rotation}/{quality}.{format}": {
+      "get": {
+        "summary": "Render a IIIF Image API 3.0 image request",
+        "description": "The region is cut from the upright image, scaled, rotated and recoloured locally, then cached like /fetch-photo variants.",
+        "parameters": [
+          {"$ref": "#/components/parameters/PathID"},
+          {"name": "region", "in": "path", "required": true, "description": "full, square, x,y,w,h or pct:x,y,w,h", "schema": {"type": "string"}},
+          {"name": "size", "in": "path", "required": true, "description": "max, w,, ,h, pct:n, w,h or !w,h, preceded by ^ to allow enlarging", "schema": {"type": "string"}},
+          {"name": "rotation", "in": "path", "required": true, "description": "0, 90, 180 or 270 degrees clockwise, preceded by ! to mirror first", "schema": {"type": "string"}},
+          {"name": "quality", "in": "path", "required": true, "schema": {"type": "string", "enum": ["default", "color", "gray", "bitonal"]}},
+          {"name": "format", "in": "path", "required": true, "schema": {"type": "string", "enum": ["jpg", "png", "gif"]}},
+          {"$ref": "#/components/parameters/IfNoneMatch"},
+          {"$ref": "#/components/parameters/Range"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Image"},
+          "206": {"$ref": "#/components/responses/PartialImage"},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "408": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/share-links": {
+      "post": {
+        "summary": "Mint a signed, expiring link to one image",
+        "description": "The link hides the image ID and can't be altered. It is signed with the first unretired key of -share-keys-file; links signed with retired keys keep working for -share-key-grace. View counts are kept in shares.db in -jobs-dir, so they survive restarts.",
+        "security": [{"APIKey": []}],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ShareLinkRequest"}}}
+        },
+        "responses": {
+          "201": {"description": "The link", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ShareLink"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "405": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/s/{token}": {
+      "get": {
+        "summary": "Page showing a shared image",
+        "description": "Viewing the page doesn't count as a view. Query parameters listed in the link's allow are passed on to the image.",
+        "parameters": [{"$ref": "#/components/parameters/ShareToken"}],
+        "responses": {
+          "200": {"description": "HTML page", "content": {"text/html": {"schema": {"type": "string"}}}},
+          "403": {"description": "The link is not valid", "content": {"text/html": {"schema": {"type": "string"}}}},
+          "410": {"description": "The link has expired or been used up", "content": {"text/html": {"schema": {"type": "string"}}}}
+        }
+      }
+    },
+    "/s/{token}/image": {
+      "get": {
+        "summary": "Fetch a shared image",
+        "description": "Rendered with the parameters fixed by the link, plus those it allows the viewer to choose. Only a GET answered with the whole image counts as a view: errors, 304 and 206 responses, and transfers the viewer didn't receive in full, don't.",
+        "parameters": [
+          {"$ref": "#/components/parameters/ShareToken"},
+          {"$ref": "#/components/parameters/Width"},
+          {"$ref": "#/components/parameters/Height"},
+          {"$ref": "#/components/parameters/Fit"},
+          {"$ref": "#/components/parameters/Format"},
+          {"$ref": "#/components/parameters/Quality"},
+          {"$ref": "#/components/parameters/Raw"},
+          {"$ref": "#/components/parameters/Orient"},
+          {"$ref": "#/components/parameters/Crop"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Image"},
+          "206": {"$ref": "#/components/responses/PartialImage"},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "410": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/jobs": {
+      "post": {
+        "summary": "Queue a background download of many images",
+        "security": [{"APIKey": []}],
+        "description": "Returns at once with the job's ID; poll /api/v1/jobs/{id} for its progress. Jobs run one at a time, in order, each fetching -job-workers images at once. A watermarking API key watermarks every image. Only the API key that queued a job can see, cancel or download it; other keys are told it doesn't exist. Jobs are kept in -jobs-dir: an unfinished job carries on after a restart without fetching again the images it already has, trying again those that failed, and a finished job is removed after -job-retention, or sooner once archives outgrow -jobs-max-bytes.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobRequest"}}}
+        },
+        "responses": {
+          "202": {
+            "description": "The job was queued",
+            "headers": {"Location": {"description": "URL of the job", "schema": {"type": "string"}}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "405": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/jobs/{id}": {
+      "get": {
+        "summary": "Report the progress of a job",
+        "security": [{"APIKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/JobID"}],
+        "responses": {
+          "200": {"description": "The job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Cancel a job",
+        "description": "A queued job is cancelled at once. A running job starts no more fetches, abandons those in flight and is marked cancelled once they have returned. Nothing it fetched is kept.",
+        "security": [{"APIKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/JobID"}],
+        "responses": {
+          "200": {"description": "The job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/jobs/{id}/archive": {
+      "get": {
+        "summary": "Download the archive of a completed job",
+        "description": "A zip of every image the job fetched, in the order listed. Images that failed are listed in errors.json inside it, as with /fetch-photos. Supports Range requests.",
+        "security": [{"APIKey": []}],
+        "parameters": [{"$ref": "#/components/parameters/JobID"}],
+        "responses": {
+          "200": {"description": "Zip archive", "content": {"application/zip": {"schema": {"type": "string", "format": "binary"}}}},
+          "206": {"description": "Part of the zip archive", "content": {"application/zip": {"schema": {"type": "string", "format": "binary"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/webhooks/deliveries": {
+      "get": {
+        "summary": "List recent webhook deliveries, newest first",
+        "description": "Each event is POSTed as a JSON WebhookEvent to every webhook in -webhooks-file that wants it, with X-Webhook-Event, X-Webhook-Delivery and X-Webhook-Signature headers. The signature is t=<unix seconds>,v1=<hex HMAC-SHA256 of \"<t>.<body>\" keyed with the webhook's secret>, with one v1 per secret while a secret is being rotated. Anything but a 2xx is retried after 10s, 1m, 5m, 30m and 2h. Deliveries are kept for 7 days, and pending ones carry on after a restart. Run the server with the webhook-receiver subcommand to check signatures locally.",
+        "security": [{"APIKey": []}],
+        "parameters": [
+          {"name": "state", "in": "query", "description": "Only deliveries in this state", "schema": {"type": "string", "enum": ["pending", "delivered", "failed"]}},
+          {"name": "limit", "in": "query", "description": "Most deliveries to list", "schema": {"type": "integer", "minimum": 1, "maximum": 500, "default": 50}}
+        ],
+        "responses": {
+          "200": {"description": "The deliveries", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookDelivery"}}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/webhooks/ping": {
+      "post": {
+        "summary": "Send a ping event to every webhook",
+        "description": "For checking that a receiver verifies signatures. The deliveries are attempted in the background.",
+        "security": [{"APIKey": []}],
+        "responses": {
+          "202": {"description": "The deliveries queued", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookDelivery"}}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": {"description": "OpenAPI 3 document", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    },
+    "/docs": {
+      "get": {
+        "summary": "Interactive viewer for this document",
+        "responses": {
+          "200": {"description": "HTML page", "content": {"text/html": {"schema": {"type": "string"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "APIKey": {"type": "apiKey", "in": "header", "name": "X-API-Key", "description": "One of the keys in the server's -api-keys-file. A key marked watermark there has a watermark composited onto every image served to a request that carries it: /fetch-photo, /fetch-photos, image content, IIIF images, contact sheets, jobs and the share links it mints. Placeholders are never marked. This is not access control: the same images can be fetched without the key."}
+    },
+    "parameters": {
+      "QueryID": {"name": "id", "in": "query", "required": true, "description": "Tempest image ID", "schema": {"type": "string"}},
+      "PathID": {"name": "id", "in": "path", "required": true, "description": "Tempest image ID", "schema": {"type": "string"}},
+      "Width": {"name": "w", "in": "query", "description": "Maximum width in pixels. Images are never enlarged.", "schema": {"type": "integer", "minimum": 1, "maximum": 8192}},
+      "Height": {"name": "h", "in": "query", "description": "Maximum height in pixels. Images are never enlarged.", "schema": {"type": "integer", "minimum": 1, "maximum": 8192}},
+      "Fit": {"name": "fit", "in": "query", "description": "contain keeps the whole image inside w×h; cover fills w×h and crops the overflow", "schema": {"type": "string", "enum": ["contain", "cover"], "default": "contain"}},
+      "Format": {"name": "format", "in": "query", "description": "Re-encode the image in this format. When omitted, the format is negotiated from the Accept header (opaque PNGs may be sent as JPEG) and the response varies on Accept.", "schema": {"type": "string", "enum": ["jpeg", "png", "gif"]}},
+      "Quality": {"name": "q", "in": "query", "description": "JPEG quality", "schema": {"type": "integer", "minimum": 1, "maximum": 100, "default": 85}},
+      "Raw": {"name": "raw", "in": "query", "description": "Start from the preview as stored, without Tempest's EXIF rotation and cropping. The raw preview is cached once and turned upright locally.", "schema": {"type": "boolean", "default": false}},
+      "Orient": {"name": "orient", "in": "query", "description": "With raw, whether to apply the EXIF orientation locally (auto) or keep the stored pixel order (none)", "schema": {"type": "string", "enum": ["auto", "none"], "default": "auto"}},
+      "Crop": {"name": "crop", "in": "query", "description": "Crop rectangle x,y,width,height in pixels of the upright image, applied before resizing", "schema": {"type": "string", "pattern": "^\\d+,\\d+,\\d+,\\d+$"}},
+      "Watermark": {"name": "watermark", "in": "query", "description": "Composite the server's -watermark-logo or -watermark-text onto the image. Images that must be watermarked are never served without it: if the server has no watermark they fail with 500 watermark_unavailable. Always on for requests carrying an API key marked watermark in -api-keys-file.", "schema": {"type": "boolean", "default": false}},
+      "JobID": {"name": "id", "in": "path", "required": true, "description": "ID returned by POST /api/v1/jobs", "schema": {"type": "string"}},
+      "ShareToken": {"name": "token", "in": "path", "required": true, "description": "Token returned by POST /api/v1/share-links", "schema": {"type": "string"}},
+      "IfNoneMatch": {"name": "If-None-Match", "in": "header", "description": "ETag of a copy the client already has", "schema": {"type": "string"}},
+      "IfModifiedSince": {"name": "If-Modified-Since", "in": "header", "description": "Last-Modified of a copy the client already has", "schema": {"type": "string"}},
+      "Range": {"name": "Range", "in": "header", "description": "Byte range to return, e.g. bytes=1000-. Served locally for cached images and forwarded to Tempest otherwise.", "schema": {"type": "string"}},
+      "IfRange": {"name": "If-Range", "in": "header", "description": "Only honour Range if the image still has this ETag or Last-Modified", "schema": {"type": "string"}}
+    },
+    "headers": {
+      "X-Cache": {"description": "HIT when the image was served from the proxy cache, MISS otherwise", "schema": {"type": "string", "enum": ["HIT", "MISS"]}},
+      "X-Metadata-Removed": {"description": "The EXIF tags and metadata segments removed from the image by the server's -sanitize-metadata setting, e.g. GPSInfo, BodySerialNumber, XMP, Comment. Absent when nothing was removed.", "schema": {"type": "string"}},
+      "ETag": {"description": "Strong validator: Tempest's own ETag when it sends one, otherwise derived from Last-Modified or a hash of the content", "schema": {"type": "string"}},
+      "Repr-Digest": {"description": "RFC 9530 SHA-256 of the whole image, e.g. sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:. It is the same on a 206 for part of the image. When an image is streamed straight from Tempest and neither Tempest nor an earlier download supplied it, it is sent as a trailer and the response has no Content-Length, so HTTP/1.1 clients get it after the chunked body.", "schema": {"type": "string"}},
+      "Last-Modified": {"description": "Passed through from Tempest when it sends one", "schema": {"type": "string"}},
+      "Accept-Ranges": {"description": "Always bytes", "schema": {"type": "string", "enum": ["bytes"]}},
+      "Content-Range": {"description": "The part of the image being returned", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Image": {
+        "description": "The image, in the format Tempest returned it",
+        "headers": {
+          "X-Cache": {"$ref": "#/components/headers/X-Cache"},
+          "ETag": {"$ref": "#/components/headers/ETag"},
+          "Repr-Digest": {"$ref": "#/components/headers/Repr-Digest"},
+          "Last-Modified": {"$ref": "#/components/headers/Last-Modified"},
+          "Accept-Ranges": {"$ref": "#/components/headers/Accept-Ranges"},
+          "X-Metadata-Removed": {"$ref": "#/components/headers/X-Metadata-Removed"}
+        },
+        "content": {"image/*": {"schema": {"type": "string", "format": "binary"}}}
+      },
+      "PartialImage": {
+        "description": "Part of the image",
+        "headers": {
+          "X-Cache": {"$ref": "#/components/headers/X-Cache"},
+          "ETag": {"$ref": "#/components/headers/ETag"},
+          "Repr-Digest": {"$ref": "#/components/headers/Repr-Digest"},
+          "Content-Range": {"$ref": "#/components/headers/Content-Range"},
+          "X-Metadata-Removed": {"$ref": "#/components/headers/X-Metadata-Removed"}
+        },
+        "content": {"image/*": {"schema": {"type": "string", "format": "binary"}}}
+      },
+      "NotModified": {
+        "description": "The client's copy is current",
+        "headers": {
+          "ETag": {"$ref": "#/components/headers/ETag"},
+          "Last-Modified": {"$ref": "#/components/headers/Last-Modified"}
+        }
+      },
+      "Error": {
+        "description": "The request failed",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      }
+    },
+    "schemas": {
+      "ErrorResponse": {
+        "type": "object",
+        "required": ["error", "code", "status"],
+        "properties": {
+          "error": {"type": "string", "description": "Short human-readable summary"},
+          "code": {"type": "string", "description": "Stable machine-readable error code, e.g. image_not_found or upstream_timeout"},
+          "details": {"type": "string", "description": "Longer human-readable explanation"},
+          "status": {"type": "integer", "description": "HTTP status of the response"}
+        }
+      },
+      "ImageMetadata": {
+        "type": "object",
+        "required": ["id", "content_type", "size", "upstream_latency_ms", "cache", "parameters", "content_url"],
+        "properties": {
+          "id": {"type": "string"},
+          "content_type": {"type": "string"},
+          "size": {"type": "integer", "description": "Size in bytes"},
+          "width": {"type": "integer", "description": "Width in pixels, when the format is recognised"},
+          "height": {"type": "integer", "description": "Height in pixels, when the format is recognised"},
+          "upstream_latency_ms": {"type": "integer", "description": "Time Tempest took to deliver the image when it was fetched"},
+          "cache": {"type": "string", "enum": ["hit", "miss"]},
+          "parameters": {"type": "object", "additionalProperties": {"type": "string"}, "description": "Query parameters sent to Tempest"},
+          "content_url": {"type": "string"}
+        }
+      },
+      "ImageStatus": {
+        "type": "object",
+        "required": ["id", "exists", "cached"],
+        "properties": {
+          "id": {"type": "string"},
+          "exists": {"type": "boolean"},
+          "content_type": {"type": "string"},
+          "size": {"type": "integer", "description": "Size in bytes, when known"},
+          "cached": {"type": "boolean"}
+        }
+      },
+      "ShareLinkRequest": {
+        "type": "object",
+        "required": ["id"],
+        "properties": {
+          "id": {"type": "string", "description": "Image to share"},
+          "expires_in": {"type": "string", "description": "Lifetime as a duration such as 30m or 72h, at most -share-max-ttl", "default": "24h"},
+          "max_views": {"type": "integer", "minimum": 0, "description": "How many times the image can be loaded; 0 for no limit"},
+          "params": {"type": "object", "additionalProperties": {"type": "string"}, "description": "Rendering parameters fixed for every view: w, h, fit, format, q, raw, orient or crop", "example": {"w": "1200", "format": "jpeg"}},
+          "allow": {"type": "array", "items": {"type": "string"}, "description": "Rendering parameters the viewer may set, from the same list"},
+          "watermark": {"type": "boolean", "description": "Watermark the image on every view; always on for links minted with a key marked watermark", "default": false}
+        }
+      },
+      "ShareLink": {
+        "type": "object",
+        "required": ["url", "image_url", "token", "expires_at", "key_id"],
+        "properties": {
+          "url": {"type": "string", "description": "Page showing the image"},
+          "image_url": {"type": "string", "description": "The image itself"},
+          "token": {"type": "string"},
+          "expires_at": {"type": "string", "format": "date-time"},
+          "max_views": {"type": "integer"},
+          "watermark": {"type": "boolean"},
+          "key_id": {"type": "string", "description": "ID of the key that signed the link"}
+        }
+      },
+      "JobRequest": {
+        "type": "object",
+        "required": ["ids"],
+        "properties": {
+          "ids": {"type": "array", "items": {"type": "string"}, "maxItems": 5000, "description": "Images to download; duplicates are dropped"},
+          "params": {"type": "object", "additionalProperties": {"type": "string"}, "description": "Rendering parameters applied to every image: w, h, fit, format, q, raw, orient, crop or watermark", "example": {"w": "1600", "format": "jpeg"}}
+        }
+      },
+      "Job": {
+        "type": "object",
+        "required": ["id", "state", "created_at", "total", "done", "failed", "items"],
+        "properties": {
+          "id": {"type": "string"},
+          "state": {"type": "string", "enum": ["queued", "running", "completed", "failed", "cancelled"], "description": "completed once every image has been tried and at least one was fetched; failed if none were"},
+          "created_at": {"type": "string", "format": "date-time"},
+          "started_at": {"type": "string", "format": "date-time"},
+          "finished_at": {"type": "string", "format": "date-time"},
+          "params": {"type": "object", "additionalProperties": {"type": "string"}},
+          "total": {"type": "integer"},
+          "done": {"type": "integer", "description": "Images fetched so far"},
+          "failed": {"type": "integer", "description": "Images that couldn't be fetched so far"},
+          "items": {"type": "array", "items": {"$ref": "#/components/schemas/JobItem"}},
+          "archive_url": {"type": "string", "description": "Where to download the archive, once the job has completed"},
+          "archive_size": {"type": "integer"}
+        }
+      },
+      "JobItem": {
+        "type": "object",
+        "required": ["id", "state"],
+        "properties": {
+          "id": {"type": "string"},
+          "state": {"type": "string", "enum": ["pending", "fetching", "done", "failed"]},
+          "content_type": {"type": "string"},
+          "size": {"type": "integer"},
+          "sha256": {"type": "string", "description": "Hex SHA-256 of the image as stored in the archive"},
+          "archive_name": {"type": "string", "description": "Name of the image in the archive: the ID, with characters that can't go in a file name replaced by _ and, when any were, the first 8 hex digits of the ID's SHA-256 appended"},
+          "error": {"$ref": "#/components/schemas/ErrorResponse"}
+        }
+      },
+      "WebhookEvent": {
+        "type": "object",
+        "required": ["id", "type", "created_at", "data"],
+        "properties": {
+          "id": {"type": "string", "description": "Shared by every delivery of the event"},
+          "type": {"type": "string", "enum": ["job.completed", "job.failed", "circuit.opened", "circuit.closed", "upstream.errors", "ping"]},
+          "created_at": {"type": "string", "format": "date-time"},
+          "data": {"type": "object", "description": "job.* events carry job_id, state, total, done, failed, finished_at and, once completed, archive_path and archive_size. circuit.opened carries failures, last_error, cooldown_seconds and retry_at. upstream.errors carries count, window_seconds and last_status."}
+        }
+      },
+      "WebhookDelivery": {
+        "type": "object",
+        "required": ["id", "event", "url", "webhook", "state", "created_at", "attempts", "payload"],
+        "properties": {
+          "id": {"type": "string", "description": "Sent as X-Webhook-Delivery"},
+          "event": {"type": "string"},
+          "url": {"type": "string"},
+          "webhook": {"type": "integer", "description": "Which line of -webhooks-file the delivery is for, counting webhooks from 0, since several may share a URL"},
+          "state": {"type": "string", "enum": ["pending", "delivered", "failed"]},
+          "created_at": {"type": "string", "format": "date-time"},
+          "next_attempt": {"type": "string", "format": "date-time"},
+          "attempts": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookAttempt"}},
+          "payload": {"$ref": "#/components/schemas/WebhookEvent"}
+        }
+      },
+      "WebhookAttempt": {
+        "type": "object",
+        "required": ["at", "duration_ms"],
+        "properties": {
+          "at": {"type": "string", "format": "date-time"},
+          "status": {"type": "integer", "description": "Status the receiver answered with, if it answered"},
+          "error": {"type": "string", "description": "Why the attempt failed"},
+          "duration_ms": {"type": "integer"}
+        }
+      },
+      "IIIFInfo": {
+        "type": "object",
+        "required": ["@context", "id", "type", "protocol", "profile", "width", "height"],
+        "properties": {
+          "@context": {"type": "string", "enum": ["http://iiif.io/api/image/3/context.json"]},
+          "id": {"type": "string", "description": "Base URI of the image service"},
+          "type": {"type": "string", "enum": ["ImageService3"]},
+          "protocol": {"type": "string", "enum": ["http://iiif.io/api/image"]},
+          "profile": {"type": "string", "enum": ["level2"]},
+          "width": {"type": "integer"},
+          "height": {"type": "integer"},
+          "maxWidth": {"type": "integer"},
+          "maxHeight": {"type": "integer"},
+          "maxArea": {"type": "integer"},
+          "tiles": {"type": "array", "items": {"type": "object", "properties": {"width": {"type": "integer"}, "scaleFactors": {"type": "array", "items": {"type": "integer"}}}}},
+          "extraFormats": {"type": "array", "items": {"type": "string"}},
+          "extraQualities": {"type": "array", "items": {"type": "string"}},
+          "extraFeatures": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "SrcSet": {
+        "type": "object",
+        "required": ["id", "width", "height", "src", "srcset", "sizes", "variants"],
+        "properties": {
+          "id": {"type": "string"},
+          "width": {"type": "integer", "description": "Width of the full image, after any crop"},
+          "height": {"type": "integer", "description": "Height of the full image, after any crop"},
+          "src": {"type": "string", "description": "Fallback URL: the smallest variant at least 1024 pixels wide, or the full image"},
+          "srcset": {"type": "string", "description": "The srcset attribute value"},
+          "sizes": {"type": "string"},
+          "variants": {"type": "array", "items": {"$ref": "#/components/schemas/SrcSetVariant"}}
+        }
+      },
+      "SrcSetVariant": {
+        "type": "object",
+        "required": ["width", "height", "url"],
+        "properties": {
+          "width": {"type": "integer"},
+          "height": {"type": "integer"},
+          "url": {"type": "string"}
+        }
+      },
+      "ImagePlaceholder": {
+        "type": "object",
+        "required": ["id", "width", "height", "blurhash", "data_uri"],
+        "properties": {
+          "id": {"type": "string"},
+          "width": {"type": "integer", "description": "Width of the image itself"},
+          "height": {"type": "integer", "description": "Height of the image itself"},
+          "blurhash": {"type": "string", "description": "BlurHash with 4x3 components, or 3x4 for portrait images"},
+          "data_uri": {"type": "string", "description": "data:image/jpeg;base64 URI of a thumbnail at most 32 pixels a side"}
+        }
+      },
+      "ImageEXIF": {
+        "type": "object",
+        "required": ["id", "source", "orientation", "found"],
+        "properties": {
+          "id": {"type": "string"},
+          "source": {"type": "string", "enum": ["preview", "raw"]},
+          "width": {"type": "integer"},
+          "height": {"type": "integer"},
+          "orientation": {"type": "integer", "minimum": 1, "maximum": 8, "description": "EXIF orientation, 1 when there is none"},
+          "capture_date": {"type": "string", "description": "RFC 3339 date, with an offset only if the image records one", "example": "2019-05-04T10:11:12"},
+          "make": {"type": "string"},
+          "model": {"type": "string"},
+          "lens_model": {"type": "string"},
+          "software": {"type": "string"},
+          "artist": {"type": "string"},
+          "copyright": {"type": "string"},
+          "description": {"type": "string"},
+          "keywords": {"type": "array", "items": {"type": "string"}},
+          "exposure_time": {"type": "string", "example": "1/250"},
+          "f_number": {"type": "number"},
+          "iso": {"type": "integer"},
+          "focal_length_mm": {"type": "number"},
+          "gps": {"$ref": "#/components/schemas/GPSPosition"},
+          "found": {"type": "array", "items": {"type": "string", "enum": ["exif", "xmp"]}, "description": "Which kinds of metadata the image has"},
+          "xmp": {"type": "object", "description": "Simple XMP properties by prefixed name; lists for bags and sequences", "additionalProperties": {}}
+        }
+      },
+      "GPSPosition": {
+        "type": "object",
+        "required": ["latitude", "longitude"],
+        "properties": {
+          "latitude": {"type": "number"},
+          "longitude": {"type": "number"},
+          "altitude": {"type": "number", "description": "Metres above sea level"}
+        }
+      }
+    }
+  }
+}
+`
+
+const docsHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Tempest Image Finder API</title>
+    <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+    <div id="swagger-ui"></div>
+    <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+    <script>
+        window.ui = SwaggerUIBundle({
+            url: '/openapi.json',
+            dom_id: '#swagger-ui'
+        });
+    </script>
+</body>
+</html>
+`
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	logf("%s /openapi.json - Client: %s", r.Method, r.RemoteAddr)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write([]byte(openAPISpec))
+}
+
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	logf("%s /docs - Client: %s", r.Method, r.RemoteAddr)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsHTML))
+}
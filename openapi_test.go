@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// openAPIParameter is a parameter of the published specification, or a
+// reference to one in components.
+type openAPIParameter struct {
+	Ref  string `json:"$ref"`
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+type openAPIDocument struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+// probedMethods are the methods each documented path is requested with.
+var probedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// pathSamples fill in the path parameters of a documented path so that its
+// handler gets as far as checking the method.
+var pathSamples = strings.NewReplacer(
+	"{id}", "abc", "{token}", "abc", "{region}", "full", "{size}", "max",
+	"{rotation}", "0", "{quality}", "default", "{format}", "jpg",
+)
+
+var pathTemplateParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+func loadOpenAPIDocument(t *testing.T) openAPIDocument {
+	var doc openAPIDocument
+	if err := json.Unmarshal([]byte(openAPISpec), &doc); err != nil {
+		t.Fatalf("openAPISpec is not valid JSON: %v", err)
+	}
+	return doc
+}
+
+// registeredPaths lists the routes table as OpenAPI paths, expanding the
+// /api/v1/images/ subtree from imageActions, /iiif/ from iiifPaths, /s/
+// from sharePaths, /api/v1/jobs/ from jobPaths and /api/v1/webhooks/ from
+// webhookPaths.
+func registeredPaths() []string {
+	var paths []string
+	for _, rt := range routes {
+		switch rt.pattern {
+		case "/iiif/":
+			paths = append(paths, iiifPaths...)
+		case "/s/":
+			paths = append(paths, sharePaths...)
+		case "/api/v1/jobs/":
+			paths = append(paths, jobPaths...)
+		case "/api/v1/webhooks/":
+			paths = append(paths, webhookPaths...)
+		case "/api/v1/images/":
+			for action := range imageActions {
+				if action == "" {
+					paths = append(paths, "/api/v1/images/{id}")
+				} else {
+					paths = append(paths, "/api/v1/images/{id}/"+action)
+				}
+			}
+		default:
+			paths = append(paths, rt.pattern)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	doc := loadOpenAPIDocument(t)
+	registered := make(map[string]bool)
+	for _, p := range registeredPaths() {
+		registered[p] = true
+		if len(doc.Paths[p]) == 0 {
+			t.Errorf("%s is registered but not documented", p)
+		}
+	}
+	for p := range doc.Paths {
+		if !registered[p] {
+			t.Errorf("%s is documented but not registered", p)
+		}
+	}
+}
+
+// TestOpenAPIMethods requests every documented path with each method and
+// expects 405 exactly for the methods the specification leaves out. HEAD
+// is expected wherever GET is documented.
+func TestOpenAPIMethods(t *testing.T) {
+	doc := loadOpenAPIDocument(t)
+	fakeTempest(t, nil)
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		mux.HandleFunc(rt.pattern, rt.handler)
+	}
+
+	for p, item := range doc.Paths {
+		target := pathSamples.Replace(p)
+		for _, method := range probedMethods {
+			_, documented := item[strings.ToLower(method)]
+			if method == http.MethodHead {
+				_, documented = item["get"]
+				_, head := item["head"]
+				documented = documented || head
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+			switch {
+			case documented && rec.Code == http.StatusMethodNotAllowed:
+				t.Errorf("%s %s is documented but answered 405", method, p)
+			case !documented && rec.Code != http.StatusMethodNotAllowed:
+				t.Errorf("%s %s is not documented but answered %d, want 405", method, p, rec.Code)
+			}
+		}
+	}
+}
+
+// TestOpenAPIPathParameters checks that every operation declares each
+// {name} in its path as an in: path parameter, and no others.
+func TestOpenAPIPathParameters(t *testing.T) {
+	doc := loadOpenAPIDocument(t)
+	resolve := func(p openAPIParameter) openAPIParameter {
+		if p.Ref == "" {
+			return p
+		}
+		name := strings.TrimPrefix(p.Ref, "#/components/parameters/")
+		resolved, ok := doc.Components.Parameters[name]
+		if !ok {
+			t.Errorf("parameter %s is not defined", p.Ref)
+		}
+		return resolved
+	}
+
+	for p, item := range doc.Paths {
+		var want []string
+		for _, m := range pathTemplateParam.FindAllStringSubmatch(p, -1) {
+			want = append(want, m[1])
+		}
+		sort.Strings(want)
+
+		var shared []openAPIParameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &shared); err != nil {
+				t.Fatalf("%s parameters: %v", p, err)
+			}
+		}
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+			var op struct {
+				Parameters []openAPIParameter `json:"parameters"`
+			}
+			if err := json.Unmarshal(raw, &op); err != nil {
+				t.Fatalf("%s %s: %v", method, p, err)
+			}
+			var got []string
+			for _, param := range append(append([]openAPIParameter{}, shared...), op.Parameters...) {
+				if param = resolve(param); param.In == "path" {
+					got = append(got, param.Name)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%s %s declares path parameters %v, want %v", method, p, got, want)
+			}
+		}
+	}
+}
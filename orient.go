@@ -0,0 +1,49 @@
+package main
+
+import "image"
+
+// orientedSize is the size of a w×h image once the given EXIF orientation
+// has been applied.
+func orientedSize(w, h, orientation int) (int, int) {
+	if orientation >= 5 {
+		return h, w
+	}
+	return w, h
+}
+
+// applyOrientation turns src upright according to its EXIF orientation.
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	in := toRGBA(src)
+	w, h := in.Rect.Dx(), in.Rect.Dy()
+	dw, dh := orientedSize(w, h, orientation)
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// Find the source pixel that ends up at (x, y). The comments say
+			// what it takes to correct each orientation.
+			var sx, sy int
+			switch orientation {
+			case 2: // flip horizontally
+				sx, sy = w-1-x, y
+			case 3: // turn 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flip vertically
+				sx, sy = x, h-1-y
+			case 5: // transpose
+				sx, sy = y, x
+			case 6: // turn 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // turn 90° anticlockwise
+				sx, sy = w-1-y, x
+			}
+			copy(out.Pix[y*out.Stride+x*4:y*out.Stride+x*4+4], in.Pix[sy*in.Stride+sx*4:])
+		}
+	}
+	return out
+}
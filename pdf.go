@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// pdfPage is one page of a PDF made of a single JPEG image.
+type pdfPage struct {
+	JPEG          []byte
+	Width, Height int // in pixels
+}
+
+// pdfPointsPerPixel sizes pages as if the images were shown at 96 dpi.
+const pdfPointsPerPixel = 72.0 / 96.0
+
+// buildPDF writes a PDF with one page per image. The images are embedded
+// as they are, so no re-encoding happens here.
+func buildPDF(title string, pages []pdfPage) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+	// object starts object n, which must be the next in sequence.
+	object := func(n int) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n", n)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1-3 are the catalog, the page tree and the document info;
+	// each page then takes three: the page, its content and its image.
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+3*i)
+	}
+	object(1)
+	buf.WriteString("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	object(2)
+	fmt.Fprintf(&buf, "<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(pages))
+	object(3)
+	fmt.Fprintf(&buf, "<< /Title %s /Producer (Tempest Image Finder) /CreationDate (D:%s) >>\nendobj\n", pdfString(title), time.Now().UTC().Format("20060102150405Z"))
+
+	for i, p := range pages {
+		n := 4 + 3*i
+		w, h := float64(p.Width)*pdfPointsPerPixel, float64(p.Height)*pdfPointsPerPixel
+
+		object(n)
+		fmt.Fprintf(&buf, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n", w, h, n+2, n+1)
+
+		content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q\n", w, h)
+		object(n + 1)
+		fmt.Fprintf(&buf, "<< /Length %d >>\nstream\n%sendstream\nendobj\n", len(content), content)
+
+		object(n + 2)
+		fmt.Fprintf(&buf, "<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n", p.Width, p.Height, len(p.JPEG))
+		buf.Write(p.JPEG)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// pdfString quotes s as a PDF literal string.
+func pdfString(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('(')
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
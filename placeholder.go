@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// placeholderSize is the box the tiny thumbnail of a placeholder fits in.
+// The blurhash is computed from the same thumbnail.
+const (
+	placeholderSize    = 32
+	placeholderQuality = 50
+)
+
+// placeholderCacheKey is where the placeholder of photoId is cached, next to
+// the image itself.
+func placeholderCacheKey(photoId string) string {
+	return photoId + "|placeholder"
+}
+
+// handleImagePlaceholder sends a blurhash and a tiny inline JPEG of an image
+// that clients can show blurred while the image itself loads. Placeholders
+// are cached like images.
+func handleImagePlaceholder(w http.ResponseWriter, r *http.Request, photoId string) {
+	logf("%s /api/v1/images/%s/placeholder - Client: %s", r.Method, photoId, r.RemoteAddr)
+
+	key := placeholderCacheKey(photoId)
+	entry, hit := images.Get(key)
+	if !hit {
+		original, _, err := loadImage(r.Context(), photoId)
+		if err != nil {
+			sendTempestError(w, err)
+			return
+		}
+		p, err := makePlaceholder(photoId, original)
+		if err != nil {
+			sendTempestError(w, err)
+			return
+		}
+		data, _ := json.Marshal(p)
+		body := append(data, '\n')
+		entry = &cacheEntry{
+			ContentType:     "application/json",
+			Data:            body,
+			FetchedAt:       time.Now(),
+			UpstreamLatency: original.UpstreamLatency,
+			ETag:            contentETag(data),
+			Digest:          contentDigest(body),
+		}
+		images.Put(key, entry)
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	setValidators(w, entry.ETag, time.Time{})
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	if notModified(r, entry.ETag, time.Time{}) {
+		sendNotModified(w)
+		return
+	}
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Data)
+	}
+}
+
+// makePlaceholder shrinks original to a thumbnail of at most placeholderSize
+// pixels a side and describes it as a blurhash and a JPEG data URI.
+func makePlaceholder(photoId string, original *cacheEntry) (*ImagePlaceholder, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(original.Data))
+	if err != nil {
+		return nil, &tempestError{codeUnsupportedImage, "Unsupported image", fmt.Sprintf("The %s image can't be processed: %v", normalizeImageType(original.ContentType), err), http.StatusUnprocessableEntity}
+	}
+	thumb, release, err := renderPixels(photoId, original, renderOptions{Width: placeholderSize, Height: placeholderSize})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	data, err := encodeImage(thumb, "jpeg", placeholderQuality)
+	if err != nil {
+		return nil, &tempestError{codeInternal, "Encoding failed", fmt.Sprintf("Unable to encode the placeholder: %v", err), http.StatusInternalServerError}
+	}
+
+	// Use more components along the longer side.
+	cx, cy := 4, 3
+	if thumb.Rect.Dy() > thumb.Rect.Dx() {
+		cx, cy = 3, 4
+	}
+	return &ImagePlaceholder{
+		ID:       photoId,
+		Width:    cfg.Width,
+		Height:   cfg.Height,
+		Blurhash: blurhash(thumb, cx, cy),
+		DataURI:  "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
+// blurhash encodes img as a BlurHash (https://blurha.sh) with cx×cy cosine
+// components, each between 1 and 9.
+func blurhash(img *image.RGBA, cx, cy int) string {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	// Convert to linear light once rather than for every component.
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.RGBAAt(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			linear[y*w+x] = [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				by := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := by * math.Cos(math.Pi*float64(i)*float64(x)/float64(w))
+					p := linear[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(base83(cx-1+(cy-1)*9, 1))
+
+	maxValue := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised := clampInt(int(math.Floor(actualMax*166-0.5)), 0, 82)
+		maxValue = float64(quantised+1) / 166
+		b.WriteString(base83(quantised, 1))
+	} else {
+		b.WriteString(base83(0, 1))
+	}
+
+	dc := factors[0]
+	b.WriteString(base83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, f := range factors[1:] {
+		q := func(v float64) int {
+			return clampInt(int(math.Floor(signedPow(v/maxValue, 0.5)*9+9.5)), 0, 18)
+		}
+		b.WriteString(base83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return b.String()
+}
+
+const base83Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// base83 writes v as length base-83 digits, most significant first.
+func base83(v, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83Digits[v%83]
+		v /= 83
+	}
+	return string(digits)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
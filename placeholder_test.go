@@ -0,0 +1,86 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// The expected hashes come from the reference encoder at
+// https://github.com/woltapp/blurhash (TypeScript, encode.ts).
+func TestBlurhashReferenceVectors(t *testing.T) {
+	gradient := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			gradient.SetRGBA(x, y, color.RGBA{uint8(x * 32), uint8(y * 40), uint8((x + y) * 16), 255})
+		}
+	}
+	red := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	half := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 8; x++ {
+			if x < 4 {
+				red.SetRGBA(x, y, color.RGBA{255, 0, 0, 255})
+				half.SetRGBA(x, y, color.RGBA{0, 0, 0, 255})
+			} else {
+				half.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		img    *image.RGBA
+		cx, cy int
+		want   string
+	}{
+		{"gradient 4x3", gradient, 4, 3, "LjF=aJ32a_xtzFNKfRnQenf9fRf6"},
+		{"gradient 1x1", gradient, 1, 1, "00F=aJ"},
+		{"gradient 9x9", gradient, 9, 9, "|jF=aJ32a_xtJi%2FE-VFEzFNKfRnQWqnQWqnQWqenf9fRf6fRf6fRf6fR%LOTfPoeWooeWoofWod[e=fRe:fRe:fRe:fR%eOTfPoeWoofWoofWod@e=fRe:fRe:fRe:fR%eOTfPoeWoofWoofWod[e=fRe:fRe:fRe:fR"},
+		{"solid red", red, 4, 3, "L~TI:j|cfQ|c|c$5fQ$5fQfQfQfQ"},
+		{"black and white halves", half, 4, 3, "L~Lqe900D%?b-;IURjxufQfQfQfQ"},
+	}
+	for _, tt := range tests {
+		if got := blurhash(tt.img, tt.cx, tt.cy); got != tt.want {
+			t.Errorf("%s: blurhash = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A sub-image must hash the same as a copy of its pixels at the origin.
+func TestBlurhashSubImage(t *testing.T) {
+	full := image.NewRGBA(image.Rect(0, 0, 12, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 12; x++ {
+			full.SetRGBA(x, y, color.RGBA{uint8(x * 20), uint8(y * 25), 128, 255})
+		}
+	}
+	sub := full.SubImage(image.Rect(2, 3, 10, 9)).(*image.RGBA)
+	moved := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			moved.SetRGBA(x, y, sub.RGBAAt(x+2, y+3))
+		}
+	}
+	if a, b := blurhash(sub, 4, 3), blurhash(moved, 4, 3); a != b {
+		t.Errorf("sub-image blurhash = %q, copy = %q", a, b)
+	}
+}
+
+func TestBase83(t *testing.T) {
+	tests := []struct {
+		v, length int
+		want      string
+	}{
+		{0, 1, "0"},
+		{82, 1, "~"},
+		{83, 2, "10"},
+		{6888, 2, "~~"},
+		{0xff0000, 4, "TI:j"},
+	}
+	for _, tt := range tests {
+		if got := base83(tt.v, tt.length); got != tt.want {
+			t.Errorf("base83(%d, %d) = %q, want %q", tt.v, tt.length, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// metadataCategories are the kinds of metadata -sanitize-metadata can
+// remove. gps, identifiers and comments remove individual EXIF tags;
+// thumbnail removes the EXIF thumbnail; exif, xmp and iptc remove whole
+// segments, and comments also removes COM segments.
+var metadataCategories = []string{"gps", "identifiers", "comments", "thumbnail", "exif", "xmp", "iptc"}
+
+// exifTagCategories gives the category and reported name of each EXIF tag
+// that can be removed. GPSInfo takes the whole GPS directory with it.
+var exifTagCategories = map[uint16]struct{ category, name string }{
+	tagGPSIFD:           {"gps", "GPSInfo"},
+	tagHostComputer:     {"identifiers", "HostComputer"},
+	tagMakerNote:        {"identifiers", "MakerNote"},
+	tagImageUniqueID:    {"identifiers", "ImageUniqueID"},
+	tagCameraOwnerName:  {"identifiers", "CameraOwnerName"},
+	tagBodySerialNumber: {"identifiers", "BodySerialNumber"},
+	tagLensSerialNumber: {"identifiers", "LensSerialNumber"},
+	tagCameraSerial:     {"identifiers", "CameraSerialNumber"},
+	tagUserComment:      {"comments", "UserComment"},
+}
+
+const (
+	tagThumbnailOffset = 0x0201
+	tagThumbnailLength = 0x0202
+)
+
+const (
+	xmpExtensionSignature = "http://ns.adobe.com/xmp/extension/\x00"
+	iptcSignature         = "Photoshop 3.0\x00"
+)
+
+// metadataRemoval is the set of metadataCategories to remove from served
+// images.
+type metadataRemoval map[string]bool
+
+// metadataToRemove is set in main from -sanitize-metadata and
+// -strip-sensitive-metadata.
+var metadataToRemove metadataRemoval
+
+// parseMetadataRemoval reads a comma-separated list of metadataCategories,
+// or "all". sensitive adds gps, identifiers and comments.
+func parseMetadataRemoval(list string, sensitive bool) (metadataRemoval, error) {
+	m := metadataRemoval{}
+	if sensitive {
+		m["gps"], m["identifiers"], m["comments"] = true, true, true
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "":
+		case name == "all":
+			for _, c := range metadataCategories {
+				m[c] = true
+			}
+		case containsString(metadataCategories, name):
+			m[name] = true
+		default:
+			return nil, fmt.Errorf("unknown metadata %q; use %s or all", name, strings.Join(metadataCategories, ", "))
+		}
+	}
+	return m, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (m metadataRemoval) enabled() bool {
+	return len(m) > 0
+}
+
+// String lists the categories in a stable order, for logging.
+func (m metadataRemoval) String() string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// tags returns the EXIF tags to remove, with their names.
+func (m metadataRemoval) tags() map[uint16]string {
+	tags := make(map[uint16]string)
+	for tag, c := range exifTagCategories {
+		if m[c.category] {
+			tags[tag] = c.name
+		}
+	}
+	return tags
+}
+
+// hidesXMPProperty reports whether an XMP property, named as parseXMP names
+// it, holds the kind of information m removes from EXIF. Every property is
+// hidden when m removes the XMP itself.
+func (m metadataRemoval) hidesXMPProperty(name string) bool {
+	if m["xmp"] {
+		return true
+	}
+	if strings.HasPrefix(name, "exif:GPS") {
+		return m["gps"]
+	}
+	switch name {
+	case "aux:SerialNumber", "aux:LensSerialNumber", "aux:OwnerName",
+		"exifEX:BodySerialNumber", "exifEX:LensSerialNumber", "exifEX:CameraOwnerName", "exifEX:ImageUniqueID":
+		return m["identifiers"]
+	case "exif:UserComment":
+		return m["comments"]
+	}
+	return false
+}
+
+// sanitizeJPEG returns a copy of a JPEG without the metadata m selects, and
+// the names of what it removed. Tags are removed by editing the EXIF in
+// place and whole segments by leaving them out; the compressed pixel data is
+// copied as it is. data itself is returned if there was nothing to remove.
+func sanitizeJPEG(data []byte, m metadataRemoval) ([]byte, []string) {
+	segments := jpegSegments(data)
+	if segments == nil {
+		return data, nil
+	}
+	out := append([]byte(nil), data...)
+	var removed []string
+
+	if !m["exif"] {
+		removed = append(removed, stripEXIFTags(exifPayload(out), m)...)
+	}
+
+	// Rebuild the header without the unwanted segments.
+	rebuilt := []byte{0xFF, 0xD8}
+	rest := 2
+	for _, s := range segments {
+		end := s.Offset + 4 + len(s.Data)
+		rest = end
+		if name := removedSegment(s, m); name != "" {
+			removed = append(removed, name)
+			continue
+		}
+		rebuilt = append(rebuilt, out[s.Offset:end]...)
+	}
+	if len(removed) == 0 {
+		return data, nil
+	}
+	return append(rebuilt, out[rest:]...), uniqueStrings(removed)
+}
+
+// removedSegment returns the name to report a segment by if m removes it,
+// or "".
+func removedSegment(s jpegSegment, m metadataRemoval) string {
+	switch {
+	case s.Marker == 0xFE && m["comments"]:
+		return "Comment"
+	case s.Marker == 0xE1 && bytes.HasPrefix(s.Data, []byte("Exif\x00\x00")) && m["exif"]:
+		return "EXIF"
+	case s.Marker == 0xE1 && (bytes.HasPrefix(s.Data, []byte(xmpSignature)) || bytes.HasPrefix(s.Data, []byte(xmpExtensionSignature))) && m["xmp"]:
+		return "XMP"
+	case s.Marker == 0xED && bytes.HasPrefix(s.Data, []byte(iptcSignature)) && m["iptc"]:
+		return "IPTC"
+	}
+	return ""
+}
+
+// stripEXIFTags removes the tags and thumbnail m selects from an EXIF
+// payload in place, so nothing moves, and returns their names.
+func stripEXIFTags(payload []byte, m metadataRemoval) []string {
+	t, ok := newTIFFReader(payload)
+	if !ok {
+		return nil
+	}
+	tags := m.tags()
+
+	// Find the other directories before IFD0 loses its pointers to them.
+	ifd0 := t.fields(t.firstIFD())
+	var removed []string
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if off, ok := t.uint(e); ok {
+			removed = append(removed, t.removeTags(off, tags)...)
+		}
+	}
+	if _, drop := tags[tagGPSIFD]; drop {
+		if e, ok := ifd0[tagGPSIFD]; ok {
+			if off, ok := t.uint(e); ok {
+				t.clearIFD(off)
+			}
+		}
+	}
+	if m["thumbnail"] && t.removeThumbnail() {
+		removed = append(removed, "Thumbnail")
+	}
+	return append(removed, t.removeTags(t.firstIFD(), tags)...)
+}
+
+// nextIFDAt returns where the pointer to the directory after the one at
+// offset is stored.
+func (t *tiffReader) nextIFDAt(offset uint32) (uint64, bool) {
+	start := uint64(offset)
+	if start+2 > uint64(len(t.data)) {
+		return 0, false
+	}
+	at := start + 2 + uint64(t.order.Uint16(t.data[start:]))*12
+	return at, at+4 <= uint64(len(t.data))
+}
+
+// removeThumbnail clears IFD1, which describes the thumbnail, and the
+// thumbnail itself, and unlinks IFD1 from IFD0. It reports whether there was
+// a thumbnail.
+func (t *tiffReader) removeThumbnail() bool {
+	at, ok := t.nextIFDAt(t.firstIFD())
+	if !ok {
+		return false
+	}
+	ifd1 := t.order.Uint32(t.data[at:])
+	if ifd1 == 0 {
+		return false
+	}
+	fields := t.fields(ifd1)
+	if e, ok := fields[tagThumbnailOffset]; ok {
+		off, ok1 := t.uint(e)
+		n, ok2 := t.uint(fields[tagThumbnailLength])
+		if ok1 && ok2 && uint64(off)+uint64(n) <= uint64(len(t.data)) {
+			zeroBytes(t.data[off : off+n])
+		}
+	}
+	t.clearIFD(ifd1)
+	t.order.PutUint32(t.data[at:], 0)
+	return true
+}
+
+// removeTags deletes the entries for tags from the directory at offset,
+// zeroing their values, and returns the names of those it found. The
+// remaining entries move up so the directory stays valid.
+func (t *tiffReader) removeTags(offset uint32, tags map[uint16]string) []string {
+	start := uint64(offset)
+	if start+2 > uint64(len(t.data)) {
+		return nil
+	}
+	n := uint64(t.order.Uint16(t.data[start:]))
+	end := start + 2 + n*12
+	if end > uint64(len(t.data)) {
+		return nil
+	}
+
+	var removed []string
+	kept := uint64(0)
+	for i := uint64(0); i < n; i++ {
+		p := start + 2 + i*12
+		entry, ok := t.entryAt(p)
+		if name, drop := tags[entry.Tag]; drop {
+			if ok && entry.valueAt >= 0 {
+				zeroBytes(entry.Value)
+			}
+			removed = append(removed, name)
+			continue
+		}
+		copy(t.data[start+2+kept*12:], t.data[p:p+12])
+		kept++
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	// Move the pointer to the next directory up behind the last entry and
+	// clear what is left of the old entries.
+	var next [4]byte
+	if end+4 <= uint64(len(t.data)) {
+		copy(next[:], t.data[end:end+4])
+		end += 4
+	}
+	t.order.PutUint16(t.data[start:], uint16(kept))
+	last := start + 2 + kept*12
+	zeroBytes(t.data[last:end])
+	copy(t.data[last:end], next[:])
+	return removed
+}
+
+// clearIFD zeroes the directory at offset and the values it points to.
+func (t *tiffReader) clearIFD(offset uint32) {
+	start := uint64(offset)
+	if start+2 > uint64(len(t.data)) {
+		return
+	}
+	for _, e := range t.ifd(offset) {
+		if e.valueAt >= 0 {
+			zeroBytes(e.Value)
+		}
+	}
+	n := uint64(t.order.Uint16(t.data[start:]))
+	end := start + 2 + n*12 + 4
+	if end > uint64(len(t.data)) {
+		end = uint64(len(t.data))
+	}
+	zeroBytes(t.data[start:end])
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func uniqueStrings(list []string) []string {
+	var out []string
+	for _, s := range list {
+		if !containsString(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// sanitizedEntry returns entry, which is cached under key, without the
+// metadata in metadataToRemove. The cleaned copy is cached beside the
+// original, which stays available to /exif. Only JPEGs are sanitized;
+// re-encoded variants carry no metadata to begin with.
+func sanitizedEntry(key string, entry *cacheEntry) *cacheEntry {
+	if !metadataToRemove.enabled() || normalizeImageType(entry.ContentType) != "image/jpeg" {
+		return entry
+	}
+	cleanKey := key + "|sanitized"
+	if clean, ok := images.Get(cleanKey); ok {
+		return clean
+	}
+
+	data, removed := sanitizeJPEG(entry.Data, metadataToRemove)
+	if len(removed) == 0 {
+		return entry
+	}
+	logf("SANITIZED: Removed %s from %s", strings.Join(removed, ", "), key)
+	clean := *entry
+	clean.Data = data
+	clean.ETag = contentETag(data)
+	clean.Digest = contentDigest(data)
+	clean.MetadataRemoved = removed
+	images.Put(cleanKey, &clean)
+	return &clean
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// gpsJPEG returns a small JPEG whose EXIF places it at 51.5N 0.1E and whose
+// XMP repeats the latitude.
+func gpsJPEG(t *testing.T) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Little-endian TIFF: IFD0 at 8 points at the GPS IFD at 26, whose
+	// rationals follow at 80 and 104.
+	le := binary.LittleEndian
+	tiff := make([]byte, 128)
+	copy(tiff, "II*\x00")
+	le.PutUint32(tiff[4:], 8)
+	le.PutUint16(tiff[8:], 1)
+	entry := func(at int, tag, typ uint16, count, value uint32) {
+		le.PutUint16(tiff[at:], tag)
+		le.PutUint16(tiff[at+2:], typ)
+		le.PutUint32(tiff[at+4:], count)
+		le.PutUint32(tiff[at+8:], value)
+	}
+	entry(10, tagGPSIFD, 4, 1, 26)
+	le.PutUint16(tiff[26:], 4)
+	entry(28, tagGPSLatitudeRef, 2, 2, uint32('N'))
+	entry(40, tagGPSLatitude, 5, 3, 80)
+	entry(52, tagGPSLongitudeRef, 2, 2, uint32('E'))
+	entry(64, tagGPSLongitude, 5, 3, 104)
+	for i, v := range []uint32{51, 1, 30, 1, 0, 1, 0, 1, 6, 1, 0, 1} {
+		le.PutUint32(tiff[80+4*i:], v)
+	}
+
+	xmp := []byte(xmpSignature + `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="51,30.0N"/></rdf:RDF></x:xmpmeta>`)
+
+	var out bytes.Buffer
+	out.Write(img.Bytes()[:2])
+	for _, payload := range [][]byte{append([]byte("Exif\x00\x00"), tiff...), xmp} {
+		out.Write([]byte{0xff, 0xe1, 0, 0})
+		binary.BigEndian.PutUint16(out.Bytes()[out.Len()-2:], uint16(len(payload)+2))
+		out.Write(payload)
+	}
+	out.Write(img.Bytes()[2:])
+	return out.Bytes()
+}
+
+func withMetadataRemoval(t *testing.T, list string, sensitive bool) {
+	m, err := parseMetadataRemoval(list, sensitive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := metadataToRemove
+	metadataToRemove = m
+	t.Cleanup(func() { metadataToRemove = old })
+}
+
+func TestServedImagesHaveNoGPS(t *testing.T) {
+	data := gpsJPEG(t)
+	if x, ok := readEXIF(data); !ok || gpsPosition(x) == nil {
+		t.Fatal("test image has no GPS position")
+	}
+	fakeTempest(t, map[string][]byte{"gps1": data})
+	withMetadataRemoval(t, "", true)
+
+	for _, tt := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/fetch-photo?id=gps1", handleFetchPhoto},
+		{"/api/v1/images/gps1/content", handleImagesAPI},
+	} {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", tt.path, rec.Code, rec.Body)
+			continue
+		}
+		if x, ok := readEXIF(rec.Body.Bytes()); ok {
+			if _, found := x.ifd0[tagGPSIFD]; found || gpsPosition(x) != nil {
+				t.Errorf("%s: served image still has a GPS IFD", tt.path)
+			}
+		}
+		if info := describeMetadata(rec.Body.Bytes(), nil); info.GPS != nil {
+			t.Errorf("%s: served image still has a GPS position", tt.path)
+		}
+	}
+}
+
+func TestDescribeMetadataHidesRemovedSegments(t *testing.T) {
+	data := gpsJPEG(t)
+	if info := describeMetadata(data, nil); info.GPS == nil || info.XMP["exif:GPSLatitude"] == nil {
+		t.Fatalf("unfiltered description lacks the GPS position: %+v", info)
+	}
+
+	for _, tt := range []struct {
+		hide    metadataRemoval
+		gps     bool
+		exif    bool
+		xmpProp bool
+	}{
+		{metadataRemoval{"gps": true}, false, true, false},
+		{metadataRemoval{"exif": true}, false, false, true},
+		{metadataRemoval{"xmp": true}, true, true, false},
+	} {
+		info := describeMetadata(data, tt.hide)
+		if got := info.GPS != nil; got != tt.gps {
+			t.Errorf("hide %v: GPS position reported = %v, want %v", tt.hide, got, tt.gps)
+		}
+		if got := containsString(info.Found, "exif"); got != tt.exif {
+			t.Errorf("hide %v: exif found = %v, want %v", tt.hide, got, tt.exif)
+		}
+		if got := info.XMP["exif:GPSLatitude"] != nil; got != tt.xmpProp {
+			t.Errorf("hide %v: exif:GPSLatitude reported = %v, want %v", tt.hide, got, tt.xmpProp)
+		}
+	}
+}
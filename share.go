@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultShareTTL = 24 * time.Hour
+
+// sharePaths are the OpenAPI paths served under /s/.
+var sharePaths = []string{"/s/{token}", "/s/{token}/image"}
+
+// shareParameters are the /fetch-photo parameters a share link can fix or
+// let its viewer choose.
+var shareParameters = []string{"w", "h", "fit", "format", "q", "raw", "orient", "crop"}
+
+// A share link token is three base64url parts separated by dots: the ID of
+// the signing key, the sharePayload encrypted with AES-CTR under a random
+// IV, and an HMAC-SHA256 of the first two. Encrypting keeps the image ID out
+// of the URL; the HMAC stops anyone forging or altering links.
+type sharePayload struct {
+	ID       string            `json:"i"`
+	Expires  int64             `json:"e"`
+	MaxViews int               `json:"v,omitempty"`
+	Params   map[string]string `json:"p,omitempty"`
+	Allow    []string          `json:"a,omitempty"`
+	Nonce    string            `json:"n"`
+	// Watermark marks the image with studioMark whatever the parameters.
+	Watermark bool `json:"m,omitempty"`
+}
+
+// shareKey signs share links. Retired keys no longer sign but are accepted
+// for -share-key-grace after their retirement.
+type shareKey struct {
+	ID      string
+	Secret  []byte
+	Retired time.Time
+}
+
+// subkey derives a key for one purpose from the secret.
+func (k shareKey) subkey(purpose string) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (k shareKey) sign(data string) []byte {
+	mac := hmac.New(sha256.New, k.subkey("share link signature"))
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// crypt encrypts or decrypts data in place; CTR mode is its own inverse.
+func (k shareKey) crypt(iv, data []byte) {
+	block, _ := aes.NewCipher(k.subkey("share link encryption"))
+	cipher.NewCTR(block, iv).XORKeyStream(data, data)
+}
+
+// shareKeyring holds the signing keys from -share-keys-file, reloading them
+// when the file changes so keys can be rotated without a restart.
+type shareKeyring struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	keys    []shareKey
+}
+
+var shareKeys = &shareKeyring{}
+
+// configure loads the keys from path, or makes a random key that lasts
+// until the server stops if path is empty.
+func (k *shareKeyring) configure(path string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.path = path
+	if path == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		k.keys = []shareKey{{ID: "temporary", Secret: secret}}
+		return nil
+	}
+	return k.reload()
+}
+
+// reload rereads the key file if it changed. k.mu must be held.
+func (k *shareKeyring) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(k.modTime) && k.keys != nil {
+		return nil
+	}
+	keys, err := loadShareKeys(k.path)
+	if err != nil {
+		return err
+	}
+	k.keys, k.modTime = keys, info.ModTime()
+	logf("Loaded %d share link signing keys from %s", len(keys), k.path)
+	return nil
+}
+
+// snapshot returns the current keys. If the file can't be reread, the keys
+// loaded last are kept.
+func (k *shareKeyring) snapshot() []shareKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.path != "" {
+		if err := k.reload(); err != nil {
+			logf("ERROR: Reloading share keys: %v", err)
+		}
+	}
+	return k.keys
+}
+
+// signingKey is the first key that hasn't been retired.
+func (k *shareKeyring) signingKey() (shareKey, bool) {
+	for _, key := range k.snapshot() {
+		if key.Retired.IsZero() {
+			return key, true
+		}
+	}
+	return shareKey{}, false
+}
+
+// lookup finds the key with the given ID if links it signed are still
+// accepted.
+func (k *shareKeyring) lookup(id string) (shareKey, bool) {
+	for _, key := range k.snapshot() {
+		if key.ID == id {
+			return key, key.Retired.IsZero() || time.Since(key.Retired) < *shareKeyGrace
+		}
+	}
+	return shareKey{}, false
+}
+
+// loadShareKeys reads lines of the form "id secret [retired-at]", newest key
+// first, where retired-at is an RFC 3339 time. Blank lines and # comments
+// are skipped.
+func loadShareKeys(path string) ([]shareKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []shareKey
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected \"id secret [retired-at]\"", line)
+		}
+		key := shareKey{ID: fields[0], Secret: []byte(fields[1])}
+		if strings.Contains(key.ID, ".") || seen[key.ID] {
+			return nil, fmt.Errorf("line %d: key IDs must be unique and can't contain dots", line)
+		}
+		if len(key.Secret) < 32 {
+			return nil, fmt.Errorf("line %d: secrets must be at least 32 characters long", line)
+		}
+		if len(fields) == 3 {
+			if key.Retired, err = time.Parse(time.RFC3339, fields[2]); err != nil {
+				return nil, fmt.Errorf("line %d: retired-at must be an RFC 3339 time", line)
+			}
+		}
+		seen[key.ID] = true
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+	return keys, nil
+}
+
+// encodeShareToken signs and encrypts p with key.
+func encodeShareToken(key shareKey, p sharePayload) (string, error) {
+	plain, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	sealed := make([]byte, aes.BlockSize+len(plain))
+	iv := sealed[:aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	copy(sealed[aes.BlockSize:], plain)
+	key.crypt(iv, sealed[aes.BlockSize:])
+
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(sealed)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(key.sign(signed)), nil
+}
+
+// decodeShareToken checks the signature and expiry of token and returns its
+// payload.
+func decodeShareToken(token string) (*sharePayload, error) {
+	invalid := &tempestError{codeShareLinkInvalid, "Invalid share link", "This link is not valid. Check that it was copied completely.", http.StatusForbidden}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalid
+	}
+	key, ok := shareKeys.lookup(parts[0])
+	if !ok {
+		return nil, invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, key.sign(parts[0]+"."+parts[1])) {
+		return nil, invalid
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aes.BlockSize {
+		return nil, invalid
+	}
+	plain := sealed[aes.BlockSize:]
+	key.crypt(sealed[:aes.BlockSize], plain)
+	var p sharePayload
+	if err := json.Unmarshal(plain, &p); err != nil {
+		return nil, invalid
+	}
+	if time.Now().Unix() >= p.Expires {
+		return nil, &tempestError{codeShareLinkExpired, "Share link expired", fmt.Sprintf("This link expired on %s", time.Unix(p.Expires, 0).UTC().Format(time.RFC1123)), http.StatusGone}
+	}
+	return &p, nil
+}
+
+// shareViews counts the views of links with a view limit. Once open has
+// been called the counts are saved in a store, so they survive restarts.
+type shareViews struct {
+	mu     sync.Mutex
+	db     *kvStore
+	counts map[string]shareViewCount
+	pruned time.Time
+}
+
+// shareViewCount is how often a link has been viewed. It is kept under
+// "views/{nonce}" until the link expires.
+type shareViewCount struct {
+	Views   int   `json:"views"`
+	Expires int64 `json:"expires"`
+}
+
+var sharedViews = &shareViews{counts: make(map[string]shareViewCount)}
+
+// open loads the counts saved in db and saves every change there from now
+// on.
+func (v *shareViews) open(db *kvStore) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range db.Keys("views/") {
+		var c shareViewCount
+		if _, err := db.Get(key, &c); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		v.counts[strings.TrimPrefix(key, "views/")] = c
+	}
+	v.db = db
+	return nil
+}
+
+// remaining is how many more views the link p allows, or -1 if unlimited.
+func (v *shareViews) remaining(p *sharePayload) int {
+	if p.MaxViews == 0 {
+		return -1
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return p.MaxViews - v.counts[p.Nonce].Views
+}
+
+// take reserves a view of p, reporting false if none are left. A view that
+// isn't served in full is handed back with refund.
+func (v *shareViews) take(p *sharePayload) bool {
+	if p.MaxViews == 0 {
+		return true
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// Forget links that have expired now and then.
+	if now := time.Now(); now.Sub(v.pruned) > 10*time.Minute {
+		for nonce, c := range v.counts {
+			if now.Unix() >= c.Expires {
+				delete(v.counts, nonce)
+				if v.db != nil {
+					v.db.Delete("views/" + nonce)
+				}
+			}
+		}
+		v.pruned = now
+	}
+
+	c := v.counts[p.Nonce]
+	if c.Views >= p.MaxViews {
+		return false
+	}
+	c.Views++
+	c.Expires = p.Expires
+	v.save(p.Nonce, c)
+	return true
+}
+
+// refund hands back a view reserved by take.
+func (v *shareViews) refund(p *sharePayload) {
+	if p.MaxViews == 0 {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.counts[p.Nonce]; ok && c.Views > 0 {
+		c.Views--
+		v.save(p.Nonce, c)
+	}
+}
+
+// save records the count of the link with nonce. v.mu must be held.
+func (v *shareViews) save(nonce string, c shareViewCount) {
+	v.counts[nonce] = c
+	if v.db == nil {
+		return
+	}
+	if err := v.db.Put("views/"+nonce, c, false); err != nil {
+		logf("ERROR: Saving the view count of a share link: %v", err)
+	}
+}
+
+func usedUpError(p *sharePayload) *tempestError {
+	return &tempestError{codeShareLinkUsedUp, "Share link used up", fmt.Sprintf("This link could be viewed %d times and has been used up", p.MaxViews), http.StatusGone}
+}
+
+// ShareLinkRequest is the body of POST /api/v1/share-links.
+type ShareLinkRequest struct {
+	ID        string            `json:"id"`
+	ExpiresIn string            `json:"expires_in"` // a Go duration such as "72h"
+	MaxViews  int               `json:"max_views"`
+	Params    map[string]string `json:"params"`
+	Allow     []string          `json:"allow"`
+	Watermark bool              `json:"watermark"`
+}
+
+// ShareLink is the response of POST /api/v1/share-links.
+type ShareLink struct {
+	URL       string    `json:"url"`
+	ImageURL  string    `json:"image_url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxViews  int       `json:"max_views,omitempty"`
+	Watermark bool      `json:"watermark"`
+	KeyID     string    `json:"key_id"`
+}
+
+// shareLinkPayload validates a mint request and turns it into a payload.
+func shareLinkPayload(req ShareLinkRequest) (sharePayload, error) {
+	p := sharePayload{ID: req.ID, MaxViews: req.MaxViews, Params: req.Params, Allow: req.Allow, Watermark: req.Watermark}
+	if p.ID == "" {
+		return p, &tempestError{codeMissingID, "Image ID required", "Please provide the ID of the image to share", http.StatusBadRequest}
+	}
+	ttl := defaultShareTTL
+	if req.ExpiresIn != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.ExpiresIn); err != nil || ttl <= 0 {
+			return p, invalidParameterError("expires_in must be a positive duration such as 30m or 72h")
+		}
+	}
+	if ttl > *shareMaxTTL {
+		return p, invalidParameterError(fmt.Sprintf("expires_in can be at most %s", *shareMaxTTL))
+	}
+	p.Expires = time.Now().Add(ttl).Unix()
+	if p.MaxViews < 0 {
+		return p, invalidParameterError("max_views must not be negative")
+	}
+	if p.Watermark && studioMark == nil {
+		return p, invalidParameterError("watermark needs the server to be started with -watermark-logo or -watermark-text")
+	}
+
+	q := url.Values{}
+	for name, value := range p.Params {
+		if !containsString(shareParameters, name) {
+			return p, invalidParameterError(fmt.Sprintf("params can only contain %s", strings.Join(shareParameters, ", ")))
+		}
+		q.Set(name, value)
+	}
+	if _, err := parseRenderOptions(q); err != nil {
+		return p, err
+	}
+	for _, name := range p.Allow {
+		if !containsString(shareParameters, name) {
+			return p, invalidParameterError(fmt.Sprintf("allow can only contain %s", strings.Join(shareParameters, ", ")))
+		}
+		if _, fixed := p.Params[name]; fixed {
+			return p, invalidParameterError(fmt.Sprintf("%s can't be both fixed in params and allowed", name))
+		}
+	}
+	sort.Strings(p.Allow)
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return p, err
+	}
+	p.Nonce = hex.EncodeToString(nonce)
+	return p, nil
+}
+
+// handleShareLinks mints a share link for one image. It needs an API key.
+func handleShareLinks(w http.ResponseWriter, r *http.Request) {
+	logf("%s /api/v1/share-links - Client: %s", r.Method, r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	caller, ok := requireAPIKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req ShareLinkRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		sendTempestError(w, invalidParameterError(fmt.Sprintf("The body must be a JSON ShareLinkRequest: %v", err)))
+		return
+	}
+	// Keys that watermark everything they fetch watermark what they share.
+	req.Watermark = req.Watermark || caller.Watermark
+	p, err := shareLinkPayload(req)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+
+	key, ok := shareKeys.signingKey()
+	if !ok {
+		sendJSONError(w, codeInternal, "No signing key", "Every key in -share-keys-file is retired; add a new one at the top", http.StatusInternalServerError)
+		return
+	}
+	token, err := encodeShareToken(key, p)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+
+	base := requestBaseURL(r) + "/s/" + token
+	link := ShareLink{
+		URL:       base,
+		ImageURL:  base + "/image",
+		Token:     token,
+		ExpiresAt: time.Unix(p.Expires, 0).UTC(),
+		MaxViews:  p.MaxViews,
+		Watermark: p.Watermark,
+		KeyID:     key.ID,
+	}
+	logf("SUCCESS: Minted share link for %s with key %s, expiring %s", p.ID, key.ID, link.ExpiresAt.Format(time.RFC3339))
+	sendJSON(w, link, http.StatusCreated)
+}
+
+// handleShared serves /s/{token}, a page showing the shared image, and
+// /s/{token}/image, the image itself. Only the image counts as a view.
+func handleShared(w http.ResponseWriter, r *http.Request) {
+	token, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+
+	logf("%s /s/ - Client: %s", r.Method, r.RemoteAddr)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	switch rest {
+	case "":
+		serveSharePage(w, r, token)
+	case "image":
+		serveSharedImage(w, r, token)
+	default:
+		sendJSONError(w, codeUnknownEndpoint, "Not found", fmt.Sprintf("Unknown endpoint %s", r.URL.Path), http.StatusNotFound)
+	}
+}
+
+// shareOptions combines the parameters fixed by the link with those the
+// viewer may choose.
+func shareOptions(p *sharePayload, q url.Values) url.Values {
+	v := url.Values{}
+	for _, name := range p.Allow {
+		if value := q.Get(name); value != "" {
+			v.Set(name, value)
+		}
+	}
+	for name, value := range p.Params {
+		v.Set(name, value)
+	}
+	return v
+}
+
+// privateResponseWriter stops browsers and proxies reusing a shared image
+// without asking, so expiry and view limits apply to every view.
+type privateResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w privateResponseWriter) WriteHeader(status int) {
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// viewResponseWriter follows a shared image out, so that only a 200 whose
+// whole body was sent counts as a view.
+type viewResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	failed  bool
+}
+
+func (w *viewResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *viewResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// complete reports whether the whole image went out with a 200.
+func (w *viewResponseWriter) complete() bool {
+	if w.status != http.StatusOK || w.failed {
+		return false
+	}
+	size, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+	return err != nil || w.written == size
+}
+
+func serveSharedImage(w http.ResponseWriter, r *http.Request, token string) {
+	w = privateResponseWriter{w}
+	p, err := decodeShareToken(token)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	o, err := parseRenderOptions(shareOptions(p, r.URL.Query()))
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	o.Watermark = o.Watermark || p.Watermark
+	if r.Method == http.MethodGet {
+		if !sharedViews.take(p) {
+			sendTempestError(w, usedUpError(p))
+			return
+		}
+		// Errors, 304s and ranges don't use up a view, nor do images
+		// the viewer didn't receive in full.
+		vw := &viewResponseWriter{ResponseWriter: w}
+		defer func() {
+			if !vw.complete() {
+				sharedViews.refund(p)
+			}
+		}()
+		w = vw
+	}
+
+	load := loadImage
+	if o.Raw {
+		load = loadRawImage
+	}
+	original, hit, err := load(r.Context(), p.ID)
+	if err != nil {
+		// Upstream errors name the image, which the link is meant to hide.
+		e := errorResponseFor(err)
+		sendJSONError(w, e.Code, e.Error, "The shared image can't be shown right now", e.Status)
+		return
+	}
+	serveVariant(w, r, p.ID, original, hit, o)
+}
+
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="robots" content="noindex">
+    <title>Shared image</title>
+    <style>
+        body {
+            margin: 0;
+            min-height: 100vh;
+            display: flex;
+            flex-direction: column;
+            align-items: center;
+            justify-content: center;
+            gap: 16px;
+            padding: 20px;
+            box-sizing: border-box;
+            background: linear-gradient(135deg, #0f172a 0%, #1e293b 50%, #334155 100%);
+            color: #f1f5f9;
+            font-family: 'Inter', system-ui, sans-serif;
+        }
+        img {
+            max-width: 100%;
+            max-height: 85vh;
+            border-radius: 16px;
+            box-shadow: 0 25px 50px rgba(0, 0, 0, 0.5);
+        }
+        .note {
+            color: #94a3b8;
+            font-size: 0.85rem;
+        }
+        .error {
+            color: #f87171;
+            font-weight: 500;
+        }
+    </style>
+</head>
+<body>
+{{if .Error}}
+    <div class="error">{{.Error}}</div>
+{{else}}
+    <img src="{{.ImageURL}}" alt="Shared image">
+    <div class="note">This link expires {{.Expires}}{{if ge .Remaining 0}} and can be viewed {{.Remaining}} more times{{end}}.</div>
+{{end}}
+</body>
+</html>
+`))
+
+// serveSharePage shows the shared image, or why it can't be shown. Viewing
+// the page doesn't use up a view; loading the image does.
+func serveSharePage(w http.ResponseWriter, r *http.Request, token string) {
+	data := struct {
+		ImageURL  string
+		Expires   string
+		Remaining int
+		Error     string
+	}{}
+
+	status := http.StatusOK
+	p, err := decodeShareToken(token)
+	if err == nil && sharedViews.remaining(p) == 0 {
+		err = usedUpError(p)
+	}
+	if err != nil {
+		e := errorResponseFor(err)
+		data.Error, status = e.Details, e.Status
+	} else {
+		// Pass on the parameters the viewer may choose; the image adds the
+		// fixed ones itself.
+		data.ImageURL = "/s/" + url.PathEscape(token) + "/image"
+		q := url.Values{}
+		for _, name := range p.Allow {
+			if value := r.URL.Query().Get(name); value != "" {
+				q.Set(name, value)
+			}
+		}
+		if len(q) > 0 {
+			data.ImageURL += "?" + q.Encode()
+		}
+		data.Expires = time.Unix(p.Expires, 0).UTC().Format(time.RFC1123)
+		data.Remaining = sharedViews.remaining(p)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	sharePageTemplate.Execute(w, data)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withShareKeys replaces the signing keys for one test.
+func withShareKeys(t *testing.T, keys ...shareKey) {
+	old := shareKeys
+	shareKeys = &shareKeyring{keys: keys}
+	t.Cleanup(func() { shareKeys = old })
+}
+
+func testShareKey(id string) shareKey {
+	return shareKey{ID: id, Secret: []byte(strings.Repeat(id, 32))}
+}
+
+func tokenError(token string) string {
+	if _, err := decodeShareToken(token); err != nil {
+		return err.(*tempestError).Code
+	}
+	return ""
+}
+
+func TestShareTokens(t *testing.T) {
+	current, retired, stale := testShareKey("k2"), testShareKey("k1"), testShareKey("k0")
+	retired.Retired = time.Now().Add(-time.Hour)
+	stale.Retired = time.Now().Add(-*shareKeyGrace - time.Hour)
+	withShareKeys(t, current, retired, stale)
+
+	p := sharePayload{ID: "secret-id", Expires: time.Now().Add(time.Hour).Unix(), MaxViews: 3, Nonce: "0123456789abcdef"}
+	token, err := encodeShareToken(current, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token, "secret-id") {
+		t.Error("the token shows the image ID")
+	}
+	got, err := decodeShareToken(token)
+	if err != nil || got.ID != p.ID || got.MaxViews != 3 || got.Nonce != p.Nonce {
+		t.Fatalf("decodeShareToken = %+v, %v", got, err)
+	}
+
+	parts := strings.Split(token, ".")
+	flipped := []byte(parts[1])
+	flipped[len(flipped)/2] ^= 1
+	expired := p
+	expired.Expires = time.Now().Add(-time.Minute).Unix()
+
+	sign := func(key shareKey, p sharePayload) string {
+		token, err := encodeShareToken(key, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	tests := []struct {
+		name, token, want string
+	}{
+		{"altered payload", parts[0] + "." + string(flipped) + "." + parts[2], codeShareLinkInvalid},
+		{"signature from another key", "k1." + parts[1] + "." + parts[2], codeShareLinkInvalid},
+		{"truncated", parts[0] + "." + parts[1], codeShareLinkInvalid},
+		{"unknown key", sign(testShareKey("k9"), p), codeShareLinkInvalid},
+		{"expired", sign(current, expired), codeShareLinkExpired},
+		{"retired key within grace", sign(retired, p), ""},
+		{"retired key past grace", sign(stale, p), codeShareLinkInvalid},
+	}
+	for _, tt := range tests {
+		if got := tokenError(tt.token); got != tt.want {
+			t.Errorf("%s: error code %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSharedImageViews(t *testing.T) {
+	fakeTempest(t, map[string][]byte{"abc": grayJPEG(t, 64)})
+	key := testShareKey("k1")
+	withShareKeys(t, key)
+	path := filepath.Join(t.TempDir(), "shares.db")
+	old := sharedViews
+	sharedViews = &shareViews{counts: make(map[string]shareViewCount)}
+	t.Cleanup(func() { sharedViews = old })
+	if err := sharedViews.open(openTestStore(t, path)); err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Hour).Unix()
+	p := sharePayload{ID: "abc", Expires: expires, MaxViews: 3, Nonce: "0000000000000001"}
+	missing := sharePayload{ID: "missing", Expires: expires, MaxViews: 1, Nonce: "0000000000000002"}
+	get := func(p sharePayload, header ...string) *httptest.ResponseRecorder {
+		token, err := encodeShareToken(key, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/s/"+token+"/image", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handleShared(rec, req)
+		return rec
+	}
+
+	full := get(p)
+	if full.Code != http.StatusOK {
+		t.Fatalf("status %d", full.Code)
+	}
+	if rec := get(p, "If-None-Match", full.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+		t.Errorf("conditional GET: status %d, want 304", rec.Code)
+	}
+	if rec := get(p, "Range", "bytes=0-9"); rec.Code != http.StatusPartialContent {
+		t.Errorf("range: status %d, want 206", rec.Code)
+	}
+	if got := sharedViews.remaining(&p); got != 2 {
+		t.Errorf("%d views left after a 200, a 304 and a 206; want 2", got)
+	}
+	if rec := get(missing); rec.Code != http.StatusNotFound {
+		t.Errorf("missing image: status %d, want 404", rec.Code)
+	}
+	if got := sharedViews.remaining(&missing); got != 1 {
+		t.Errorf("a failed view was counted: %d left, want 1", got)
+	}
+
+	// The counts survive a restart.
+	restarted := &shareViews{counts: make(map[string]shareViewCount)}
+	if err := restarted.open(openTestStore(t, path)); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.remaining(&p); got != 2 {
+		t.Errorf("after a restart %d views are left, want 2", got)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxSrcsetWidths = 12
+
+// srcsetLadder is the widths offered by /api/v1/images/{id}/srcset when the
+// request doesn't list its own. It is set from -srcset-widths.
+var srcsetLadder []int
+
+// srcsetParameters are the /fetch-photo parameters copied into every URL of
+// a srcset. Width comes from the ladder, and the height follows from it.
+var srcsetParameters = []string{"format", "q", "raw", "orient", "crop", "watermark"}
+
+// parseWidthLadder reads a comma-separated list of widths, returning them
+// sorted without duplicates.
+func parseWidthLadder(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	var widths []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > maxRenderDimension {
+			return nil, fmt.Errorf("width %q is not a whole number of pixels between 1 and %d", field, maxRenderDimension)
+		}
+		if !seen[n] {
+			seen[n] = true
+			widths = append(widths, n)
+		}
+	}
+	if len(widths) == 0 {
+		return nil, fmt.Errorf("no widths given")
+	}
+	if len(widths) > maxSrcsetWidths {
+		return nil, fmt.Errorf("at most %d widths can be given", maxSrcsetWidths)
+	}
+	sort.Ints(widths)
+	return widths, nil
+}
+
+// requestBaseURL is where clients reach us, so the URLs in a srcset work
+// when embedded in pages served from elsewhere: -public-url, or else the
+// scheme and host r came in on. Any client can send X-Forwarded-Proto, so
+// it is only believed with -trust-proxy.
+func requestBaseURL(r *http.Request) string {
+	if *publicURL != "" {
+		return *publicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); *trustProxy && (proto == "http" || proto == "https") {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// handleImageSrcset lists /fetch-photo URLs of an image at each width of the
+// ladder that is smaller than the image, plus the image at full width. The
+// variants are rendered and cached by /fetch-photo when first requested.
+// With output=html it sends a ready-made <img> element instead of JSON.
+func handleImageSrcset(w http.ResponseWriter, r *http.Request, photoId string) {
+	logf("%s /api/v1/images/%s/srcset - Client: %s", r.Method, photoId, r.RemoteAddr)
+
+	q := r.URL.Query()
+	if q.Get("w") != "" || q.Get("h") != "" || q.Get("fit") != "" {
+		sendTempestError(w, invalidParameterError("w, h and fit can't be used with srcset; the widths come from the ladder"))
+		return
+	}
+	o, err := parseRenderOptions(q)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	output := q.Get("output")
+	if output != "" && output != "json" && output != "html" {
+		sendTempestError(w, invalidParameterError("output must be json or html"))
+		return
+	}
+	ladder := srcsetLadder
+	if s := q.Get("widths"); s != "" {
+		if ladder, err = parseWidthLadder(s); err != nil {
+			sendTempestError(w, invalidParameterError("widths: "+err.Error()))
+			return
+		}
+	}
+	sizes := q.Get("sizes")
+	if sizes == "" {
+		sizes = "100vw"
+	}
+
+	load := loadImage
+	if o.Raw {
+		load = loadRawImage
+	}
+	entry, _, err := load(r.Context(), photoId)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(entry.Data))
+	if err != nil {
+		sendTempestError(w, &tempestError{codeUnsupportedImage, "Unsupported image", fmt.Sprintf("The %s image can't be processed: %v", normalizeImageType(entry.ContentType), err), http.StatusUnprocessableEntity})
+		return
+	}
+	sw, sh := orientedSize(cfg.Width, cfg.Height, o.orientation(entry))
+	if !o.Crop.Empty() {
+		if !o.Crop.In(image.Rect(0, 0, sw, sh)) {
+			sendTempestError(w, invalidParameterError(fmt.Sprintf("crop must lie within the %dx%d image", sw, sh)))
+			return
+		}
+		sw, sh = o.Crop.Dx(), o.Crop.Dy()
+	}
+
+	base := url.Values{"id": {photoId}}
+	for _, name := range srcsetParameters {
+		if v := q.Get(name); v != "" {
+			base.Set(name, v)
+		}
+	}
+	variantURL := func(width int) string {
+		v := url.Values{}
+		for name, values := range base {
+			v[name] = values
+		}
+		if width < sw {
+			v.Set("w", strconv.Itoa(width))
+		}
+		return requestBaseURL(r) + "/fetch-photo?" + v.Encode()
+	}
+
+	set := SrcSet{ID: photoId, Width: sw, Height: sh, Sizes: sizes, Variants: []SrcSetVariant{}}
+	var candidates []string
+	var widths []int
+	for _, width := range ladder {
+		if width < sw {
+			widths = append(widths, width)
+		}
+	}
+	for _, width := range append(widths, sw) {
+		_, _, height := renderOptions{Width: width}.layout(sw, sh)
+		v := SrcSetVariant{Width: width, Height: height, URL: variantURL(width)}
+		set.Variants = append(set.Variants, v)
+		candidates = append(candidates, fmt.Sprintf("%s %dw", v.URL, v.Width))
+	}
+	set.Srcset = strings.Join(candidates, ", ")
+	set.Src = set.Variants[len(set.Variants)-1].URL
+	for _, v := range set.Variants {
+		// The smallest width that fills a typical 1024-pixel-wide column.
+		if v.Width >= 1024 {
+			set.Src = v.URL
+			break
+		}
+	}
+
+	if output != "html" {
+		sendJSON(w, set, http.StatusOK)
+		return
+	}
+	alt := q.Get("alt")
+	if alt == "" {
+		alt = "Image " + photoId
+	}
+	snippet := fmt.Sprintf(`<img src="%s" srcset="%s" sizes="%s" width="%d" height="%d" alt="%s" loading="lazy" decoding="async">`+"\n",
+		html.EscapeString(set.Src), html.EscapeString(set.Srcset), html.EscapeString(set.Sizes), set.Width, set.Height, html.EscapeString(alt))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(snippet))
+}
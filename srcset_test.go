@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestBaseURL(t *testing.T) {
+	tests := []struct {
+		publicURL  string
+		trustProxy bool
+		proto      string
+		want       string
+	}{
+		{"", false, "", "http://attacker.example"},
+		{"", false, "https", "http://attacker.example"},
+		{"", true, "https", "https://attacker.example"},
+		{"", true, "gopher", "http://attacker.example"},
+		{"https://images.example.com", false, "http", "https://images.example.com"},
+		{"https://images.example.com", true, "http", "https://images.example.com"},
+	}
+	oldURL, oldTrust := *publicURL, *trustProxy
+	t.Cleanup(func() { *publicURL, *trustProxy = oldURL, oldTrust })
+	for _, tt := range tests {
+		*publicURL, *trustProxy = tt.publicURL, tt.trustProxy
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/images/1/srcset", nil)
+		r.Host = "attacker.example"
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		if got := requestBaseURL(r); got != tt.want {
+			t.Errorf("public-url %q, trust-proxy %v, X-Forwarded-Proto %q: got %q, want %q", tt.publicURL, tt.trustProxy, tt.proto, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// kvStore is a small embedded key-value database kept in one file: an
+// append-only log of JSON records, one per line, replayed into memory when
+// the store is opened. Once more of the log is dead than alive it is
+// rewritten with only the live records.
+type kvStore struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	data map[string]json.RawMessage
+	dead int
+}
+
+// kvRecord is one line of the log. A record with Deleted set removes Key.
+type kvRecord struct {
+	Key     string          `json:"k"`
+	Value   json.RawMessage `json:"v,omitempty"`
+	Deleted bool            `json:"d,omitempty"`
+}
+
+// kvCompactAfter is how many dead records the log may hold before it is
+// worth rewriting.
+const kvCompactAfter = 1000
+
+// openKVStore opens the store at path, creating it if it doesn't exist. A
+// last record cut short by a crash is dropped.
+func openKVStore(path string) (*kvStore, error) {
+	s := &kvStore{path: path, data: make(map[string]json.RawMessage)}
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	good := 0
+	for good < len(content) {
+		end := bytes.IndexByte(content[good:], '\n')
+		if end < 0 {
+			break
+		}
+		var rec kvRecord
+		if err := json.Unmarshal(content[good:good+end], &rec); err != nil {
+			break
+		}
+		if _, ok := s.data[rec.Key]; ok {
+			s.dead++
+		}
+		if rec.Deleted {
+			delete(s.data, rec.Key)
+			s.dead++
+		} else {
+			s.data[rec.Key] = rec.Value
+		}
+		good += end + 1
+	}
+
+	s.f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if good < len(content) {
+		logf("WARNING: Dropping %d damaged bytes at the end of %s", len(content)-good, path)
+	}
+	if err := s.f.Truncate(int64(good)); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	if _, err := s.f.Seek(int64(good), 0); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	s.maybeCompact()
+	return s, nil
+}
+
+// Get decodes the value stored under key into v, reporting whether there
+// was one.
+func (s *kvStore) Get(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	raw, ok := s.data[key]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Keys lists the keys starting with prefix, sorted.
+func (s *kvStore) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Put stores v under key. With durable set the write is flushed to disk
+// before Put returns; otherwise it survives the process dying but may be
+// lost if the machine does.
+func (s *kvStore) Put(key string, v interface{}, durable bool) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(kvRecord{Key: key, Value: raw}, durable); err != nil {
+		return err
+	}
+	if _, ok := s.data[key]; ok {
+		s.dead++
+	}
+	s.data[key] = raw
+	s.maybeCompact()
+	return nil
+}
+
+// Delete removes every key starting with prefix.
+func (s *kvStore) Delete(prefix string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.data {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if err := s.append(kvRecord{Key: k, Deleted: true}, false); err != nil {
+			return err
+		}
+		delete(s.data, k)
+		s.dead += 2
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.maybeCompact()
+	return nil
+}
+
+// append writes one record to the end of the log. The caller must hold mu.
+func (s *kvStore) append(rec kvRecord, durable bool) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if durable {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+// maybeCompact rewrites the log once it is mostly dead records. The caller
+// must hold mu.
+func (s *kvStore) maybeCompact() {
+	if s.dead < kvCompactAfter || s.dead < len(s.data) {
+		return
+	}
+	if err := s.compact(); err != nil {
+		logf("WARNING: Unable to compact %s: %v", s.path, err)
+	}
+}
+
+// compact writes the live records to a new log, replacing the old one only
+// once the new one is safely on disk. The caller must hold mu.
+func (s *kvStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for k, v := range s.data {
+		line, err := json.Marshal(kvRecord{Key: k, Value: v})
+		if err == nil {
+			_, err = w.Write(append(line, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = f
+	s.dead = 0
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestStore(t *testing.T, path string) *kvStore {
+	s, err := openKVStore(path)
+	if err != nil {
+		t.Fatalf("openKVStore: %v", err)
+	}
+	return s
+}
+
+func TestKVStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s := openTestStore(t, path)
+	for _, kv := range []struct {
+		key   string
+		value int
+	}{{"job/a", 1}, {"job/b", 2}, {"item/a/0", 3}, {"job/a", 4}} {
+		if err := s.Put(kv.key, kv.value, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("job/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, path)
+	var v int
+	if ok, err := s.Get("job/a", &v); !ok || err != nil || v != 4 {
+		t.Errorf("job/a = %d, %v, %v after replay; want 4", v, ok, err)
+	}
+	if ok, _ := s.Get("job/b", &v); ok {
+		t.Error("deleted job/b came back after replay")
+	}
+	if keys := strings.Join(s.Keys("job/"), ","); keys != "job/a" {
+		t.Errorf("Keys(job/) = %s, want job/a", keys)
+	}
+}
+
+func TestKVStoreDropsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s := openTestStore(t, path)
+	if err := s.Put("a", "kept", true); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"k":"b","v":"cut sh`)
+	f.Close()
+
+	s = openTestStore(t, path)
+	if err := s.Put("c", "after", true); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestStore(t, path)
+	var v string
+	for key, want := range map[string]string{"a": "kept", "c": "after"} {
+		if ok, _ := s.Get(key, &v); !ok || v != want {
+			t.Errorf("%s = %q, %v; want %q", key, v, ok, want)
+		}
+	}
+	if ok, _ := s.Get("b", &v); ok {
+		t.Error("the torn record was replayed")
+	}
+}
+
+func TestKVStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s := openTestStore(t, path)
+	s.Put("other", "x", false)
+	for i := 0; i <= kvCompactAfter; i++ {
+		if err := s.Put("counter", i, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > 3 {
+		t.Errorf("log has %d lines after %d overwrites; want it compacted", lines, kvCompactAfter+1)
+	}
+
+	s = openTestStore(t, path)
+	var v int
+	if ok, _ := s.Get("counter", &v); !ok || v != kvCompactAfter {
+		t.Errorf("counter = %d, %v after compaction; want %d", v, ok, kvCompactAfter)
+	}
+	if keys := s.Keys(""); len(keys) != 2 {
+		t.Errorf("keys after compaction = %v, want counter and other", keys)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tempestBaseURL is where the Tempest API lives; tests point it at a fake.
+var tempestBaseURL = "https://us-central1-htempest-preproduction-prod.cloudfunctions.net/ImageApiProxy"
+
+// tempestPreviewQuery is sent with every preview request.
+const tempestPreviewQuery = "exifrotate=1&MaxSize=9999&ProofWatermark=FALSE&source=G&WithCrop=TRUE"
+
+// tempestRawPreviewQuery asks for the preview as stored, without EXIF
+// rotation or cropping, so both can be done locally.
+const tempestRawPreviewQuery = "exifrotate=0&MaxSize=9999&ProofWatermark=FALSE&source=G&WithCrop=FALSE"
+
+// tempestPreviewURL is the URL of the preview of photoId with the given
+// query.
+func tempestPreviewURL(photoId, query string) string {
+	return tempestBaseURL + "/image/" + url.PathEscape(photoId) + "/preview/?" + query
+}
+
+const tempestTimeout = 20 * time.Second
+
+// tempestParameters returns the query parameters sent with every preview
+// request.
+func tempestParameters() map[string]string {
+	values, _ := url.ParseQuery(tempestPreviewQuery)
+	params := make(map[string]string, len(values))
+	for k := range values {
+		params[k] = values.Get(k)
+	}
+	return params
+}
+
+// tempestError is an upstream failure already translated into the response
+// the proxy should send back to its own client.
+type tempestError struct {
+	Code    string
+	Message string
+	Details string
+	Status  int
+}
+
+func (e *tempestError) Error() string {
+	if e.Details == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Details
+}
+
+// errorResponseFor describes err as an ErrorResponse, falling back to a
+// generic 500 for errors that did not come from fetchTempestImage.
+func errorResponseFor(err error) ErrorResponse {
+	if te, ok := err.(*tempestError); ok {
+		return ErrorResponse{Error: te.Message, Code: te.Code, Details: te.Details, Status: te.Status}
+	}
+	return ErrorResponse{Error: "Internal error", Code: codeInternal, Details: err.Error(), Status: http.StatusInternalServerError}
+}
+
+// sendTempestError writes err using sendJSONError.
+func sendTempestError(w http.ResponseWriter, err error) {
+	e := errorResponseFor(err)
+	sendJSONError(w, e.Code, e.Error, e.Details, e.Status)
+}
+
+// fetchTempestImage requests the preview for photoId. It returns the upstream
+// response only when Tempest answered 200; the caller must close its body.
+// Every other outcome is returned as a *tempestError.
+func fetchTempestImage(ctx context.Context, photoId string) (*http.Response, error) {
+	return doTempestRequest(ctx, http.MethodGet, photoId, nil)
+}
+
+// fetchTempestRawImage is fetchTempestImage for the unrotated, uncropped
+// preview.
+func fetchTempestRawImage(ctx context.Context, photoId string) (*http.Response, error) {
+	return sendTempestRequest(ctx, http.MethodGet, tempestRawPreviewQuery, photoId, nil)
+}
+
+// fetchTempestRange requests part of the preview for photoId. Tempest may
+// ignore the range and answer 200 with the whole image.
+func fetchTempestRange(ctx context.Context, photoId string, rangeHeader string) (*http.Response, error) {
+	return doTempestRequest(ctx, http.MethodGet, photoId, http.Header{"Range": {rangeHeader}})
+}
+
+// tempestProbe is what Tempest told us about an image without sending it.
+type tempestProbe struct {
+	ContentType  string
+	Size         int64  // -1 when Tempest didn't say
+	ETag         string // "" unless Tempest sent usable validators
+	LastModified time.Time
+	Digest       []byte // nil unless Tempest sent one
+}
+
+// probeTempestImage checks that photoId exists and reports its type and size
+// without downloading it. HEAD is tried first; if Tempest doesn't support it,
+// a single-byte ranged GET is used instead.
+func probeTempestImage(ctx context.Context, photoId string) (*tempestProbe, error) {
+	resp, err := doTempestRequest(ctx, http.MethodHead, photoId, nil)
+	if te, ok := err.(*tempestError); ok && (te.Status == http.StatusMethodNotAllowed || te.Status == http.StatusNotImplemented) {
+		resp, err = doTempestRequest(ctx, http.MethodGet, photoId, http.Header{"Range": {"bytes=0-0"}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	probe := &tempestProbe{ContentType: resp.Header.Get("Content-Type"), Size: resp.ContentLength}
+	if resp.StatusCode == http.StatusPartialContent {
+		probe.Size = contentRangeTotal(resp.Header.Get("Content-Range"))
+	}
+	probe.ETag = upstreamETag(resp.Header, probe.Size)
+	probe.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	probe.Digest = upstreamDigest(resp)
+	return probe, nil
+}
+
+// contentRangeTotal returns the complete length from a Content-Range header
+// such as "bytes 0-0/12345", or -1 if it is unknown.
+func contentRangeTotal(contentRange string) int64 {
+	i := strings.LastIndexByte(contentRange, '/')
+	if i < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
+
+// doTempestRequest sends one request for the preview of photoId. Responses
+// other than 200 and 206 are closed and mapped with tempestStatusError.
+func doTempestRequest(ctx context.Context, method string, photoId string, header http.Header) (*http.Response, error) {
+	return sendTempestRequest(ctx, method, tempestPreviewQuery, photoId, header)
+}
+
+// sendTempestRequest is doTempestRequest for a preview query. The request
+// is built before the circuit breaker is asked, and once it has been let
+// through every outcome is reported back, so a probe is never lost.
+func sendTempestRequest(ctx context.Context, method string, query string, photoId string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, tempestPreviewURL(photoId, query), nil)
+	if err != nil {
+		logf("ERROR: Failed to create request for ID %s: %v", photoId, err)
+		return nil, &tempestError{codeInternal, "Request creation failed", fmt.Sprintf("Unable to create API request: %v", err), http.StatusInternalServerError}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	probe, err := tempestCircuit.allow()
+	if err != nil {
+		logf("CIRCUIT OPEN: Not requesting Tempest API for ID %s", photoId)
+		return nil, err
+	}
+
+	logf("Requesting Tempest API for ID: %s", photoId)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			// The caller gave up; that says nothing about Tempest.
+			tempestCircuit.abandon(probe)
+		} else {
+			tempestCircuit.record(probe, true, 0, err.Error())
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			logf("TIMEOUT: Tempest API request timed out for ID %s after 20s", photoId)
+			return nil, &tempestError{codeUpstreamTimeout, "Request timeout", "The image request took too long to process (>20s). The image may be very large.", http.StatusRequestTimeout}
+		}
+		logf("ERROR: Tempest API connection failed for ID %s: %v", photoId, err)
+		return nil, &tempestError{codeUpstreamConnection, "Connection failed", fmt.Sprintf("Unable to connect to Tempest API: %v", err), http.StatusInternalServerError}
+	}
+
+	logf("Tempest API response for ID %s: %d %s", photoId, resp.StatusCode, resp.Status)
+	// 501 only means HEAD isn't supported; probeTempestImage falls back.
+	tempestCircuit.record(probe, resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented, resp.StatusCode, resp.Status)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, tempestStatusError(photoId, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// tempestStatusError maps a non-200 Tempest status onto the error the proxy
+// reports for it.
+func tempestStatusError(photoId string, statusCode int) *tempestError {
+	if statusCode == 204 {
+		logf("NOT FOUND: Image ID %s not found in Tempest", photoId)
+		return &tempestError{codeImageNotFound, "Image not found", fmt.Sprintf("The image ID '%s' was not found in the Tempest system", photoId), http.StatusNotFound}
+	}
+	switch statusCode {
+	case http.StatusForbidden:
+		logf("FORBIDDEN: Access denied for image ID %s", photoId)
+		return &tempestError{codeAccessDenied, "Access denied", fmt.Sprintf("You don't have permission to access image '%s'", photoId), http.StatusForbidden}
+
+	case http.StatusUnauthorized:
+		logf("UNAUTHORIZED: Authentication required for image ID %s", photoId)
+		return &tempestError{codeAuthRequired, "Authentication required", "The request requires valid authentication credentials", http.StatusUnauthorized}
+
+	case http.StatusInternalServerError:
+		logf("SERVER ERROR: Tempest API internal error for image ID %s", photoId)
+		return &tempestError{codeUpstreamError, "Tempest API error", "The upstream image service is currently experiencing issues", http.StatusInternalServerError}
+
+	case http.StatusServiceUnavailable:
+		logf("UNAVAILABLE: Tempest API service unavailable for image ID %s", photoId)
+		return &tempestError{codeUpstreamUnavailable, "Service unavailable", "The Tempest API is temporarily unavailable. Please try again later.", http.StatusServiceUnavailable}
+
+	default:
+		logf("UNEXPECTED: Tempest API returned %d for image ID %s", statusCode, photoId)
+		return &tempestError{codeUpstreamUnexpected, "Unexpected error", fmt.Sprintf("Tempest API returned status %d", statusCode), statusCode}
+	}
+}
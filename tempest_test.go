@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeTempest serves files as Tempest previews for one test, answering 204
+// for IDs it doesn't have, with a fresh image cache and digest index and a
+// closed circuit.
+func fakeTempest(t *testing.T, files map[string][]byte) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/image/"), "/preview/")
+		data, ok := files[id]
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+		w.Write(data)
+	}))
+	oldBase, oldImages, oldDigests := tempestBaseURL, images, upstreamDigests
+	tempestBaseURL = srv.URL
+	images = newImageCache(imageCacheMaxBytes, imageCacheTTL)
+	upstreamDigests = &digestIndex{items: make(map[string]knownDigest)}
+	tempestCircuit = circuitBreaker{}
+	t.Cleanup(func() {
+		srv.Close()
+		tempestBaseURL, images, upstreamDigests = oldBase, oldImages, oldDigests
+		tempestCircuit = circuitBreaker{}
+	})
+	return srv
+}
+
+func TestTempestRequestEscapesID(t *testing.T) {
+	var gotPath string
+	srv := fakeTempest(t, nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte{0xff, 0xd8, 0xff})
+	})
+
+	resp, err := fetchTempestImage(context.Background(), "a%zz/b?c")
+	if err != nil {
+		t.Fatalf("fetchTempestImage: %v", err)
+	}
+	resp.Body.Close()
+	if want := "/image/a%25zz%2Fb%3Fc/preview/"; gotPath != want {
+		t.Errorf("Tempest was asked for %q, want %q", gotPath, want)
+	}
+}
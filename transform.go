@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxRenderDimension = 8192
+	defaultJPEGQuality = 85
+)
+
+// renderOptions are the optional w, h, fit, format, q, raw, orient, crop and
+// watermark parameters of /fetch-photo. The zero value means "serve the
+// original".
+type renderOptions struct {
+	Width   int
+	Height  int
+	Fit     string // "contain" (default), "cover", or "fill" to stretch to exactly Width×Height
+	Format  string // "jpeg", "png", "gif", or "" to keep the original's
+	Quality int    // JPEG quality, 0 for the default
+
+	// Raw starts from the preview as stored rather than the one Tempest has
+	// rotated and cropped. Its EXIF orientation is then applied locally
+	// unless KeepOrientation is set.
+	Raw             bool
+	KeepOrientation bool
+	Crop            image.Rectangle // in pixels of the upright image; empty for none
+
+	// Watermark composites studioMark onto the result.
+	Watermark bool
+}
+
+func invalidParameterError(details string) *tempestError {
+	return &tempestError{codeInvalidParameter, "Invalid parameter", details, http.StatusBadRequest}
+}
+
+func parseDimension(q url.Values, name string) (int, error) {
+	s := q.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxRenderDimension {
+		return 0, invalidParameterError(fmt.Sprintf("%s must be a whole number of pixels between 1 and %d", name, maxRenderDimension))
+	}
+	return n, nil
+}
+
+// parseRenderOptions reads the rendering parameters from a query string.
+func parseRenderOptions(q url.Values) (renderOptions, error) {
+	var o renderOptions
+	var err error
+	if o.Width, err = parseDimension(q, "w"); err != nil {
+		return o, err
+	}
+	if o.Height, err = parseDimension(q, "h"); err != nil {
+		return o, err
+	}
+
+	switch fit := q.Get("fit"); fit {
+	case "", "contain", "cover":
+		o.Fit = fit
+	default:
+		return o, invalidParameterError("fit must be contain or cover")
+	}
+
+	switch format := q.Get("format"); format {
+	case "":
+	case "jpeg", "jpg":
+		o.Format = "jpeg"
+	case "png", "gif":
+		o.Format = format
+	default:
+		return o, invalidParameterError("format must be jpeg, png or gif")
+	}
+
+	if s := q.Get("q"); s != "" {
+		o.Quality, err = strconv.Atoi(s)
+		if err != nil || o.Quality < 1 || o.Quality > 100 {
+			return o, invalidParameterError("q must be a whole number between 1 and 100")
+		}
+	}
+
+	if s := q.Get("raw"); s != "" {
+		if o.Raw, err = strconv.ParseBool(s); err != nil {
+			return o, invalidParameterError("raw must be true or false")
+		}
+	}
+	switch orient := q.Get("orient"); orient {
+	case "", "auto":
+	case "none":
+		o.KeepOrientation = true
+	default:
+		return o, invalidParameterError("orient must be auto or none")
+	}
+	if s := q.Get("crop"); s != "" {
+		if o.Crop, err = parseCrop(s); err != nil {
+			return o, err
+		}
+	}
+	if s := q.Get("watermark"); s != "" {
+		if o.Watermark, err = strconv.ParseBool(s); err != nil {
+			return o, invalidParameterError("watermark must be true or false")
+		}
+		if o.Watermark && studioMark == nil {
+			return o, invalidParameterError("watermark needs the server to be started with -watermark-logo or -watermark-text")
+		}
+	}
+	return o, nil
+}
+
+// parseCrop reads a crop rectangle written as x,y,width,height.
+func parseCrop(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, invalidParameterError("crop must be x,y,width,height")
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 || (i >= 2 && n < 1) {
+			return image.Rectangle{}, invalidParameterError("crop must be x,y,width,height in whole pixels, with a non-zero width and height")
+		}
+		v[i] = n
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+func (o renderOptions) isZero() bool {
+	return o == renderOptions{}
+}
+
+// orientation is the EXIF orientation to correct in source, which is 1 unless
+// the raw preview is being turned upright locally.
+func (o renderOptions) orientation(source *cacheEntry) int {
+	if !o.Raw || o.KeepOrientation {
+		return 1
+	}
+	return exifOrientation(source.Data)
+}
+
+// passesThrough reports whether source can be served as it is.
+func (o renderOptions) passesThrough(source *cacheEntry) bool {
+	p := o
+	p.Raw, p.KeepOrientation = false, false
+	return p.isZero() && o.orientation(source) == 1
+}
+
+// cacheKey is the cache key of this variant of photoId.
+func (o renderOptions) cacheKey(photoId string) string {
+	key := fmt.Sprintf("%s|w=%d|h=%d|fit=%s|format=%s|q=%d", photoId, o.Width, o.Height, o.Fit, o.Format, o.Quality)
+	if o.Raw {
+		key += fmt.Sprintf("|raw|keep=%t", o.KeepOrientation)
+	}
+	if !o.Crop.Empty() {
+		key += fmt.Sprintf("|crop=%d,%d,%d,%d", o.Crop.Min.X, o.Crop.Min.Y, o.Crop.Dx(), o.Crop.Dy())
+	}
+	if o.Watermark {
+		key += "|watermark"
+	}
+	return key
+}
+
+// outputFormat picks the encoder for a variant of an image of the given
+// content type.
+func (o renderOptions) outputFormat(contentType string) string {
+	if o.Format != "" {
+		return o.Format
+	}
+	switch normalizeImageType(contentType) {
+	case "image/png":
+		return "png"
+	case "image/gif":
+		return "gif"
+	}
+	return "jpeg"
+}
+
+// layout works out which part of a sw×sh source to use and how large the
+// result should be. Images are never enlarged, except by fill, which only
+// IIIF requests use.
+func (o renderOptions) layout(sw, sh int) (crop image.Rectangle, dw, dh int) {
+	crop = image.Rect(0, 0, sw, sh)
+	if o.Width == 0 && o.Height == 0 {
+		return crop, sw, sh
+	}
+	if o.Fit == "fill" {
+		return crop, o.Width, o.Height
+	}
+
+	if o.Fit == "cover" && o.Width > 0 && o.Height > 0 {
+		// Cut the largest centred region with the requested aspect ratio.
+		cw, ch := sw, int(math.Round(float64(sw)*float64(o.Height)/float64(o.Width)))
+		if ch > sh {
+			cw, ch = int(math.Round(float64(sh)*float64(o.Width)/float64(o.Height))), sh
+		}
+		x0, y0 := (sw-cw)/2, (sh-ch)/2
+		crop = image.Rect(x0, y0, x0+cw, y0+ch)
+		scale := math.Min(1, float64(cw)/float64(o.Width))
+		return crop, maxInt(1, int(math.Round(float64(o.Width)*scale))), maxInt(1, int(math.Round(float64(o.Height)*scale)))
+	}
+
+	scale := 1.0
+	if o.Width > 0 {
+		scale = math.Min(scale, float64(o.Width)/float64(sw))
+	}
+	if o.Height > 0 {
+		scale = math.Min(scale, float64(o.Height)/float64(sh))
+	}
+	return crop, maxInt(1, int(math.Round(float64(sw)*scale))), maxInt(1, int(math.Round(float64(sh)*scale)))
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// renderImage decodes original, turns it upright, crops, resizes,
+// watermarks and re-encodes it as o asks.
+func renderImage(photoId string, original *cacheEntry, o renderOptions) (*cacheEntry, error) {
+	if o.Watermark && studioMark == nil {
+		return nil, watermarkUnavailableError()
+	}
+	img, release, err := renderPixels(photoId, original, o)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if o.Watermark {
+		studioMark.draw(img)
+	}
+
+	format := o.outputFormat(original.ContentType)
+	data, err := encodeImage(img, format, o.Quality)
+	if err != nil {
+		return nil, &tempestError{codeInternal, "Encoding failed", fmt.Sprintf("Unable to encode the image as %s: %v", format, err), http.StatusInternalServerError}
+	}
+
+	return &cacheEntry{
+		ContentType:     "image/" + format,
+		Data:            data,
+		FetchedAt:       time.Now(),
+		UpstreamLatency: original.UpstreamLatency,
+		ETag:            contentETag(data),
+		LastModified:    original.LastModified,
+		Digest:          contentDigest(data),
+	}, nil
+}
+
+// renderPixels decodes original, turns it upright, crops and resizes it as
+// o asks. The memory it used stays reserved until release is called.
+func renderPixels(photoId string, original *cacheEntry, o renderOptions) (img *image.RGBA, release func(), err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(original.Data))
+	if err != nil {
+		return nil, nil, &tempestError{codeUnsupportedImage, "Unsupported image", fmt.Sprintf("The %s image can't be processed: %v", normalizeImageType(original.ContentType), err), http.StatusUnprocessableEntity}
+	}
+
+	orientation := o.orientation(original)
+	uw, uh := orientedSize(cfg.Width, cfg.Height, orientation)
+	region := image.Rect(0, 0, uw, uh)
+	if !o.Crop.Empty() {
+		if !o.Crop.In(region) {
+			return nil, nil, invalidParameterError(fmt.Sprintf("crop must lie within the %dx%d image", uw, uh))
+		}
+		region = o.Crop
+	}
+	crop, dw, dh := o.layout(region.Dx(), region.Dy())
+	crop = crop.Add(region.Min)
+
+	// Account for the decoded source, the upright copy and the resized copy.
+	need := int64(cfg.Width)*int64(cfg.Height)*4 + int64(dw)*int64(dh)*4
+	if orientation != 1 {
+		need += int64(uw) * int64(uh) * 4
+	}
+	if !inflight.reserve(need) {
+		return nil, nil, memoryBudgetError()
+	}
+	release = func() { inflight.release(need) }
+
+	src, _, err := decodeImage(photoId, original.Data)
+	if err != nil {
+		release()
+		if te, ok := err.(*tempestError); ok {
+			return nil, nil, te
+		}
+		return nil, nil, &tempestError{codeUnsupportedImage, "Unsupported image", fmt.Sprintf("The %s image can't be processed: %v", normalizeImageType(original.ContentType), err), http.StatusUnprocessableEntity}
+	}
+	src = applyOrientation(src, orientation)
+	if crop != src.Bounds().Sub(src.Bounds().Min) {
+		src = toRGBA(src).SubImage(crop)
+	}
+	return resample(src, dw, dh), release, nil
+}
+
+// encodeImage encodes img in one of the supported output formats. JPEG has no
+// transparency, so transparent pixels are flattened onto white.
+func encodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		if quality == 0 {
+			quality = defaultJPEGQuality
+		}
+		if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			flat := image.NewRGBA(img.Bounds())
+			draw.Draw(flat, flat.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+			draw.Draw(flat, flat.Rect, img, img.Bounds().Min, draw.Over)
+			img = flat
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	}
+	return buf.Bytes(), err
+}
+
+// serveRendered serves photoId as o and the Accept header ask, rendering a
+// variant from the original and caching it on first use.
+func serveRendered(w http.ResponseWriter, r *http.Request, photoId string, o renderOptions) {
+	if o.Format != "" {
+		key := o.cacheKey(photoId)
+		if entry, ok := images.Get(key); ok {
+			logf("CACHE HIT: Serving variant %s (%d bytes) to %s", key, len(entry.Data), r.RemoteAddr)
+			serveImageEntry(w, r, entry, true)
+			return
+		}
+	}
+
+	load := loadImage
+	if o.Raw {
+		load = loadRawImage
+	}
+	original, hit, err := load(r.Context(), photoId)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	serveVariant(w, r, photoId, original, hit, o)
+}
+
+// serveVariant serves original itself, or the variant of it that o and the
+// Accept header call for. original is the raw preview when o.Raw is set.
+func serveVariant(w http.ResponseWriter, r *http.Request, photoId string, original *cacheEntry, hit bool, o renderOptions) {
+	accept := r.Header.Get("Accept")
+	requested := o
+	sourceKey := photoId
+	if o.Raw {
+		sourceKey = rawCacheKey(photoId)
+	}
+	o = negotiatedOptions(accept, original, o)
+	if o.passesThrough(original) {
+		serveImageEntry(w, r, sanitizedEntry(sourceKey, original), hit)
+		return
+	}
+
+	key := o.cacheKey(photoId)
+	if entry, ok := images.Get(key); ok {
+		logf("CACHE HIT: Serving variant %s (%d bytes) to %s", key, len(entry.Data), r.RemoteAddr)
+		serveImageEntry(w, r, entry, true)
+		return
+	}
+
+	entry, err := renderImage(photoId, original, o)
+	if err != nil {
+		sendTempestError(w, err)
+		return
+	}
+	// A conversion the client didn't ask for is only worth it if it saves
+	// bytes; otherwise remember to send the original.
+	if requested.passesThrough(original) && len(entry.Data) >= len(original.Data) && acceptQuality(accept, normalizeImageType(original.ContentType)) > 0 {
+		entry = sanitizedEntry(sourceKey, original)
+	}
+	images.Put(key, entry)
+
+	logf("SUCCESS: Serving variant %s (%d bytes) to %s", key, len(entry.Data), r.RemoteAddr)
+	serveImageEntry(w, r, entry, false)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is how much of a body http.DetectContentType looks at.
+const sniffLen = 512
+
+func invalidImageError(photoId string, details string) *tempestError {
+	logf("INVALID IMAGE: Tempest returned a bad image for ID %s: %s", photoId, details)
+	return &tempestError{codeUpstreamInvalidImage, "Invalid image from Tempest", details, http.StatusBadGateway}
+}
+
+// normalizeImageType reduces a Content-Type header to its media type,
+// folding the non-standard JPEG spellings into image/jpeg.
+func normalizeImageType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "image/jpg", "image/pjpeg":
+		return "image/jpeg"
+	}
+	return mediaType
+}
+
+// checkDeclaredType rejects a Content-Type that can't be an image, without
+// looking at the body.
+func checkDeclaredType(photoId string, declared string) error {
+	mediaType := normalizeImageType(declared)
+	if mediaType == "" || mediaType == "application/octet-stream" || strings.HasPrefix(mediaType, "image/") {
+		return nil
+	}
+	return invalidImageError(photoId, fmt.Sprintf("Tempest declared %s instead of an image", mediaType))
+}
+
+// checkImageType sniffs the start of a body and compares it with the
+// declared Content-Type. It returns the content type to serve: the declared
+// one, or the sniffed one when Tempest didn't declare anything specific.
+// The sniffer only knows a few image formats, so a declared image type it
+// can't recognise, such as image/tiff, is taken on trust.
+func checkImageType(photoId string, declared string, head []byte) (string, error) {
+	mediaType := normalizeImageType(declared)
+	sniffed := http.DetectContentType(head)
+	if !strings.HasPrefix(sniffed, "image/") {
+		if sniffed == "application/octet-stream" && strings.HasPrefix(mediaType, "image/") {
+			return declared, nil
+		}
+		sniffedType, _, _ := mime.ParseMediaType(sniffed)
+		return "", invalidImageError(photoId, fmt.Sprintf("Tempest sent %s content instead of an image", sniffedType))
+	}
+
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		return sniffed, nil
+	}
+	if mediaType != sniffed {
+		return "", invalidImageError(photoId, fmt.Sprintf("Tempest declared %s but sent %s", mediaType, sniffed))
+	}
+	return declared, nil
+}
+
+// checkImageBody validates a complete upstream body: its type, its length
+// against Content-Length and, with -verify-decode, that it decodes. It
+// returns the content type to serve.
+func checkImageBody(photoId string, header http.Header, declaredLength int64, data []byte) (string, error) {
+	head := data
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	contentType, err := checkImageType(photoId, header.Get("Content-Type"), head)
+	if err != nil {
+		return "", err
+	}
+
+	if declaredLength >= 0 && int64(len(data)) != declaredLength {
+		return "", invalidImageError(photoId, fmt.Sprintf("Tempest declared %d bytes but sent %d", declaredLength, len(data)))
+	}
+
+	if *verifyDecode && canDecode(contentType) {
+		if _, _, err := decodeImage(photoId, data); err != nil {
+			if _, ok := err.(*tempestError); ok {
+				return "", err
+			}
+			return "", invalidImageError(photoId, fmt.Sprintf("The %s image could not be decoded: %v", normalizeImageType(contentType), err))
+		}
+	}
+	return contentType, nil
+}
+
+// canDecode reports whether an image decoder is registered for contentType.
+func canDecode(contentType string) bool {
+	switch normalizeImageType(contentType) {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCheckImageType(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	html := []byte("<!DOCTYPE html><html></html>")
+	tests := []struct {
+		declared string
+		head     []byte
+		want     string
+		ok       bool
+	}{
+		{"image/jpeg", jpeg, "image/jpeg", true},
+		{"image/jpg", jpeg, "image/jpg", true},
+		{"", jpeg, "image/jpeg", true},
+		{"application/octet-stream", jpeg, "image/jpeg", true},
+		{"image/png", jpeg, "", false},
+		{"image/tiff", tiff, "image/tiff", true},
+		{"", tiff, "", false},
+		{"application/octet-stream", tiff, "", false},
+		{"image/jpeg", html, "", false},
+	}
+	for _, tt := range tests {
+		got, err := checkImageType("1", tt.declared, tt.head)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("checkImageType(%q, %q) = %q, %v; want %q, ok %v", tt.declared, tt.head, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+)
+
+// watermarkPositions are the places -watermark-position can put the mark.
+var watermarkPositions = map[string]bool{
+	"top-left": true, "top": true, "top-right": true,
+	"left": true, "center": true, "right": true,
+	"bottom-left": true, "bottom": true, "bottom-right": true,
+}
+
+// watermark is the studio mark composited onto images that ask for it:
+// either a PNG logo or a line of text.
+type watermark struct {
+	logo     *image.RGBA // nil for a text mark
+	text     string
+	position string
+	opacity  float64
+	scale    float64 // width of the mark as a fraction of the image width
+}
+
+// studioMark is the configured watermark, or nil when there is none.
+var studioMark *watermark
+
+// watermarkUnavailableError is the error for an image that must be
+// watermarked, e.g. by a share link minted while the server had a watermark,
+// when studioMark is nil. Such images are never served unmarked.
+func watermarkUnavailableError() *tempestError {
+	return &tempestError{codeWatermarkUnavailable, "Watermark unavailable", "The image must be watermarked, but the server has neither -watermark-logo nor -watermark-text", http.StatusInternalServerError}
+}
+
+// loadWatermark builds the watermark from the command line settings. It
+// returns nil if neither a logo nor text was given.
+func loadWatermark(logoPath, text, position string, opacity, scale float64) (*watermark, error) {
+	if logoPath == "" && text == "" {
+		return nil, nil
+	}
+	if logoPath != "" && text != "" {
+		return nil, fmt.Errorf("give either -watermark-logo or -watermark-text, not both")
+	}
+	if !watermarkPositions[position] {
+		return nil, fmt.Errorf("-watermark-position must be top-left, top, top-right, left, center, right, bottom-left, bottom or bottom-right")
+	}
+	if opacity <= 0 || opacity > 1 {
+		return nil, fmt.Errorf("-watermark-opacity must be more than 0 and at most 1")
+	}
+	if scale <= 0 || scale > 1 {
+		return nil, fmt.Errorf("-watermark-scale must be more than 0 and at most 1")
+	}
+
+	m := &watermark{text: text, position: position, opacity: opacity, scale: scale}
+	if logoPath != "" {
+		f, err := os.Open(logoPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		logo, err := png.Decode(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", logoPath, err)
+		}
+		m.logo = toRGBA(logo)
+	}
+	return m, nil
+}
+
+// String describes the mark for the startup log.
+func (m *watermark) String() string {
+	what := fmt.Sprintf("text %q", m.text)
+	if m.logo != nil {
+		what = fmt.Sprintf("%dx%d logo", m.logo.Rect.Dx(), m.logo.Rect.Dy())
+	}
+	return fmt.Sprintf("%s at %s, %.0f%% opaque, %.0f%% of the image width", what, m.position, m.opacity*100, m.scale*100)
+}
+
+// render draws the mark about width pixels wide.
+func (m *watermark) render(width int) *image.RGBA {
+	if m.logo != nil {
+		lw, lh := m.logo.Rect.Dx(), m.logo.Rect.Dy()
+		height := maxInt(1, int(math.Round(float64(lh)*float64(width)/float64(lw))))
+		return resample(m.logo, width, height)
+	}
+
+	// Text can only be drawn at whole multiples of the font size, with a
+	// shadow so it shows on light and dark images alike.
+	scale := maxInt(1, width/textWidth(m.text, 1))
+	shadow := maxInt(1, scale/2)
+	mark := image.NewRGBA(image.Rect(0, 0, textWidth(m.text, scale)+shadow, glyphHeight*scale+shadow))
+	drawText(mark, shadow, shadow, m.text, scale, color.RGBA{0, 0, 0, 0xff})
+	drawText(mark, 0, 0, m.text, scale, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	return mark
+}
+
+// draw composites the mark onto dst.
+func (m *watermark) draw(dst *image.RGBA) {
+	dw, dh := dst.Rect.Dx(), dst.Rect.Dy()
+	margin := maxInt(2, minInt(dw, dh)/40)
+	width := int(math.Round(float64(dw) * m.scale))
+	if width < 1 || dw <= 2*margin || dh <= 2*margin {
+		return
+	}
+	mark := m.render(width)
+	mw, mh := mark.Rect.Dx(), mark.Rect.Dy()
+
+	x, y := (dw-mw)/2, (dh-mh)/2
+	switch m.position {
+	case "top-left", "left", "bottom-left":
+		x = margin
+	case "top-right", "right", "bottom-right":
+		x = dw - margin - mw
+	}
+	switch m.position {
+	case "top-left", "top", "top-right":
+		y = margin
+	case "bottom-left", "bottom", "bottom-right":
+		y = dh - margin - mh
+	}
+
+	at := dst.Rect.Min.Add(image.Pt(x, y))
+	alpha := image.NewUniform(color.Alpha{uint8(math.Round(m.opacity * 255))})
+	draw.DrawMask(dst, image.Rectangle{at, at.Add(image.Pt(mw, mh))}, mark, image.Point{}, alpha, image.Point{}, draw.Over)
+}
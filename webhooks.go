@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Events webhooks can subscribe to. ping is sent only on request, to every
+// webhook.
+const (
+	eventJobCompleted   = "job.completed"
+	eventJobFailed      = "job.failed"
+	eventCircuitOpened  = "circuit.opened"
+	eventCircuitClosed  = "circuit.closed"
+	eventUpstreamErrors = "upstream.errors"
+	eventPing           = "ping"
+)
+
+var webhookEvents = []string{eventJobCompleted, eventJobFailed, eventCircuitOpened, eventCircuitClosed, eventUpstreamErrors}
+
+// webhookPaths are the OpenAPI paths served under /api/v1/webhooks/.
+var webhookPaths = []string{"/api/v1/webhooks/deliveries", "/api/v1/webhooks/ping"}
+
+// webhookRetries are the waits before each retry of a failed delivery.
+// A delivery is given up once they have all been used.
+var webhookRetries = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour}
+
+const (
+	webhookTimeout = 10 * time.Second
+	// webhookLogRetention is how long finished deliveries stay in the log.
+	webhookLogRetention = 7 * 24 * time.Hour
+	// webhookSignatureTolerance is how far a signature's timestamp may be
+	// from the receiver's clock, to stop old deliveries being replayed.
+	webhookSignatureTolerance = 5 * time.Minute
+)
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhook is an endpoint told about events.
+type webhook struct {
+	URL     string
+	Secrets [][]byte // newest first; every one signs each delivery
+	Events  []string // every event when empty
+}
+
+func (h webhook) wants(event string) bool {
+	return event == eventPing || len(h.Events) == 0 || containsString(h.Events, event)
+}
+
+// webhooks are read from -webhooks-file at startup.
+var webhooks []webhook
+
+// webhookLog keeps every delivery, so pending ones are retried after a
+// restart.
+var webhookLog *kvStore
+
+// loadWebhooks reads one "url secret [event...]" per line, skipping blank
+// lines and # comments. While a secret is being rotated the line can list
+// the new and old ones separated by a comma: deliveries are signed with
+// both until the old one is removed.
+func loadWebhooks(path string) ([]webhook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hooks []webhook
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want a URL and a secret", line)
+		}
+		u, err := url.Parse(fields[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("line %d: %q is not an http or https URL", line, fields[0])
+		}
+		var secrets [][]byte
+		for _, secret := range strings.Split(fields[1], ",") {
+			if len(secret) < 16 {
+				return nil, fmt.Errorf("line %d: secrets must be at least 16 characters long", line)
+			}
+			secrets = append(secrets, []byte(secret))
+		}
+		for _, event := range fields[2:] {
+			if !containsString(webhookEvents, event) {
+				return nil, fmt.Errorf("line %d: unknown event %q; events are %s", line, event, strings.Join(webhookEvents, ", "))
+			}
+		}
+		hooks = append(hooks, webhook{URL: fields[0], Secrets: secrets, Events: fields[2:]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(hooks) == 0 {
+		return nil, fmt.Errorf("%s has no webhooks", path)
+	}
+	return hooks, nil
+}
+
+// WebhookEvent is the body of every webhook delivery.
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is one event sent to one webhook, as kept in the delivery
+// log.
+type WebhookDelivery struct {
+	ID          string           `json:"id"`
+	Event       string           `json:"event"`
+	URL         string           `json:"url"`
+	Webhook     int              `json:"webhook"` // index in webhooks, as several may share a URL
+	State       string           `json:"state"`
+	CreatedAt   time.Time        `json:"created_at"`
+	NextAttempt *time.Time       `json:"next_attempt,omitempty"`
+	Attempts    []WebhookAttempt `json:"attempts"`
+	Payload     json.RawMessage  `json:"payload"`
+}
+
+// WebhookAttempt is one try at sending a WebhookDelivery.
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deliveryKey is the key of d in webhookLog. Keys sort by creation time.
+func deliveryKey(d *WebhookDelivery) string {
+	return fmt.Sprintf("delivery/%019d/%s", d.CreatedAt.UnixNano(), d.ID)
+}
+
+// notifyWebhooks sends an event to every webhook that wants it, returning
+// the deliveries it queued. Deliveries are saved before they are attempted
+// and carry on in the background.
+func notifyWebhooks(event string, data interface{}) []WebhookDelivery {
+	if len(webhooks) == 0 {
+		return nil
+	}
+	e := WebhookEvent{ID: "evt_" + randomHex(12), Type: event, CreatedAt: time.Now().UTC(), Data: data}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logf("ERROR: Unable to encode %s event: %v", event, err)
+		return nil
+	}
+
+	var queued []WebhookDelivery
+	for i, h := range webhooks {
+		if !h.wants(event) {
+			continue
+		}
+		d := &WebhookDelivery{ID: "dlv_" + randomHex(12), Event: event, URL: h.URL, Webhook: i, State: deliveryPending, CreatedAt: e.CreatedAt, Attempts: []WebhookAttempt{}, Payload: payload}
+		d.NextAttempt = &d.CreatedAt
+		saveDelivery(d)
+		queued = append(queued, *d)
+		go deliverWebhook(d)
+	}
+	return queued
+}
+
+func saveDelivery(d *WebhookDelivery) {
+	if err := webhookLog.Put(deliveryKey(d), d, true); err != nil {
+		logf("ERROR: Unable to save webhook delivery %s: %v", d.ID, err)
+	}
+}
+
+// deliverWebhook sends d until it succeeds or its retries run out, saving
+// each attempt.
+func deliverWebhook(d *WebhookDelivery) {
+	for d.State == deliveryPending {
+		if wait := time.Until(*d.NextAttempt); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		// The URL check catches -webhooks-file having been edited since
+		// the delivery was queued.
+		var hook *webhook
+		if d.Webhook < len(webhooks) && webhooks[d.Webhook].URL == d.URL {
+			hook = &webhooks[d.Webhook]
+		}
+		if hook == nil {
+			d.State, d.NextAttempt = deliveryFailed, nil
+			d.Attempts = append(d.Attempts, WebhookAttempt{At: time.Now().UTC(), Error: "the webhook is no longer in -webhooks-file"})
+			saveDelivery(d)
+			break
+		}
+
+		attempt := sendWebhook(*hook, d)
+		d.Attempts = append(d.Attempts, attempt)
+		switch {
+		case attempt.Error == "":
+			d.State, d.NextAttempt = deliveryDelivered, nil
+			logf("WEBHOOK: Delivered %s %s to %s", d.Event, d.ID, d.URL)
+		case len(d.Attempts) > len(webhookRetries):
+			d.State, d.NextAttempt = deliveryFailed, nil
+			logf("WEBHOOK: Gave up on %s %s to %s after %d attempts: %s", d.Event, d.ID, d.URL, len(d.Attempts), attempt.Error)
+		default:
+			next := time.Now().Add(webhookRetries[len(d.Attempts)-1]).UTC()
+			d.NextAttempt = &next
+			logf("WEBHOOK: Delivering %s %s to %s failed (%s); retrying at %s", d.Event, d.ID, d.URL, attempt.Error, next.Format(time.RFC3339))
+		}
+		saveDelivery(d)
+	}
+}
+
+// signWebhook computes the X-Webhook-Signature header for body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">", with one v1 per
+// secret. Signing the time lets receivers reject replayed deliveries.
+func signWebhook(secrets [][]byte, t time.Time, body []byte) string {
+	header := fmt.Sprintf("t=%d", t.Unix())
+	for _, secret := range secrets {
+		header += ",v1=" + webhookMAC(secret, t, body)
+	}
+	return header
+}
+
+// webhookMAC is the hex HMAC-SHA256 of "<t>.<body>".
+func webhookMAC(secret []byte, t time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", t.Unix())
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhook checks an X-Webhook-Signature header against body as a
+// receiver would. Any one v1 signature made with secret will do.
+func verifyWebhook(secret []byte, header string, body []byte, now time.Time) error {
+	var t int64 = -1
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			t, _ = strconv.ParseInt(v, 10, 64)
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	if t < 0 || len(sigs) == 0 {
+		return fmt.Errorf("malformed signature header %q", header)
+	}
+	sent := time.Unix(t, 0)
+	if d := now.Sub(sent); d > webhookSignatureTolerance || d < -webhookSignatureTolerance {
+		return fmt.Errorf("signed at %s, more than %s from now", sent.UTC().Format(time.RFC3339), webhookSignatureTolerance)
+	}
+	want := webhookMAC(secret, sent, body)
+	for _, sig := range sigs {
+		if hmac.Equal([]byte(sig), []byte(want)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature doesn't match")
+}
+
+// sendWebhook makes one attempt at delivering d to h. Any 2xx response
+// counts as delivered.
+func sendWebhook(h webhook, d *WebhookDelivery) WebhookAttempt {
+	start := time.Now()
+	attempt := WebhookAttempt{At: start.UTC()}
+
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tempest-image-finder-webhooks")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID)
+	req.Header.Set("X-Webhook-Signature", signWebhook(h.Secrets, start, d.Payload))
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	attempt.Status = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = resp.Status
+	}
+	return attempt
+}
+
+// resumeWebhookDeliveries carries on with the deliveries that were pending
+// when the server stopped.
+func resumeWebhookDeliveries() error {
+	for _, key := range webhookLog.Keys("delivery/") {
+		var d WebhookDelivery
+		if _, err := webhookLog.Get(key, &d); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if d.State == deliveryPending {
+			if d.NextAttempt == nil {
+				d.NextAttempt = &d.CreatedAt
+			}
+			go deliverWebhook(&d)
+		}
+	}
+	return nil
+}
+
+// pruneWebhookLogEvery deletes finished deliveries older than
+// webhookLogRetention now and then once every interval.
+func pruneWebhookLogEvery(interval time.Duration) {
+	for {
+		for _, key := range webhookLog.Keys("delivery/") {
+			var d WebhookDelivery
+			if _, err := webhookLog.Get(key, &d); err != nil || d.State == deliveryPending {
+				continue
+			}
+			if time.Since(d.CreatedAt) > webhookLogRetention {
+				webhookLog.Delete(key)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// handleWebhooks serves GET /api/v1/webhooks/deliveries, the delivery log,
+// newest first, and POST /api/v1/webhooks/ping, which sends a ping event to
+// every webhook. Both need an API key.
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.URL.Path, "/api/v1/webhooks/")
+
+	logf("%s /api/v1/webhooks/%s - Client: %s", r.Method, action, r.RemoteAddr)
+
+	var method string
+	switch action {
+	case "deliveries":
+		method = http.MethodGet
+	case "ping":
+		method = http.MethodPost
+	default:
+		sendJSONError(w, codeUnknownEndpoint, "Not found", fmt.Sprintf("Unknown endpoint %s", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	if r.Method != method && !(method == http.MethodGet && r.Method == http.MethodHead) {
+		sendJSONError(w, codeMethodNotAllowed, "Method not allowed", fmt.Sprintf("%s is not supported on this endpoint", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := requireAPIKey(w, r); !ok {
+		return
+	}
+	if len(webhooks) == 0 {
+		sendJSONError(w, codeWebhooksNotConfigured, "Webhooks not configured", "This server has no webhooks; start it with -webhooks-file to use this endpoint", http.StatusConflict)
+		return
+	}
+
+	if action == "ping" {
+		sendJSON(w, notifyWebhooks(eventPing, map[string]interface{}{}), http.StatusAccepted)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 50
+	if s := q.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > 500 {
+			sendTempestError(w, invalidParameterError("limit must be a whole number between 1 and 500"))
+			return
+		}
+	}
+	state := q.Get("state")
+	if state != "" && state != deliveryPending && state != deliveryDelivered && state != deliveryFailed {
+		sendTempestError(w, invalidParameterError("state must be pending, delivered or failed"))
+		return
+	}
+
+	keys := webhookLog.Keys("delivery/")
+	deliveries := []WebhookDelivery{}
+	for i := len(keys) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		var d WebhookDelivery
+		if _, err := webhookLog.Get(keys[i], &d); err != nil {
+			continue
+		}
+		if state == "" || d.State == state {
+			deliveries = append(deliveries, d)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSON(w, deliveries, http.StatusOK)
+}
+
+// runWebhookReceiver is the webhook-receiver subcommand: a local endpoint
+// that checks the signature of every delivery and prints it, for testing
+// webhooks without the real receiver.
+func runWebhookReceiver(args []string) {
+	fs := flag.NewFlagSet("webhook-receiver", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:9090", "address to listen on")
+	secret := fs.String("secret", "", "the webhook's secret from -webhooks-file")
+	failFirst := fs.Int("fail", 0, "answer the first n deliveries with 503, to try out retries")
+	fs.Parse(args)
+	if *secret == "" {
+		log.Fatalf("webhook-receiver: -secret is required")
+	}
+
+	var received atomic.Int64
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := verifyWebhook([]byte(*secret), r.Header.Get("X-Webhook-Signature"), body, time.Now()); err != nil {
+			logf("REJECTED: %s %s: %v", r.Header.Get("X-Webhook-Event"), r.Header.Get("X-Webhook-Delivery"), err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if n := received.Add(1); n <= int64(*failFirst) {
+			logf("FAILING ON PURPOSE: %s %s (%d of %d)", r.Header.Get("X-Webhook-Event"), r.Header.Get("X-Webhook-Delivery"), n, *failFirst)
+			http.Error(w, "failing on purpose", http.StatusServiceUnavailable)
+			return
+		}
+		logf("VERIFIED: %s %s\n%s", r.Header.Get("X-Webhook-Event"), r.Header.Get("X-Webhook-Delivery"), body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	logf("Webhook receiver listening on http://%s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
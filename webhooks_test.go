@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	oldSecret := []byte("old-secret-0123456789")
+	newSecret := []byte("new-secret-0123456789")
+	body := []byte(`{"id":"evt_1","type":"job.completed"}`)
+	sent := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		signed  [][]byte // secrets the sender signs with
+		secret  []byte   // secret the receiver checks with
+		body    []byte
+		now     time.Time
+		header  string // overrides the signature when set
+		wantErr string
+	}{
+		{name: "valid", signed: [][]byte{newSecret}, secret: newSecret, body: body, now: sent},
+		{name: "within tolerance", signed: [][]byte{newSecret}, secret: newSecret, body: body, now: sent.Add(4 * time.Minute)},
+		{name: "tampered body", signed: [][]byte{newSecret}, secret: newSecret, body: []byte(`{"id":"evt_1","type":"job.failed"}`), now: sent, wantErr: "doesn't match"},
+		{name: "wrong secret", signed: [][]byte{newSecret}, secret: []byte("another-secret-0123456"), body: body, now: sent, wantErr: "doesn't match"},
+		{name: "stale timestamp", signed: [][]byte{newSecret}, secret: newSecret, body: body, now: sent.Add(6 * time.Minute), wantErr: "more than"},
+		{name: "timestamp in the future", signed: [][]byte{newSecret}, secret: newSecret, body: body, now: sent.Add(-6 * time.Minute), wantErr: "more than"},
+		{name: "rotating: receiver still on old secret", signed: [][]byte{newSecret, oldSecret}, secret: oldSecret, body: body, now: sent},
+		{name: "rotating: receiver on new secret", signed: [][]byte{newSecret, oldSecret}, secret: newSecret, body: body, now: sent},
+		{name: "rotated: old secret retired", signed: [][]byte{newSecret}, secret: oldSecret, body: body, now: sent, wantErr: "doesn't match"},
+		{name: "malformed header", secret: newSecret, body: body, now: sent, header: "v1=abc", wantErr: "malformed"},
+		{name: "no signature", secret: newSecret, body: body, now: sent, header: "t=1700000000", wantErr: "malformed"},
+	}
+	for _, tt := range tests {
+		header := tt.header
+		if header == "" {
+			header = signWebhook(tt.signed, sent, body)
+		}
+		err := verifyWebhook(tt.secret, header, tt.body, tt.now)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSignWebhookFormat(t *testing.T) {
+	secrets := [][]byte{[]byte("new-secret-0123456789"), []byte("old-secret-0123456789")}
+	header := signWebhook(secrets, time.Unix(1700000000, 0), []byte("{}"))
+
+	want := "t=1700000000"
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("1700000000.{}"))
+		want += ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	if header != want {
+		t.Errorf("signWebhook = %q, want %q", header, want)
+	}
+}
+
+// Webhooks sharing a URL each sign their deliveries with their own secret.
+func TestDeliveriesToWebhooksSharingAURL(t *testing.T) {
+	var mu sync.Mutex
+	signatures := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		signatures[r.Header.Get("X-Webhook-Delivery")] = r.Header.Get("X-Webhook-Signature")
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	secrets := [][]byte{[]byte("first-secret-0123456789"), []byte("second-secret-0123456789")}
+	oldHooks, oldLog := webhooks, webhookLog
+	webhooks = []webhook{{URL: srv.URL, Secrets: secrets[:1]}, {URL: srv.URL, Secrets: secrets[1:]}}
+	webhookLog = openTestStore(t, filepath.Join(t.TempDir(), "webhooks.db"))
+	t.Cleanup(func() { webhooks, webhookLog = oldHooks, oldLog })
+
+	for i, secret := range secrets {
+		d := &WebhookDelivery{ID: "dlv_" + randomHex(4), Event: eventPing, URL: srv.URL, Webhook: i, State: deliveryPending, CreatedAt: time.Now().UTC(), Payload: []byte("{}")}
+		d.NextAttempt = &d.CreatedAt
+		deliverWebhook(d)
+		if d.State != deliveryDelivered {
+			t.Fatalf("delivery to webhook %d is %s", i, d.State)
+		}
+		mu.Lock()
+		header := signatures[d.ID]
+		mu.Unlock()
+		if err := verifyWebhook(secret, header, d.Payload, time.Now()); err != nil {
+			t.Errorf("delivery to webhook %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+const xmpSignature = "http://ns.adobe.com/xap/1.0/\x00"
+
+const rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+// xmpPrefixes gives the usual prefix for the XMP namespaces we report.
+// Properties in other namespaces are reported by their local name.
+var xmpPrefixes = map[string]string{
+	"http://purl.org/dc/elements/1.1/":            "dc",
+	"http://ns.adobe.com/xap/1.0/":                "xmp",
+	"http://ns.adobe.com/xap/1.0/rights/":         "xmpRights",
+	"http://ns.adobe.com/xap/1.0/mm/":             "xmpMM",
+	"http://ns.adobe.com/photoshop/1.0/":          "photoshop",
+	"http://ns.adobe.com/tiff/1.0/":               "tiff",
+	"http://ns.adobe.com/exif/1.0/":               "exif",
+	"http://ns.adobe.com/exif/1.0/aux/":           "aux",
+	"http://cipa.jp/exif/1.0/":                    "exifEX",
+	"http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/": "Iptc4xmpCore",
+}
+
+// xmpPayload returns the XMP packet of a JPEG, or nil if it has none.
+func xmpPayload(data []byte) []byte {
+	for _, s := range jpegSegments(data) {
+		if s.Marker == 0xE1 && bytes.HasPrefix(s.Data, []byte(xmpSignature)) {
+			return s.Data[len(xmpSignature):]
+		}
+	}
+	return nil
+}
+
+// xmlNode is any XML element, kept whole.
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Text    string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+// parseXMP flattens the simple properties of an XMP packet into a map from
+// "prefix:Name" to a string, or to a list of strings for bags and
+// sequences. Language alternatives give their first value. Structured
+// properties are left out.
+func parseXMP(packet []byte) map[string]interface{} {
+	var root xmlNode
+	if err := xml.Unmarshal(packet, &root); err != nil {
+		return nil
+	}
+	props := make(map[string]interface{})
+	var walk func(n xmlNode)
+	walk = func(n xmlNode) {
+		if n.XMLName.Space == rdfNamespace && n.XMLName.Local == "Description" {
+			for _, a := range n.Attrs {
+				if a.Name.Space == rdfNamespace || a.Name.Space == "xmlns" || a.Name.Space == "" {
+					continue
+				}
+				props[xmpName(a.Name)] = strings.TrimSpace(a.Value)
+			}
+			for _, p := range n.Nodes {
+				if v := xmpValue(p); v != nil {
+					props[xmpName(p.XMLName)] = v
+				}
+			}
+			return
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	walk(root)
+	return props
+}
+
+func xmpName(n xml.Name) string {
+	if prefix, ok := xmpPrefixes[n.Space]; ok {
+		return prefix + ":" + n.Local
+	}
+	return n.Local
+}
+
+// xmpValue returns the value of one property element, or nil if it isn't
+// simple text or a list of it.
+func xmpValue(p xmlNode) interface{} {
+	if len(p.Nodes) == 0 {
+		if text := strings.TrimSpace(p.Text); text != "" {
+			return text
+		}
+		return nil
+	}
+	container := p.Nodes[0]
+	if container.XMLName.Space != rdfNamespace {
+		return nil
+	}
+	var items []string
+	for _, li := range container.Nodes {
+		if li.XMLName.Space == rdfNamespace && li.XMLName.Local == "li" && len(li.Nodes) == 0 {
+			items = append(items, strings.TrimSpace(li.Text))
+		}
+	}
+	switch container.XMLName.Local {
+	case "Alt":
+		if len(items) > 0 {
+			return items[0]
+		}
+	case "Bag", "Seq":
+		if len(items) > 0 {
+			return items
+		}
+	}
+	return nil
+}